@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/oceanplexian/go-openai-proxy/internal"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// configFlagPaths are the settings with a flag of their own; -set covers every other one.
+var configFlagPaths = map[string]string{
+	"listeners": "listeners",
+	"logLevel":  "logConfig.logLevel",
+	"certFile":  "certFile",
+	"keyFile":   "keyFile",
+	"useTLS":    "useTLS",
+}
+
+// overrideFlags collects repeated -set path=value flags.
+type overrideFlags []internal.ConfigOverride
+
+func (o *overrideFlags) String() string {
+	return ""
+}
+
+func (o *overrideFlags) Set(value string) error {
+	path, setting, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("%w: %q is not path=value", internal.ErrUnknownSetting, value)
+	}
+
+	*o = append(*o, internal.ConfigOverride{Path: path, Value: setting})
+
+	return nil
+}
+
+// registerConfigFlags adds the configuration flags to flags. The returned function builds the
+// layers from them once flags are parsed; only flags that were passed override the file.
+func registerConfigFlags(flags *flag.FlagSet) (*string, func() internal.ConfigLayers) {
+	configPath := flags.String("config", "config.yaml", "Path to the configuration file")
+	flags.String("listeners", "", "Comma-separated list of listeners to override config: interface:port, [ipv6]:port, unix:/path or systemd:name")
+	flags.String("logLevel", "", "Log level")
+	flags.String("certFile", "", "Path to the certificate file")
+	flags.String("keyFile", "", "Path to the key file")
+	flags.Bool("useTLS", false, "Whether to use TLS")
+
+	var overrides overrideFlags
+
+	flags.Var(&overrides, "set", "Override any setting as path=value, e.g. upstreams.Primary.priority=2 (repeatable)")
+
+	return configPath, func() internal.ConfigLayers {
+		layers := internal.ConfigLayers{Env: os.Environ()}
+
+		flags.Visit(func(f *flag.Flag) {
+			path, ok := configFlagPaths[f.Name]
+			if !ok {
+				return
+			}
+
+			value := f.Value.String()
+			if f.Name == "listeners" {
+				value = listenersYAML(value)
+			}
+
+			layers.Flags = append(layers.Flags, internal.ConfigOverride{Path: path, Value: value})
+		})
+
+		layers.Flags = append(layers.Flags, overrides...)
+
+		return layers
+	}
+}
+
+// listenersYAML turns "interface:port,unix:/path,systemd:name,..." into the YAML list of the
+// listeners setting.
+func listenersYAML(cliListeners string) string {
+	listeners := []internal.Listener{}
+
+	for _, cliListener := range strings.Split(cliListeners, ",") {
+		listener, err := internal.ParseListener(cliListener)
+		if err != nil {
+			log.Error("Invalid listener format, skipping: ", cliListener)
+			continue
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	data, _ := yaml.Marshal(listeners)
+
+	return string(data)
+}
+
+// runPrintConfig prints the effective configuration and where each setting came from.
+func runPrintConfig(args []string) int {
+	flags := flag.NewFlagSet("print-config", flag.ExitOnError)
+	configPath, layers := registerConfigFlags(flags)
+	_ = flags.Parse(args)
+
+	cfg, sources, err := internal.LoadConfigLayers(*configPath, layers())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	for _, warning := range cfg.Warnings() {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "SETTING\tVALUE\tSOURCE")
+
+	for _, setting := range internal.EffectiveSettings(cfg, sources) {
+		fmt.Fprintf(out, "%s\t%s\t%s\n", setting.Path, setting.Value, setting.Source)
+	}
+
+	_ = out.Flush()
+
+	if err := internal.ValidateConfig(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
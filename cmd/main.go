@@ -1,136 +1,222 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
 	"sync"
-	"time"
+	"syscall"
 
 	"github.com/oceanplexian/go-openai-proxy/internal"
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	ReadTimeout  = 10 * time.Second
-	WriteTimeout = 10 * time.Second
-)
+// subcommands run instead of the proxy when named as the first argument.
+var subcommands = map[string]func(args []string) int{
+	"print-config": runPrintConfig,
+	"replay":       runReplay,
+	"secrets":      runSecrets,
+	"validate":     runValidate,
+}
 
 func main() {
-	var configPath, cliListeners, logLevel, certFile, keyFile string
-
-	var useTLS bool
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(subcommand(os.Args[2:]))
+		}
+	}
 
-	flag.StringVar(&configPath, "config", "config.yaml", "Path to the configuration file")
-	flag.StringVar(&cliListeners, "listeners", "", "Comma-separated list of listeners to override config")
-	flag.StringVar(&logLevel, "logLevel", "", "Log level")
-	flag.StringVar(&certFile, "certFile", "", "Path to the certificate file")
-	flag.StringVar(&keyFile, "keyFile", "", "Path to the key file")
-	flag.BoolVar(&useTLS, "useTLS", false, "Whether to use TLS")
+	configPath, layers := registerConfigFlags(flag.CommandLine)
 	flag.Parse()
 
-	cfg, err := internal.LoadConfig(configPath)
+	live, err := internal.NewLiveConfig(*configPath, layers())
 	if err != nil {
 		log.Fatal("Couldn't load configuration: ", err)
 	}
 
-	cfg.UseTLS = useTLS
+	cfg := live.Load()
 
-	if certFile != "" {
-		cfg.CertFile = certFile
+	// Initialize the logger in logger.go
+	logger, err := internal.InitializeLogger(&cfg.LogConfig)
+
+	if err != nil {
+		fmt.Println("Failed to initialize logger:", err) //nolint
+		os.Exit(1)
 	}
 
-	if logLevel != "" {
-		cfg.LogConfig.LogLevel = logLevel
+	for _, warning := range cfg.Warnings() {
+		logger.Warn(warning)
 	}
 
-	if keyFile != "" {
-		cfg.KeyFile = keyFile
+	if err := internal.InitializeRateLimiter(&cfg.RateLimits); err != nil {
+		logger.WithFields(log.Fields{"error": err}).Fatal("Failed to initialize rate limiter")
 	}
 
-	if cliListeners != "" {
-		overrideListeners(cfg, cliListeners)
+	if err := internal.InitializeUsageStore(&cfg.Usage); err != nil {
+		logger.WithFields(log.Fields{"error": err}).Fatal("Failed to initialize usage store")
 	}
 
-	// Initialize the logger in logger.go
-	logger, err := internal.InitializeLogger(&cfg.LogConfig)
+	if err := internal.InitializeResponseCache(&cfg.Cache); err != nil {
+		logger.WithFields(log.Fields{"error": err}).Fatal("Failed to initialize response cache")
+	}
 
-	if err != nil {
-		fmt.Println("Failed to initialize logger:", err) //nolint
-		os.Exit(1)
+	if err := internal.InitializeRedaction(&cfg.Redaction); err != nil {
+		logger.WithFields(log.Fields{"error": err}).Fatal("Failed to initialize redaction")
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		internal.Response(cfg, logger, w, r)
-	})
+	if err := internal.InitializeAuditLog(&cfg.Audit); err != nil {
+		logger.WithFields(log.Fields{"error": err}).Fatal("Failed to initialize audit log")
+	}
 
-	startListeners(cfg, logger)
-}
+	if err := internal.InitializeCapture(&cfg.Capture); err != nil {
+		logger.WithFields(log.Fields{"error": err}).Fatal("Failed to initialize capture")
+	}
+
+	internal.InitializeMetrics(cfg)
+	internal.InitializeDashboard(&cfg.Admin.Dashboard)
 
-func overrideListeners(cfg *internal.Config, cliListeners string) {
-	const ExpectedParts = 2
+	if err := internal.InitializeTracing(&cfg.Tracing); err != nil {
+		logger.WithFields(log.Fields{"error": err}).Fatal("Failed to initialize tracing")
+	}
 
-	cfg.Listeners = []internal.Listener{}
+	// SIGTERM and SIGINT start a graceful shutdown; a second one stops the proxy right away.
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stopSignals()
 
-	for _, cliListener := range strings.Split(cliListeners, ",") {
-		parts := strings.Split(cliListener, ":")
-		isValidFormat := len(parts) == ExpectedParts
+	go live.Watch(logger)
 
-		if !isValidFormat {
-			log.Error("Invalid listener format, skipping: ", cliListener)
-			continue
+	// Requests run in contexts derived from requestsCtx, cancelling it aborts their upstream calls.
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	activeRequests := newRequestTracker()
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// Requests arriving on connections that are still open while draining are turned away.
+		if !activeRequests.start() {
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+
+			return
 		}
+		defer activeRequests.done()
 
-		newListener := internal.Listener{Interface: parts[0], Port: parts[1]}
-		cfg.Listeners = append(cfg.Listeners, newListener)
-	}
-}
+		internal.Response(live.Load(), logger, w, r)
+	})
 
-// startListener uses a logger from the context for logging.
-func startListener(cfg *internal.Config, logger *log.Logger, listener internal.Listener) {
-	address := fmt.Sprintf("%s:%s", listener.Interface, listener.Port)
+	servers, stopped := startListeners(cfg, logger, requestsCtx)
 
-	defaultTimeout := 10 * time.Second
+	if cfg.Admin.Port != "" {
+		if server := startAdminListener(live, logger); server != nil {
+			servers = append(servers, server)
+		}
+	}
 
-	server := &http.Server{
-		Addr:         address,
-		Handler:      nil,
-		ReadTimeout:  defaultTimeout,
-		WriteTimeout: defaultTimeout,
+	select {
+	case <-signals.Done():
+		stopSignals()
+		logger.WithFields(log.Fields{"drainTimeout": live.Load().Shutdown.DrainTimeout.String()}).Info("Shutting down, draining active streams")
+	case <-stopped:
+		logger.Error("All listeners stopped, shutting down")
 	}
 
-	if cfg.UseTLS {
+	shutdownServers(servers, live.Load().Shutdown.DrainTimeout, cancelRequests, activeRequests, logger)
+	flushOnShutdown(logger)
+}
+
+// startListener uses a logger from the context for logging. It returns once the listener stops.
+func startListener(logger *log.Logger, server *http.Server, socket net.Listener) {
+	address := server.Addr
+
+	if server.TLSConfig != nil {
 		logger.WithFields(log.Fields{"address": address}).Info("Starting TLS listener")
-		logger.WithFields(log.Fields{"certFile": cfg.CertFile, "keyFile": cfg.KeyFile}).Info("Loading certificates")
 
-		err := server.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
-		if err != nil {
-			logger.WithFields(log.Fields{"address": address, "error": err}).Error("ListenAndServeTLS")
+		// The certificates come from the TLS configuration, which reloads them when they change.
+		err := server.ServeTLS(socket, "", "")
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.WithFields(log.Fields{"address": address, "error": err}).Error("ServeTLS")
 		}
 	} else {
 		logger.WithFields(log.Fields{"address": address}).Info("Starting listener")
 
+		err := server.Serve(socket)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.WithFields(log.Fields{"address": address, "error": err}).Error("Serve")
+		}
+	}
+}
+
+// startAdminListener serves the admin API on its own address so it is never exposed to clients.
+func startAdminListener(live *internal.LiveConfig, logger *log.Logger) *http.Server {
+	cfg := live.Load()
+	address := net.JoinHostPort(cfg.Admin.Interface, cfg.Admin.Port)
+
+	if cfg.Admin.Token == "" {
+		logger.WithFields(log.Fields{"address": address}).Error("Admin listener needs a token, not starting it")
+		return nil
+	}
+
+	server := &http.Server{
+		Addr:              address,
+		Handler:           internal.AdminHandler(live, logger),
+		ReadHeaderTimeout: internal.DefaultReadHeaderTimeout,
+	}
+
+	logger.WithFields(log.Fields{"address": address}).Info("Starting admin listener")
+
+	go func() {
 		err := server.ListenAndServe()
-		if err != nil {
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logger.WithFields(log.Fields{"address": address, "error": err}).Error("ListenAndServe")
 		}
-	}
+	}()
+
+	return server
 }
 
-// startListeners starts all listeners and uses the context for logging.
-func startListeners(cfg *internal.Config, logger *log.Logger) {
+// startListeners starts all listeners and uses the context for logging. stopped is closed once
+// all of them have stopped.
+func startListeners(cfg *internal.Config, logger *log.Logger, requestsCtx context.Context) ([]*http.Server, <-chan struct{}) {
 	var listenerWaitGroup sync.WaitGroup
+
+	servers := make([]*http.Server, 0, len(cfg.Listeners))
+
 	for _, listener := range cfg.Listeners {
+		server, err := internal.NewListenerServer(cfg, listener, http.DefaultServeMux, logger)
+		if err != nil {
+			logger.WithFields(log.Fields{"address": listener.Address(), "error": err}).Error("Loading certificates")
+			continue
+		}
+
+		socket, err := internal.Listen(listener)
+		if err != nil {
+			logger.WithFields(log.Fields{"address": listener.Address(), "error": err}).Error("Listen")
+			continue
+		}
+
+		server.BaseContext = func(net.Listener) context.Context { return requestsCtx }
+		servers = append(servers, server)
+
 		listenerWaitGroup.Add(1)
 
-		listenerFunc := func(listener internal.Listener) {
+		listenerFunc := func(server *http.Server, socket net.Listener) {
 			defer listenerWaitGroup.Done()
-			startListener(cfg, logger, listener)
+			startListener(logger, server, socket)
 		}
-		go listenerFunc(listener)
+		go listenerFunc(server, socket)
 	}
 
-	listenerWaitGroup.Wait()
+	stopped := make(chan struct{})
+
+	go func() {
+		listenerWaitGroup.Wait()
+		close(stopped)
+	}()
+
+	return servers, stopped
 }
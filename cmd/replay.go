@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oceanplexian/go-openai-proxy/internal"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	replayTimeout = 5 * time.Minute
+	// maxDiffWords bounds the word diff, which needs memory quadratic in the response length.
+	maxDiffWords = 4000
+)
+
+// replayResult is a line of the replay command's -out file.
+type replayResult struct {
+	ID               string  `json:"id"`
+	Model            string  `json:"model"`
+	RecordedUpstream string  `json:"recordedUpstream"`
+	Upstream         string  `json:"upstream"`
+	Recorded         string  `json:"recorded"`
+	Replayed         string  `json:"replayed"`
+	Identical        bool    `json:"identical"`
+	Similarity       float64 `json:"similarity"`
+	Error            string  `json:"error,omitempty"`
+}
+
+// runReplay re-sends the requests of a capture archive to an upstream and diffs the answers with
+// the recorded ones.
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	configPath := flags.String("config", "config.yaml", "Path to the configuration file")
+	archivePath := flags.String("archive", "", "Capture archive to replay")
+	upstreamName := flags.String("upstream", "", "Upstream to send the requests to")
+	model := flags.String("model", "", "Only replay requests for this model")
+	limit := flags.Int("limit", 0, "Replay at most this many requests")
+	outPath := flags.String("out", "", "Write the results as JSONL to this file")
+	_ = flags.Parse(args)
+
+	if *archivePath == "" || *upstreamName == "" {
+		fmt.Fprintln(os.Stderr, "usage: replay -archive capture.jsonl -upstream NAME [-config config.yaml] [-model MODEL] [-limit N] [-out results.jsonl]")
+		return 2
+	}
+
+	cfg, err := internal.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't load configuration:", err)
+		return 1
+	}
+
+	if _, ok := cfg.Upstreams[*upstreamName]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown upstream %q\n", *upstreamName)
+		return 1
+	}
+
+	records, err := internal.ReadCaptureArchive(*archivePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var out io.Writer = io.Discard
+
+	if *outPath != "" {
+		file, err := os.Create(*outPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+
+		out = file
+	}
+
+	logger := log.New()
+	logger.SetOutput(os.Stderr)
+	logger.SetLevel(log.WarnLevel)
+
+	var replayed, identical, failed int
+
+	for _, record := range records {
+		if *model != "" && record.Request.Model != *model {
+			continue
+		}
+
+		if *limit > 0 && replayed >= *limit {
+			break
+		}
+
+		replayed++
+
+		result := replayRecord(cfg, logger, *upstreamName, record)
+
+		switch {
+		case result.Error != "":
+			failed++
+
+			fmt.Printf("%s %s %s -> %s: failed: %s\n", result.ID, result.Model, result.RecordedUpstream, result.Upstream, result.Error)
+		case result.Identical:
+			identical++
+
+			fmt.Printf("%s %s %s -> %s: identical\n", result.ID, result.Model, result.RecordedUpstream, result.Upstream)
+		default:
+			fmt.Printf("%s %s %s -> %s: differs (similarity %.2f)\n    %s\n",
+				result.ID, result.Model, result.RecordedUpstream, result.Upstream, result.Similarity,
+				wordDiff(strings.Fields(result.Recorded), strings.Fields(result.Replayed)))
+		}
+
+		line, err := json.Marshal(result)
+		if err == nil {
+			_, err = fmt.Fprintf(out, "%s\n", line)
+		}
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to write result:", err)
+			return 1
+		}
+	}
+
+	fmt.Printf("\n%d replayed, %d identical, %d different, %d failed\n", replayed, identical, replayed-identical-failed, failed)
+
+	return 0
+}
+
+func replayRecord(cfg *internal.Config, logger *log.Logger, upstreamName string, record internal.CaptureRecord) replayResult {
+	result := replayResult{
+		ID:               record.ID,
+		Model:            record.Request.Model,
+		RecordedUpstream: record.Upstream,
+		Upstream:         upstreamName,
+		Recorded:         record.Response,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), replayTimeout)
+	defer cancel()
+
+	replayed, err := internal.CompleteRequest(ctx, cfg, logger.WithFields(log.Fields{"requestId": record.ID}), upstreamName, record.Request)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Replayed = replayed
+	result.Identical = replayed == record.Response
+	result.Similarity = similarity(strings.Fields(record.Response), strings.Fields(replayed))
+
+	return result
+}
+
+// similarity is the share of words the two texts have in common, in order: 1 for identical texts.
+func similarity(a []string, b []string) float64 {
+	if len(a)+len(b) == 0 {
+		return 1
+	}
+
+	if len(a) > maxDiffWords || len(b) > maxDiffWords {
+		return 0
+	}
+
+	return 2 * float64(len(longestCommonSubsequence(a, b))) / float64(len(a)+len(b))
+}
+
+// wordDiff marks the words removed from a with [-...-] and the words added in b with {+...+}.
+func wordDiff(a []string, b []string) string {
+	if len(a) > maxDiffWords || len(b) > maxDiffWords {
+		return "(too long to diff)"
+	}
+
+	var diff []string
+
+	i, j := 0, 0
+	for _, common := range longestCommonSubsequence(a, b) {
+		for ; a[i] != common; i++ {
+			diff = append(diff, "[-"+a[i]+"-]")
+		}
+
+		for ; b[j] != common; j++ {
+			diff = append(diff, "{+"+b[j]+"+}")
+		}
+
+		diff = append(diff, common)
+		i++
+		j++
+	}
+
+	for ; i < len(a); i++ {
+		diff = append(diff, "[-"+a[i]+"-]")
+	}
+
+	for ; j < len(b); j++ {
+		diff = append(diff, "{+"+b[j]+"+}")
+	}
+
+	return strings.Join(diff, " ")
+}
+
+func longestCommonSubsequence(a []string, b []string) []string {
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else {
+				lengths[i][j] = lengths[i+1][j]
+				if lengths[i][j+1] > lengths[i][j] {
+					lengths[i][j] = lengths[i][j+1]
+				}
+			}
+		}
+	}
+
+	var common []string
+
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			common = append(common, a[i])
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+
+	return common
+}
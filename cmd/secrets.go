@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/oceanplexian/go-openai-proxy/internal"
+)
+
+const secretsUsage = `usage:
+  secrets keygen                         print a new key for PROXY_SECRETS_KEY
+  secrets encrypt [plain.yaml] > file    encrypt a YAML map of names to values (stdin if no file)
+  secrets decrypt [file]                 print the decrypted secrets (stdin if no file)`
+
+// runSecrets manages the encrypted secrets file. encrypt and decrypt read the key from the
+// environment, the same way the proxy does.
+func runSecrets(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, secretsUsage)
+		return 2
+	}
+
+	if args[0] == "keygen" {
+		key, err := internal.GenerateSecretsKey()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		fmt.Println(key)
+
+		return 0
+	}
+
+	var transform func(key []byte, data []byte) ([]byte, error)
+
+	switch args[0] {
+	case "encrypt":
+		transform = internal.EncryptSecrets
+	case "decrypt":
+		transform = internal.DecryptSecrets
+	default:
+		fmt.Fprintln(os.Stderr, secretsUsage)
+		return 2
+	}
+
+	key, err := internal.LoadSecretsKey()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	input := io.Reader(os.Stdin)
+
+	if len(args) > 1 {
+		file, err := os.Open(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+
+		input = file
+	}
+
+	data, err := io.ReadAll(input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	output, err := transform(key, data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	_, _ = os.Stdout.Write(output)
+
+	return 0
+}
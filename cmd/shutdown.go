@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oceanplexian/go-openai-proxy/internal"
+	log "github.com/sirupsen/logrus"
+)
+
+// cancelGrace is how long requests get to finish up after their upstream calls were cancelled,
+// e.g. to write the audit log entry.
+const cancelGrace = 5 * time.Second
+
+// shutdownServers stops accepting connections and waits up to drainTimeout for active requests to
+// finish. The upstream calls of those still running then are cancelled.
+func shutdownServers(servers []*http.Server, drainTimeout time.Duration, cancelRequests context.CancelFunc, activeRequests *requestTracker, logger *log.Logger) {
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	var serversWaitGroup sync.WaitGroup
+
+	for _, server := range servers {
+		serversWaitGroup.Add(1)
+
+		go func(server *http.Server) {
+			defer serversWaitGroup.Done()
+
+			if err := server.Shutdown(drainCtx); err != nil {
+				logger.WithFields(log.Fields{"address": server.Addr, "error": err}).Warn("Drain timeout reached, cancelling remaining streams")
+			}
+		}(server)
+	}
+
+	serversWaitGroup.Wait()
+
+	// Shutdown doesn't wait for h2c connections, which are taken over from the server; their
+	// streams get what is left of the drain timeout.
+	deadline, _ := drainCtx.Deadline()
+	if drainCtx.Err() == nil && !activeRequests.wait(time.Until(deadline)) {
+		logger.Warn("Drain timeout reached, cancelling remaining streams")
+	}
+
+	cancelRequests()
+
+	if !activeRequests.wait(cancelGrace) {
+		logger.Warn("Requests still running after their upstream calls were cancelled, closing their connections")
+	}
+
+	for _, server := range servers {
+		server.Close()
+	}
+}
+
+// requestTracker counts the requests being served. Once draining starts new requests are refused,
+// so that the count only goes down while shutdown waits for it to reach zero.
+type requestTracker struct {
+	mu       sync.Mutex
+	active   int
+	draining bool
+	idle     chan struct{} // Closed once draining and no request is left
+}
+
+func newRequestTracker() *requestTracker {
+	return &requestTracker{idle: make(chan struct{})}
+}
+
+// start counts a new request, and reports false when the proxy is draining instead.
+func (t *requestTracker) start() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.draining {
+		return false
+	}
+
+	t.active++
+
+	return true
+}
+
+func (t *requestTracker) done() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.active--
+	if t.draining && t.active == 0 {
+		close(t.idle)
+	}
+}
+
+// wait starts draining, and reports whether the active requests finished within timeout.
+func (t *requestTracker) wait(timeout time.Duration) bool {
+	t.mu.Lock()
+	if !t.draining {
+		t.draining = true
+		if t.active == 0 {
+			close(t.idle)
+		}
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-t.idle:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// flushOnShutdown writes out everything that is still buffered and closes the stores.
+func flushOnShutdown(logger *log.Logger) {
+	flushes := []struct {
+		name  string
+		flush func() error
+	}{
+		{"traces", internal.ShutdownTracing},
+		{"usage store", internal.CloseUsageStore},
+		{"capture archive", internal.CloseCapture},
+		{"audit log", internal.CloseAuditLog},
+	}
+
+	for _, f := range flushes {
+		if err := f.flush(); err != nil {
+			logger.WithFields(log.Fields{"error": err}).Error("Failed to flush " + f.name)
+		}
+	}
+
+	logger.Info("Shutdown complete")
+
+	if err := internal.CloseLogger(logger); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to close log:", err) //nolint
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestShutdownServers(t *testing.T) {
+	tests := []struct {
+		name          string
+		drainTimeout  time.Duration
+		work          time.Duration
+		wantCancelled bool
+	}{
+		{name: "finishes while draining", drainTimeout: 5 * time.Second, work: 50 * time.Millisecond},
+		{name: "cancelled after the drain timeout", drainTimeout: 50 * time.Millisecond, work: time.Minute, wantCancelled: true},
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requestsCtx, cancelRequests := context.WithCancel(context.Background())
+			defer cancelRequests()
+
+			activeRequests := newRequestTracker()
+
+			started := make(chan struct{})
+			cancelled := make(chan bool, 1)
+
+			server := &http.Server{
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if !activeRequests.start() {
+						t.Error("the request was refused before draining")
+						return
+					}
+					defer activeRequests.done()
+
+					close(started)
+
+					select {
+					case <-time.After(test.work):
+						cancelled <- false
+					case <-r.Context().Done():
+						cancelled <- true
+					}
+				}),
+				BaseContext: func(net.Listener) context.Context { return requestsCtx },
+			}
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			go server.Serve(listener) //nolint:errcheck
+
+			go func() {
+				if resp, err := http.Get("http://" + listener.Addr().String()); err == nil {
+					resp.Body.Close()
+				}
+			}()
+
+			<-started
+
+			begin := time.Now()
+			shutdownServers([]*http.Server{server}, test.drainTimeout, cancelRequests, activeRequests, logger)
+
+			if got := <-cancelled; got != test.wantCancelled {
+				t.Errorf("request cancelled = %v, want %v", got, test.wantCancelled)
+			}
+
+			if elapsed := time.Since(begin); elapsed > test.drainTimeout+cancelGrace {
+				t.Errorf("shutdown took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestRequestTracker(t *testing.T) {
+	tests := []struct {
+		name   string
+		active int // requests still running when draining starts
+		finish int // of which finish while shutdown waits
+		want   bool
+	}{
+		{name: "idle", want: true},
+		{name: "requests finish", active: 2, finish: 2, want: true},
+		{name: "a request keeps running", active: 2, finish: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newRequestTracker()
+
+			for i := 0; i < test.active; i++ {
+				if !tracker.start() {
+					t.Fatal("a request was refused before draining")
+				}
+			}
+
+			for i := 0; i < test.finish; i++ {
+				time.AfterFunc(10*time.Millisecond, tracker.done)
+			}
+
+			if finished := tracker.wait(time.Second); finished != test.want {
+				t.Errorf("wait() = %v, want %v", finished, test.want)
+			}
+
+			if tracker.start() {
+				t.Error("a request was accepted while draining")
+			}
+		})
+	}
+}
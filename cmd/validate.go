@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/oceanplexian/go-openai-proxy/internal"
+)
+
+// runValidate checks configuration files without starting the proxy, e.g. in CI.
+func runValidate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: validate [config.yaml ...]")
+	}
+	_ = flags.Parse(args)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"config.yaml"}
+	}
+
+	status := 0
+
+	for _, path := range paths {
+		warnings, err := validateConfigFile(path)
+		if err != nil {
+			status = 1
+
+			fmt.Printf("%s: invalid\n", path)
+
+			var joined interface{ Unwrap() []error }
+			if errors.As(err, &joined) {
+				for _, problem := range joined.Unwrap() {
+					fmt.Printf("  %s\n", problem)
+				}
+			} else {
+				fmt.Printf("  %s\n", err)
+			}
+
+			continue
+		}
+
+		fmt.Printf("%s: ok\n", path)
+
+		for _, warning := range warnings {
+			fmt.Printf("  warning: %s\n", warning)
+		}
+	}
+
+	return status
+}
+
+// validateConfigFile checks a file, returning the warnings of a valid one.
+func validateConfigFile(path string) ([]string, error) {
+	cfg, err := internal.LoadConfig(path)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	return cfg.Warnings(), internal.ValidateConfig(cfg) //nolint:wrapcheck
+}
@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AdminHandler serves the admin API. It is meant for its own listener, away from client traffic.
+func AdminHandler(live *LiveConfig, logger *log.Logger) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/admin/usage", func(w http.ResponseWriter, r *http.Request) {
+		handleUsageReport(logger, w, r)
+	})
+
+	mux.HandleFunc("/admin/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed", "invalid_request_error", "")
+			return
+		}
+
+		writeAdminJSON(logger, w, map[string]interface{}{"data": UpstreamStatuses(live.Load())})
+	})
+
+	mux.HandleFunc("/admin/upstreams/", func(w http.ResponseWriter, r *http.Request) {
+		handleUpstreamChange(live, logger, w, r)
+	})
+
+	mux.HandleFunc("/admin/requests", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed", "invalid_request_error", "")
+			return
+		}
+
+		writeAdminJSON(logger, w, map[string]interface{}{"data": InflightCalls()})
+	})
+
+	mux.HandleFunc("/admin/reload", func(w http.ResponseWriter, r *http.Request) {
+		handleReload(live, logger, w, r)
+	})
+
+	mux.Handle("/admin/dashboard/", dashboardStatic())
+
+	mux.HandleFunc("/admin/dashboard/api/", func(w http.ResponseWriter, r *http.Request) {
+		handleDashboardAPI(logger, w, r)
+	})
+
+	mux.Handle("/metrics", MetricsHandler())
+
+	return requireAdminToken(live, mux)
+}
+
+func requireAdminToken(live *LiveConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := live.Load()
+		if cfg.Admin.PublicMetrics && r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The dashboard page asks for the token itself and sends it with its API requests.
+		if isDashboardPage(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if cfg.Admin.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Admin.Token.Value())) != 1 {
+			writeAPIError(w, http.StatusUnauthorized, "Invalid admin token", "invalid_request_error", "invalid_api_key")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleUsageReport answers GET /admin/usage?groupBy=key,model&from=2023-09-01&to=2023-10-01.
+// The range defaults to the current month and results are grouped by key unless asked otherwise.
+func handleUsageReport(logger *log.Logger, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed", "invalid_request_error", "")
+		return
+	}
+
+	if usageStore == nil {
+		writeAPIError(w, http.StatusNotFound, "Usage tracking is not enabled", "invalid_request_error", "")
+		return
+	}
+
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := now.Add(time.Second)
+
+	query := r.URL.Query()
+
+	for name, target := range map[string]*time.Time{"from": &from, "to": &to} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+
+		parsed, err := parseReportTime(value)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "Invalid "+name+": "+err.Error(), "invalid_request_error", "")
+			return
+		}
+
+		*target = parsed
+	}
+
+	groupBy := []string{"key"}
+	if value := query.Get("groupBy"); value != "" {
+		groupBy = strings.Split(value, ",")
+	}
+
+	report, err := usageStore.Report(from, to, groupBy)
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err}).Error("Usage report failed")
+		writeAPIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error", "")
+
+		return
+	}
+
+	writeAdminJSON(logger, w, map[string]interface{}{
+		"from":    from,
+		"to":      to,
+		"groupBy": groupBy,
+		"data":    report,
+	})
+}
+
+// handleUpstreamChange changes an upstream at runtime:
+//
+//	POST  /admin/upstreams/{name}/enable|disable|drain|reset
+//	PATCH /admin/upstreams/{name} {"priority": 1, "weight": 3}
+func handleUpstreamChange(live *LiveConfig, logger *log.Logger, w http.ResponseWriter, r *http.Request) {
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/upstreams/"), "/")
+
+	if _, ok := live.Load().Upstreams[name]; !ok {
+		writeAPIError(w, http.StatusNotFound, "Unknown upstream "+name, "invalid_request_error", "")
+		return
+	}
+
+	fields := log.Fields{"upstreamName": name, "remoteAddr": r.RemoteAddr}
+
+	switch {
+	case r.Method == http.MethodPatch && action == "":
+		var change struct {
+			Priority *int `json:"priority"`
+			Weight   *int `json:"weight"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "Invalid body: "+err.Error(), "invalid_request_error", "")
+			return
+		}
+
+		if err := setUpstreamRouting(name, change.Priority, change.Weight); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error", "")
+			return
+		}
+
+		if change.Priority != nil {
+			fields["priority"] = *change.Priority
+		}
+
+		if change.Weight != nil {
+			fields["weight"] = *change.Weight
+		}
+
+		logger.WithFields(fields).Info("Upstream routing changed via admin API")
+	case r.Method == http.MethodPost:
+		switch action {
+		case "enable":
+			setUpstreamState(name, UpstreamEnabled)
+		case "disable":
+			setUpstreamState(name, UpstreamDisabled)
+		case "drain":
+			setUpstreamState(name, UpstreamDraining)
+		case "reset":
+			resetUpstream(name)
+		default:
+			writeAPIError(w, http.StatusNotFound, "Unknown action "+action, "invalid_request_error", "")
+			return
+		}
+
+		fields["action"] = action
+		logger.WithFields(fields).Info("Upstream changed via admin API")
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed", "invalid_request_error", "")
+		return
+	}
+
+	for _, status := range UpstreamStatuses(live.Load()) {
+		if status.Name == name {
+			writeAdminJSON(logger, w, status)
+		}
+	}
+}
+
+// handleReload reloads the configuration file, as a change to it or SIGHUP would.
+func handleReload(live *LiveConfig, logger *log.Logger, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed", "invalid_request_error", "")
+		return
+	}
+
+	if err := live.reloadAndLog(logger, "admin API"); err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, err.Error(), "invalid_request_error", "")
+		return
+	}
+
+	writeAdminJSON(logger, w, map[string]interface{}{"reloaded": true})
+}
+
+func parseReportTime(value string) (time.Time, error) {
+	if parsed, err := time.Parse("2006-01-02", value); err == nil {
+		return parsed, nil
+	}
+
+	return time.Parse(time.RFC3339, value) //nolint:wrapcheck
+}
+
+func writeAdminJSON(logger *log.Logger, w http.ResponseWriter, body interface{}) {
+	data, err := json.MarshalIndent(body, "", "  ")
+	if err != nil {
+		handleError(w, log.NewEntry(logger), err, "Failed to marshal JSON")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_, err = w.Write(data)
+	if err != nil {
+		return
+	}
+}
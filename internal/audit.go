@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// RequestIDHeader carries the ID of a request. Clients may send their own, which is kept if it
+	// is valid; the ID is returned to the client and forwarded to the upstream.
+	RequestIDHeader = "X-Request-ID"
+	requestIDBytes  = 16
+	maxRequestID    = 128
+)
+
+// upstreamRequestIDHeaders are where upstreams return their own ID of a request: OpenAI and Azure.
+var upstreamRequestIDHeaders = []string{"X-Request-Id", "Apim-Request-Id"}
+
+// auditLogger writes one line per request to the audit log, kept apart from the operational log.
+// It is nil when the audit log is disabled.
+var (
+	auditLogger         *log.Logger
+	auditIncludeContent bool
+)
+
+type auditContextKey struct{}
+
+// auditEntry collects what the audit log records about a request while it is being served.
+type auditEntry struct {
+	requestID        string
+	upstreamID       string // The upstream's own ID of the request, if it sent one
+	started          time.Time
+	promptTokens     int
+	completionTokens int
+	completion       string
+	upstreamError    error
+}
+
+// InitializeAuditLog opens the audit log sink. Redaction must be initialized first.
+func InitializeAuditLog(cfg *AuditConfig) error {
+	if cfg.Output.LogOutput == "" {
+		return nil
+	}
+
+	output := cfg.Output
+	output.LogLevel = "info"
+
+	logger, err := InitializeLogger(&output)
+	if err != nil {
+		return err
+	}
+
+	auditLogger = logger
+	auditIncludeContent = cfg.IncludeContent
+
+	return nil
+}
+
+// CloseAuditLog flushes and closes the audit log.
+func CloseAuditLog() error {
+	if auditLogger == nil {
+		return nil
+	}
+
+	return CloseLogger(auditLogger)
+}
+
+func newRequestID() string {
+	id := make([]byte, requestIDBytes)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// requestIDFor returns the ID the client sent with the request, or a new one. Client IDs end up
+// in logs and headers, so they are limited to a short run of letters, digits and "-_.:".
+func requestIDFor(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" || len(id) > maxRequestID {
+		return newRequestID()
+	}
+
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return newRequestID()
+		}
+	}
+
+	return id
+}
+
+// startAudit attaches a new audit entry to the request.
+func startAudit(r *http.Request) (*http.Request, *auditEntry) {
+	entry := &auditEntry{requestID: requestIDFor(r), started: time.Now()}
+
+	return r.WithContext(context.WithValue(r.Context(), auditContextKey{}, entry)), entry
+}
+
+// auditFrom returns the audit entry of the request ctx belongs to, or nil.
+func auditFrom(ctx context.Context) *auditEntry {
+	entry, _ := ctx.Value(auditContextKey{}).(*auditEntry)
+	return entry
+}
+
+// recordCompletion notes the answer the client was sent.
+func (e *auditEntry) recordCompletion(promptTokens int, completionTokens int, completion string) {
+	if e == nil {
+		return
+	}
+
+	e.promptTokens, e.completionTokens, e.completion = promptTokens, completionTokens, completion
+}
+
+// recordUpstreamID notes the upstream's own ID of the request from its response headers.
+func (e *auditEntry) recordUpstreamID(header http.Header) {
+	if e == nil {
+		return
+	}
+
+	for _, name := range upstreamRequestIDHeaders {
+		if id := header.Get(name); id != "" {
+			e.upstreamID = id
+			return
+		}
+	}
+}
+
+// upstreamLogger adds the upstream's ID of the request, once it answered, to the entries of logger.
+func upstreamLogger(ctx context.Context, logger *log.Entry) *log.Entry {
+	if entry := auditFrom(ctx); entry != nil && entry.upstreamID != "" {
+		return logger.WithFields(log.Fields{"upstreamRequestId": entry.upstreamID})
+	}
+
+	return logger
+}
+
+func (e *auditEntry) recordUpstreamError(err error) {
+	if e == nil {
+		return
+	}
+
+	e.upstreamError = err
+}
+
+// writeAuditEntry logs the finished request. Content is only included when configured, and only
+// after redaction.
+func writeAuditEntry(entry *auditEntry, w *metricsResponseWriter, r *http.Request, requestData RequestData) {
+	if auditLogger == nil {
+		return
+	}
+
+	fields := log.Fields{
+		"requestId":         entry.requestID,
+		"upstreamRequestId": entry.upstreamID,
+		"client":            requestData.Client,
+		"clientKey":         "",
+		"remoteAddr":        r.RemoteAddr,
+		"method":            r.Method,
+		"path":              r.URL.Path,
+		"upstream":          w.upstream,
+		"model":             requestData.Model,
+		"requestType":       requestData.RequestType,
+		"status":            w.statusCode(),
+		"latencyMs":         time.Since(entry.started).Milliseconds(),
+		"promptTokens":      entry.promptTokens,
+		"completionTokens":  entry.completionTokens,
+		"cache":             w.Header().Get(CacheHeader),
+	}
+
+	if token := clientToken(r); token != "" {
+		fields["clientKey"] = redactKey(token)
+	}
+
+	if entry.upstreamError != nil {
+		fields["upstreamError"] = redactor.Redact(entry.upstreamError.Error())
+	}
+
+	if auditIncludeContent {
+		fields["messages"] = redactor.RedactMessages(requestData.Messages)
+		fields["prompt"] = redactor.Redact(requestData.Prompt)
+		fields["completion"] = redactor.Redact(entry.completion)
+	}
+
+	auditLogger.WithFields(fields).Info("audit")
+}
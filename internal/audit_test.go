@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientID string
+		keep     bool
+	}{
+		{name: "client ID", clientID: "job-42.step:3_retry-1", keep: true},
+		{name: "no client ID"},
+		{name: "too long", clientID: strings.Repeat("a", maxRequestID+1)},
+		{name: "log injection", clientID: "abc\nlevel=error msg=forged"},
+		{name: "spaces", clientID: "my request"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			if test.clientID != "" {
+				r.Header.Set(RequestIDHeader, test.clientID)
+			}
+
+			id := requestIDFor(r)
+
+			if kept := id == test.clientID; kept != test.keep {
+				t.Errorf("requestIDFor() = %q, kept the client's ID = %v, want %v", id, kept, test.keep)
+			}
+
+			if id == "" {
+				t.Error("requestIDFor() returned no ID")
+			}
+		})
+	}
+}
+
+func TestRequestIDTransport(t *testing.T) {
+	tests := []struct {
+		name         string
+		header       string
+		wantUpstream string
+	}{
+		{name: "OpenAI", header: "X-Request-Id", wantUpstream: "req_abc123"},
+		{name: "Azure", header: "Apim-Request-Id", wantUpstream: "req_abc123"},
+		{name: "no upstream ID"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var forwarded string
+
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwarded = r.Header.Get(RequestIDHeader)
+				if test.header != "" {
+					w.Header().Set(test.header, test.wantUpstream)
+				}
+			}))
+			defer upstream.Close()
+
+			entry := &auditEntry{requestID: "client-request"}
+			ctx := context.WithValue(context.Background(), auditContextKey{}, entry)
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, upstream.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := requestIDTransport{http.DefaultTransport}.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if forwarded != "client-request" {
+				t.Errorf("upstream received %s %q, want %q", RequestIDHeader, forwarded, "client-request")
+			}
+
+			if entry.upstreamID != test.wantUpstream {
+				t.Errorf("upstream ID = %q, want %q", entry.upstreamID, test.wantUpstream)
+			}
+		})
+	}
+}
@@ -0,0 +1,499 @@
+package internal
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// CacheHeader tells clients whether the response came from the cache. Clients can also send
+	// it with the value "bypass" to skip the cache entirely.
+	CacheHeader = "X-Proxy-Cache"
+
+	// cachedUpstream is reported as the upstream of responses replayed from the cache.
+	cachedUpstream = "cache"
+)
+
+var ErrUnknownCacheBackend = errors.New("unknown cache backend")
+
+// CachedResponse is a completed response as it is kept in the cache.
+type CachedResponse struct {
+	Content  string    `json:"content"`
+	Upstream string    `json:"upstream"`
+	Created  time.Time `json:"created"`
+}
+
+// ResponseCache stores completed responses by request key.
+type ResponseCache interface {
+	Get(key string) (*CachedResponse, bool, error)
+	Set(key string, response *CachedResponse) error
+}
+
+var responseCache ResponseCache
+
+// cacheLookup carries what a lookup learned about the request through to storing its answer.
+type cacheLookup struct {
+	key       string
+	embedding []float32
+	store     bool
+}
+
+// InitializeResponseCache sets up the configured cache backend and the semantic index.
+// Caching is off without either.
+func InitializeResponseCache(cfg *CacheConfig) error {
+	semanticIndex = nil
+	if cfg.Semantic.Enabled {
+		semanticIndex = NewSemanticIndex(cfg.Semantic.Threshold, cfg.TTL, cfg.Semantic.MaxEntries)
+	}
+
+	switch cfg.Backend {
+	case "":
+		responseCache = nil
+	case "memory":
+		responseCache = NewMemoryCache(cfg.TTL, cfg.MaxEntries, cfg.MaxBytes)
+	case "disk":
+		cache, err := NewDiskCache(cfg.Path, cfg.TTL, cfg.MaxEntries, cfg.MaxBytes)
+		if err != nil {
+			return err
+		}
+
+		responseCache = cache
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownCacheBackend, cfg.Backend)
+	}
+
+	return nil
+}
+
+// cacheKey hashes the parts of a request that decide its answer, and the profile of the listener
+// it came in on, whose upstreams and interceptors may answer differently. Content is trimmed so
+// that requests differing only in surrounding whitespace share an entry.
+func cacheKey(requestData RequestData) string {
+	type normalizedMessage struct {
+		Role    string `json:"role"`
+		Name    string `json:"name,omitempty"`
+		Content string `json:"content"`
+	}
+
+	messages := make([]normalizedMessage, 0, len(requestData.Messages))
+	for _, message := range requestData.Messages {
+		messages = append(messages, normalizedMessage{
+			Role:    message.Role,
+			Name:    message.Name,
+			Content: strings.TrimSpace(message.Content),
+		})
+	}
+
+	normalized, err := json.Marshal(struct {
+		Profile     string              `json:"profile"`
+		RequestType string              `json:"requestType"`
+		Model       string              `json:"model"`
+		Messages    []normalizedMessage `json:"messages"`
+		Prompt      string              `json:"prompt"`
+		Temperature float64             `json:"temperature"`
+		MaxTokens   int                 `json:"maxTokens"`
+	}{
+		Profile:     requestData.Profile,
+		RequestType: requestData.RequestType,
+		Model:       requestData.Model,
+		Messages:    messages,
+		Prompt:      strings.TrimSpace(requestData.Prompt),
+		Temperature: requestData.Temperature,
+		MaxTokens:   requestData.MaxTokens,
+	})
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(normalized)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheMode reads the client's caching preference: "bypass" skips the cache, "refresh" skips the
+// lookup but stores the new answer and "use" does both.
+func cacheMode(r *http.Request) string {
+	if strings.EqualFold(r.Header.Get(CacheHeader), "bypass") {
+		return "bypass"
+	}
+
+	cacheControl := strings.ToLower(r.Header.Get("Cache-Control"))
+
+	switch {
+	case strings.Contains(cacheControl, "no-store"):
+		return "bypass"
+	case strings.Contains(cacheControl, "no-cache"):
+		return "refresh"
+	default:
+		return "use"
+	}
+}
+
+// lookupCachedResponse returns the cached answer to the request, if there is one. Exact matches
+// are tried first, then the semantic index.
+func lookupCachedResponse(
+	cfg *Config,
+	logger *log.Entry,
+	w http.ResponseWriter,
+	r *http.Request,
+	requestData RequestData,
+) (*CachedResponse, cacheLookup) {
+	if responseCache == nil && semanticIndex == nil {
+		return nil, cacheLookup{}
+	}
+
+	mode := cacheMode(r)
+	if mode == "bypass" {
+		w.Header().Set(CacheHeader, "BYPASS")
+		observeCacheLookup(requestData, "bypass")
+		return nil, cacheLookup{}
+	}
+
+	lookup := cacheLookup{key: cacheKey(requestData), store: true}
+
+	if mode == "use" && responseCache != nil {
+		cached, ok, err := responseCache.Get(lookup.key)
+		if err != nil {
+			logger.WithFields(log.Fields{"error": err, "cacheKey": lookup.key}).Error("Cache lookup failed")
+		} else if ok {
+			w.Header().Set(CacheHeader, "HIT")
+			observeCacheLookup(requestData, "hit")
+			logger.WithFields(log.Fields{"cache": "hit", "cacheKey": lookup.key, "client": requestData.Client}).Info("Serving cached response")
+
+			return cached, lookup
+		}
+	}
+
+	if mode == "use" {
+		var cached *CachedResponse
+
+		cached, lookup.embedding = semanticLookup(r.Context(), cfg, logger, requestData)
+		if cached != nil {
+			w.Header().Set(CacheHeader, "SEMANTIC-HIT")
+			observeCacheLookup(requestData, "semantic_hit")
+			return cached, lookup
+		}
+	}
+
+	w.Header().Set(CacheHeader, "MISS")
+	observeCacheLookup(requestData, "miss")
+
+	return nil, lookup
+}
+
+// storeCachedResponse keeps a completed answer for later requests. It is only called for upstream
+// calls that succeeded; empty answers are not cached either.
+func storeCachedResponse(ctx context.Context, cfg *Config, logger *log.Entry, lookup cacheLookup, requestData RequestData, upstreamName string, completedResponse string) {
+	if !lookup.store || completedResponse == "" {
+		return
+	}
+
+	response := &CachedResponse{Content: completedResponse, Upstream: upstreamName, Created: time.Now()}
+
+	if responseCache != nil {
+		if err := responseCache.Set(lookup.key, response); err != nil {
+			logger.WithFields(log.Fields{"error": err, "cacheKey": lookup.key}).Error("Cache store failed")
+		}
+	}
+
+	semanticStore(ctx, cfg, logger, requestData, lookup.embedding, response)
+}
+
+// replayCachedResponse feeds a cached answer through a channel in word sized chunks, so it can be
+// streamed to the client just like a live upstream response.
+func replayCachedResponse(cached *CachedResponse) <-chan string {
+	responseChannel := make(chan string)
+
+	go func() {
+		defer close(responseChannel)
+
+		for _, chunk := range strings.SplitAfter(cached.Content, " ") {
+			if chunk != "" {
+				responseChannel <- chunk
+			}
+		}
+	}()
+
+	return responseChannel
+}
+
+func (r *CachedResponse) size() int64 {
+	return int64(len(r.Content) + len(r.Upstream))
+}
+
+func (r *CachedResponse) expired(ttl time.Duration) bool {
+	return ttl > 0 && time.Since(r.Created) > ttl
+}
+
+type memoryCacheEntry struct {
+	key      string
+	response *CachedResponse
+}
+
+// MemoryCache is an LRU cache bounded by entry count and total size.
+type MemoryCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	order      *list.List
+	entries    map[string]*list.Element
+}
+
+func NewMemoryCache(ttl time.Duration, maxEntries int, maxBytes int64) *MemoryCache {
+	return &MemoryCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		order:      list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+func (c *MemoryCache) Get(key string) (*CachedResponse, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	entry, _ := element.Value.(*memoryCacheEntry)
+	if entry.response.expired(c.ttl) {
+		c.remove(element)
+		return nil, false, nil
+	}
+
+	c.order.MoveToFront(element)
+
+	return entry.response, true, nil
+}
+
+func (c *MemoryCache) Set(key string, response *CachedResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+
+	c.entries[key] = c.order.PushFront(&memoryCacheEntry{key: key, response: response})
+	c.bytes += response.size()
+
+	for c.order.Len() > 0 && ((c.maxEntries > 0 && c.order.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes)) {
+		c.remove(c.order.Back())
+	}
+
+	return nil
+}
+
+func (c *MemoryCache) remove(element *list.Element) {
+	entry, _ := element.Value.(*memoryCacheEntry)
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.response.size()
+}
+
+// DiskCache keeps one JSON file per entry in a directory, evicting the least recently used
+// files when it grows past its limits. The order of use and the sizes are kept in memory, read
+// from the directory once at startup.
+type DiskCache struct {
+	mu         sync.Mutex
+	dir        string
+	ttl        time.Duration
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	order      *list.List // Of *diskCacheEntry, most recently used first
+	entries    map[string]*list.Element
+}
+
+type diskCacheEntry struct {
+	key  string
+	size int64
+}
+
+func NewDiskCache(dir string, ttl time.Duration, maxEntries int, maxBytes int64) (*DiskCache, error) {
+	const dirMode = 0o700
+
+	if dir == "" {
+		return nil, fmt.Errorf("%w: disk cache needs a path", ErrUnknownCacheBackend)
+	}
+
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return nil, fmt.Errorf("cache directory create failed: %w", err)
+	}
+
+	c := &DiskCache{
+		dir:        dir,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		order:      list.New(),
+		entries:    map[string]*list.Element{},
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// load indexes the entries left by a previous run. The modification time of a file is its last
+// use, so the order survives restarts.
+func (c *DiskCache) load() error {
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("cache scan failed: %w", err)
+	}
+
+	infos := make([]os.FileInfo, 0, len(files))
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().After(infos[j].ModTime()) })
+
+	for _, info := range infos {
+		key := strings.TrimSuffix(info.Name(), ".json")
+		c.entries[key] = c.order.PushBack(&diskCacheEntry{key: key, size: info.Size()})
+		c.bytes += info.Size()
+	}
+
+	// The limits may have shrunk since the last run.
+	return c.evict()
+}
+
+func (c *DiskCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c *DiskCache) Get(key string) (*CachedResponse, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	data, err := os.ReadFile(c.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		c.forget(element)
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("cache read failed: %w", err)
+	}
+
+	var response CachedResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrJSONUnmarshalFailed, err)
+	}
+
+	if response.expired(c.ttl) {
+		if err := c.remove(element); err != nil {
+			return nil, false, err
+		}
+
+		return nil, false, nil
+	}
+
+	c.order.MoveToFront(element)
+
+	// Touch the file so the next run starts with the same order.
+	now := time.Now()
+	if err := os.Chtimes(c.path(key), now, now); err != nil {
+		return nil, false, fmt.Errorf("cache touch failed: %w", err)
+	}
+
+	return &response, true, nil
+}
+
+func (c *DiskCache) Set(key string, response *CachedResponse) error {
+	const fileMode = 0o600
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrJSONMarshalFailed, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Write to a temporary file first so readers never see half an entry.
+	temporary := c.path(key) + ".tmp"
+	if err := os.WriteFile(temporary, data, fileMode); err != nil {
+		return fmt.Errorf("cache write failed: %w", err)
+	}
+
+	if err := os.Rename(temporary, c.path(key)); err != nil {
+		return fmt.Errorf("cache write failed: %w", err)
+	}
+
+	if element, ok := c.entries[key]; ok {
+		c.forget(element)
+	}
+
+	c.entries[key] = c.order.PushFront(&diskCacheEntry{key: key, size: int64(len(data))})
+	c.bytes += int64(len(data))
+
+	return c.evict()
+}
+
+// evict removes the least recently used files until the cache is within its limits.
+func (c *DiskCache) evict() error {
+	for c.order.Len() > 0 && ((c.maxEntries > 0 && c.order.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes)) {
+		if err := c.remove(c.order.Back()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remove deletes the file of an entry and drops it from the index.
+func (c *DiskCache) remove(element *list.Element) error {
+	entry, _ := element.Value.(*diskCacheEntry)
+	if err := os.Remove(c.path(entry.key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cache evict failed: %w", err)
+	}
+
+	c.forget(element)
+
+	return nil
+}
+
+// forget drops an entry from the index.
+func (c *DiskCache) forget(element *list.Element) {
+	entry, _ := element.Value.(*diskCacheEntry)
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+}
@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	log "github.com/sirupsen/logrus"
+)
+
+// streamChunks answers like an upstream streaming a chat completion.
+func streamChunks(w http.ResponseWriter, chunks ...string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+
+	for _, chunk := range chunks {
+		fmt.Fprintf(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", chunk)
+		w.(http.Flusher).Flush()
+	}
+}
+
+func TestServeCompletionCachesOnlySuccessfulCalls(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream http.HandlerFunc
+		cancel   bool
+		cached   bool
+	}{
+		{
+			name: "success",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				streamChunks(w, "Hello", " world")
+				io.WriteString(w, "data: [DONE]\n\n")
+			},
+			cached: true,
+		},
+		{
+			name: "upstream error",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, `{"error":{"message":"boom","type":"server_error"}}`)
+			},
+		},
+		{
+			name: "broken stream",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				streamChunks(w, "Hello")
+				io.WriteString(w, "data: {not json}\n\n")
+			},
+		},
+		{
+			name: "client cancels",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				streamChunks(w, "Hello")
+				<-r.Context().Done()
+			},
+			cancel: true,
+		},
+		{
+			name: "no upstream available",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{Upstreams: map[string]Upstream{}}
+
+			if test.upstream != nil {
+				server := httptest.NewServer(test.upstream)
+				defer server.Close()
+
+				cfg.Upstreams["test-"+test.name] = Upstream{Type: "azure", URL: server.URL, Model: "default", Priority: 1}
+			}
+
+			cache := NewMemoryCache(time.Minute, 0, 0)
+			responseCache = cache
+			defer func() { responseCache = nil }()
+
+			requestData := RequestData{
+				Model:       openai.GPT3Dot5Turbo,
+				RequestType: "chat",
+				Messages:    []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hi"}},
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if test.cancel {
+				time.AfterFunc(200*time.Millisecond, cancel)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader("{}")).WithContext(ctx)
+			w := httptest.NewRecorder()
+
+			logger := log.New()
+			logger.SetOutput(io.Discard)
+
+			serveCompletion(cfg, log.NewEntry(logger), w, r, requestData)
+
+			_, found, err := cache.Get(cacheKey(requestData))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if found != test.cached {
+				t.Errorf("cached = %v, want %v", found, test.cached)
+			}
+		})
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	base := chatRequest("team", "What is Go?")
+	base.Profile = "internal"
+
+	tests := []struct {
+		name      string
+		change    func(requestData *RequestData)
+		wantShare bool
+	}{
+		{name: "surrounding whitespace", change: func(requestData *RequestData) { requestData.Messages[0].Content = " What is Go?\n" }, wantShare: true},
+		{name: "other client", change: func(requestData *RequestData) { requestData.Client = "ci" }, wantShare: true},
+		{name: "other profile", change: func(requestData *RequestData) { requestData.Profile = "public" }},
+		{name: "other model", change: func(requestData *RequestData) { requestData.Model = "gpt-4" }},
+		{name: "other temperature", change: func(requestData *RequestData) { requestData.Temperature = 0.5 }},
+	}
+
+	for _, test := range tests {
+		requestData := chatRequest("team", "What is Go?")
+		requestData.Profile = "internal"
+		test.change(&requestData)
+
+		if shared := cacheKey(requestData) == cacheKey(base); shared != test.wantShare {
+			t.Errorf("%s: shares the key = %v, want %v", test.name, shared, test.wantShare)
+		}
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+
+	cache, err := NewDiskCache(dir, time.Minute, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := func(key string) {
+		if err := cache.Set(key, &CachedResponse{Content: key, Created: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cached := func(key string) bool {
+		_, ok, err := cache.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return ok
+	}
+
+	set("a")
+	set("b")
+	cached("a")
+	set("c")
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, err := os.Stat(filepath.Join(dir, key+".json")); (err == nil) != want {
+			t.Errorf("file of %s kept = %v, want %v", key, err == nil, want)
+		}
+	}
+
+	// A restart with a smaller limit keeps the most recently used entry.
+	cache, err = NewDiskCache(dir, time.Minute, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cache.order.Len() != 1 || !cached("c") || cached("a") {
+		t.Errorf("after a restart the index holds %d entries, want only c", cache.order.Len())
+	}
+
+	// Files removed behind the cache's back are dropped from the index.
+	if err := os.Remove(filepath.Join(dir, "c.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	if cached("c") || cache.order.Len() != 0 || cache.bytes != 0 {
+		t.Errorf("a removed file is still indexed: %d entries of %d bytes", cache.order.Len(), cache.bytes)
+	}
+}
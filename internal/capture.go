@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const maxCaptureLineBytes = 64 << 20
+
+// CaptureRecord is one request/response pair in the capture archive.
+type CaptureRecord struct {
+	ID            string         `json:"id"`
+	Time          time.Time      `json:"time"`
+	Client        string         `json:"client"`
+	Upstream      string         `json:"upstream"`
+	Request       RequestData    `json:"request"`
+	Response      string         `json:"response"`
+	Chunks        []CaptureChunk `json:"chunks,omitempty"`
+	Status        int            `json:"status"`
+	DurationMs    int64          `json:"durationMs"`
+	UpstreamError string         `json:"upstreamError,omitempty"`
+}
+
+// CaptureChunk is a streamed piece of the response and when it arrived, relative to the request.
+type CaptureChunk struct {
+	OffsetMs int64  `json:"offsetMs"`
+	Content  string `json:"content"`
+}
+
+// CaptureArchive appends records to a JSONL file.
+type CaptureArchive struct {
+	mu     sync.Mutex
+	file   *os.File
+	redact bool
+}
+
+var (
+	captureArchive     *CaptureArchive
+	captureSampleRatio float64
+)
+
+type captureContextKey struct{}
+
+// InitializeCapture opens the capture archive. Capturing is off when no path is set.
+func InitializeCapture(cfg *CaptureConfig) error {
+	if cfg.Path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening capture archive: %w", err)
+	}
+
+	captureArchive = &CaptureArchive{file: file, redact: cfg.Redact}
+
+	captureSampleRatio = 1
+	if cfg.SampleRatio != nil {
+		captureSampleRatio = *cfg.SampleRatio
+	}
+
+	return nil
+}
+
+// Write appends a record to the archive, redacting its content first if configured to.
+func (a *CaptureArchive) Write(record *CaptureRecord) error {
+	if a.redact {
+		record.Request.Messages = redactor.RedactMessages(record.Request.Messages)
+		record.Request.Prompt = redactor.Redact(record.Request.Prompt)
+		record.Response = redactor.Redact(record.Response)
+
+		for i := range record.Chunks {
+			record.Chunks[i].Content = redactor.Redact(record.Chunks[i].Content)
+		}
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrJSONMarshalFailed, err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing capture archive: %w", err)
+	}
+
+	return nil
+}
+
+// CloseCapture flushes and closes the capture archive.
+func CloseCapture() error {
+	if captureArchive == nil {
+		return nil
+	}
+
+	captureArchive.mu.Lock()
+	defer captureArchive.mu.Unlock()
+
+	if err := captureArchive.file.Sync(); err != nil {
+		return fmt.Errorf("syncing capture archive: %w", err)
+	}
+
+	if err := captureArchive.file.Close(); err != nil {
+		return fmt.Errorf("closing capture archive: %w", err)
+	}
+
+	return nil
+}
+
+// ReadCaptureArchive loads every record of a capture archive.
+func ReadCaptureArchive(path string) ([]CaptureRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening capture archive: %w", err)
+	}
+	defer file.Close()
+
+	var records []CaptureRecord
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxCaptureLineBytes)
+
+	for line := 1; scanner.Scan(); line++ {
+		var record CaptureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrJSONUnmarshalFailed, line, err)
+		}
+
+		records = append(records, record)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading capture archive: %w", err)
+	}
+
+	return records, nil
+}
+
+// startCapture attaches a capture record to a sampled request.
+func startCapture(r *http.Request, requestID string) (*http.Request, *CaptureRecord) {
+	if captureArchive == nil || rand.Float64() >= captureSampleRatio { //nolint:gosec
+		return r, nil
+	}
+
+	record := &CaptureRecord{ID: requestID, Time: time.Now().UTC()}
+
+	return r.WithContext(context.WithValue(r.Context(), captureContextKey{}, record)), record
+}
+
+// captureFrom returns the capture record of the request ctx belongs to, or nil.
+func captureFrom(ctx context.Context) *CaptureRecord {
+	record, _ := ctx.Value(captureContextKey{}).(*CaptureRecord)
+	return record
+}
+
+// recordChunk notes a chunk of the upstream's answer.
+func (c *CaptureRecord) recordChunk(content string) {
+	if c == nil {
+		return
+	}
+
+	c.Chunks = append(c.Chunks, CaptureChunk{OffsetMs: time.Since(c.Time).Milliseconds(), Content: content})
+}
+
+func (c *CaptureRecord) recordUpstreamError(err error) {
+	if c == nil {
+		return
+	}
+
+	c.UpstreamError = err.Error()
+}
+
+// writeCaptureRecord archives a finished completion request.
+func writeCaptureRecord(record *CaptureRecord, w *metricsResponseWriter, requestData RequestData, completion string) error {
+	if record == nil || requestData.RequestType == "" {
+		return nil
+	}
+
+	record.Client = requestData.Client
+	record.Upstream = w.upstream
+	record.Request = requestData
+	record.Response = completion
+	record.Status = w.statusCode()
+	record.DurationMs = time.Since(record.Time).Milliseconds()
+
+	return captureArchive.Write(record)
+}
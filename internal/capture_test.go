@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestCaptureSampleRatio(t *testing.T) {
+	ratio := func(r float64) *float64 { return &r }
+
+	tests := []struct {
+		name        string
+		sampleRatio *float64
+		want        int
+	}{
+		{name: "unset captures every request", want: 20},
+		{name: "zero captures none", sampleRatio: ratio(0)},
+		{name: "one captures every request", sampleRatio: ratio(1), want: 20},
+	}
+
+	t.Cleanup(func() {
+		CloseCapture() //nolint:errcheck
+		captureArchive = nil
+	})
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "capture.jsonl")
+
+		if err := InitializeCapture(&CaptureConfig{Path: path, SampleRatio: test.sampleRatio}); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 20; i++ {
+			_, record := startCapture(httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil), "req")
+			if record != nil {
+				if err := captureArchive.Write(record); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		if err := CloseCapture(); err != nil {
+			t.Fatal(err)
+		}
+
+		records, err := ReadCaptureArchive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(records) != test.want {
+			t.Errorf("%s: captured %d requests, want %d", test.name, len(records), test.want)
+		}
+	}
+}
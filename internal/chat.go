@@ -3,45 +3,144 @@ package internal
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
-	"math"
+	"strings"
+	"sync"
 
 	openai "github.com/sashabaranov/go-openai"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+var (
+	ErrInvalidUpstreamType = errors.New("invalid upstream type")
+	ErrEmptyCompletion     = errors.New("upstream returned no choices")
+	ErrUnknownUpstream     = errors.New("unknown upstream")
+	ErrUnknownRequestType  = errors.New("unknown request type")
+)
+
+// selectUpstream returns the upstream with the lowest "priority number" among those the profile
+// allows, skipping upstreams whose circuit breaker is open unless every upstream is unavailable.
+// Upstreams taken out of rotation with the admin API are never selected.
+func selectUpstream(cfg *Config, profile string) (string, Upstream) {
+	name, upstream, _ := selectAvailableUpstream(cfg, profile)
+
+	return name, upstream
+}
+
+// selectAvailableUpstream is selectUpstream that also returns the upstreams it skipped.
+func selectAvailableUpstream(cfg *Config, profile string) (string, Upstream, []string) {
+	var available []string
+	var skipped []string
+
+	allowed := profileFor(cfg, profile).Upstreams
+
+	for name := range cfg.Upstreams {
+		switch {
+		case !allowedBy(allowed, name) || !upstreamInRotation(name):
+		case upstreamAvailable(cfg, name):
+			available = append(available, name)
+		default:
+			skipped = append(skipped, name)
+		}
+	}
+
+	candidates := available
+	if len(candidates) == 0 {
+		candidates = skipped
+	}
+
+	name := pickUpstream(cfg, candidates)
+
+	return name, cfg.Upstreams[name], skipped
+}
+
+// defaultUpstreamModel in an upstream's model setting keeps the model the proxy has always called
+// it with.
+const defaultUpstreamModel = "default"
+
+// upstreamModel is the model an upstream is called with for a type of request.
+func upstreamModel(upstream Upstream, requestType string) string {
+	if upstream.Model != "" && upstream.Model != defaultUpstreamModel {
+		return upstream.Model
+	}
+
+	if requestType == "completion" && upstream.Type == "azure" {
+		return openai.GPT3Ada
+	}
+
+	return openai.GPT3Dot5Turbo
+}
+
+// upstreamRoute is the upstream a request is sent to. It is chosen before the interceptors run, so
+// that context windows, limits and prices are those of the model that actually answers.
+type upstreamRoute struct {
+	name     string
+	upstream Upstream
+	model    string   // Model the upstream is called with
+	skipped  []string // Preferred upstreams passed over because their circuit is open
+	probe    bool     // The trial call of the upstream's half-open circuit, guarded by upstreamHealthMu
+}
+
+// routeMu makes choosing an upstream and claiming the trial call of its circuit one step.
+var routeMu sync.Mutex
+
+// routeRequest chooses the upstream for a request. A route to a half-open upstream may hold its
+// trial call, which releaseRoute gives up when the request doesn't get to make it.
+func routeRequest(ctx context.Context, cfg *Config, requestData RequestData) *upstreamRoute {
+	_, span := tracer.Start(ctx, "proxy.select_upstream")
+	defer span.End()
+
+	routeMu.Lock()
+	defer routeMu.Unlock()
+
+	name, upstream, skipped := selectAvailableUpstream(cfg, requestData.Profile)
+	span.SetAttributes(
+		attribute.String("proxy.upstream", name),
+		attribute.StringSlice("proxy.upstream.skipped", skipped),
+	)
+
+	route := &upstreamRoute{name: name, upstream: upstream, model: upstreamModel(upstream, requestData.RequestType), skipped: skipped}
+	claimProbe(cfg, route)
+
+	return route
+}
+
+// resolvedModel is the model the request is answered by: the one of its upstream once it is
+// routed, the requested one before.
+func resolvedModel(requestData RequestData) string {
+	if requestData.route != nil {
+		return requestData.route.model
+	}
+
+	return requestData.Model
+}
+
 // CreateChatCompletionStream creates a chat completion stream based on the given upstreams and messages,
 // by Default it will use the upstream with the lowest "priority number" and send requests to that one.
 func CreateChatCompletionStream(
 	cfg *Config,
-	logger *log.Logger,
+	logger *log.Entry,
 	upstreams map[string]Upstream,
 	messages []openai.ChatCompletionMessage,
 	maxTokens int,
 ) (<-chan string, string) {
-	lowestPriority := math.MaxInt
-	var selectedUpstream Upstream
-
-	var selectedUpstreamName string // Added to keep track of the selected upstream name
+	selectedUpstreamName, selectedUpstream := selectUpstream(cfg, "")
 
-	for name, upstream := range cfg.Upstreams { // Note: We're using cfg.Upstreams here
-		if upstream.Priority < lowestPriority {
-			lowestPriority = upstream.Priority
-			selectedUpstream = upstream
-			selectedUpstreamName = name // Store the name of the selected upstream
-		}
+	client, err := upstreamClient(selectedUpstreamName, selectedUpstream)
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err}).Error("Invalid upstream")
+		return nil, ""
 	}
 
 	var channel <-chan string
 
 	switch selectedUpstream.Type {
 	case "azure":
-		channel = CreateAzureChatCompletionStream(cfg, logger, selectedUpstream.APIKey, selectedUpstream.URL, messages, maxTokens)
+		channel = CreateAzureChatCompletionStream(context.Background(), cfg, logger, client, upstreamModel(selectedUpstream, "chat"), messages, maxTokens, &upstreamOutcome{})
 	case "openai":
-		channel = CreateOpenAIChatCompletionStream(cfg, logger, selectedUpstream.APIKey, messages, maxTokens)
-	default:
-		logger.Error("Invalid upstream type")
-		return nil, ""
+		channel = CreateOpenAIChatCompletionStream(context.Background(), cfg, logger, client, upstreamModel(selectedUpstream, "chat"), messages, maxTokens, &upstreamOutcome{})
 	}
 
 	return channel, selectedUpstreamName // Return the channel and the selected upstream name
@@ -49,88 +148,154 @@ func CreateChatCompletionStream(
 
 // New version of CreateChatCompletionStream
 func CreateOpenAIRequest(
+	ctx context.Context,
 	cfg *Config,
-	logger *log.Logger,
-	requestType string,
-	messages []openai.ChatCompletionMessage,
-	prompt string,
-	maxTokens int,
-) (<-chan string, string) {
-
-	// Determine the appropriate upstream based on priority
-	lowestPriority := math.MaxInt
-	var selectedUpstream Upstream
-	var selectedUpstreamName string
-
-	for name, upstream := range cfg.Upstreams {
-		if upstream.Priority < lowestPriority {
-			lowestPriority = upstream.Priority
-			selectedUpstream = upstream
-			selectedUpstreamName = name
-		}
+	logger *log.Entry,
+	requestData RequestData,
+) (<-chan string, string, *upstreamOutcome) {
+	requestType := requestData.RequestType
+
+	route := requestData.route
+	if route == nil {
+		route = routeRequest(ctx, cfg, requestData)
+		requestData.route = route
 	}
 
+	selectedUpstreamName, selectedUpstream := route.name, route.upstream
+
 	responseChannel := make(chan string)
+	outcome := &upstreamOutcome{}
+
 	go func() {
 		defer close(responseChannel)
-		logger.WithFields(log.Fields{"selectedUpstreamType": selectedUpstream.Type, "requestType": requestType}).Debug("I'm a bug bug bug")
-		switch requestType {
-		case "chat":
-			if selectedUpstream.Type == "azure" {
-				for content := range CreateAzureChatCompletionStream(cfg, logger, selectedUpstream.APIKey, selectedUpstream.URL, messages, maxTokens) {
-					responseChannel <- content
-				}
-			} else if selectedUpstream.Type == "openai" {
-				// Assuming you've named the OpenAI chat function "CreateOpenAIChatCompletionStream"
-				for content := range CreateOpenAIChatCompletionStream(cfg, logger, selectedUpstream.APIKey, messages, maxTokens) {
-					responseChannel <- content
-				}
-			} else {
-				responseChannel <- "Invalid upstream type for chat"
-			}
 
-		case "completion":
-			if selectedUpstream.Type == "azure" {
-				for content := range CreateAzureOpenAICompletion(cfg, logger, selectedUpstream.APIKey, selectedUpstream.URL, prompt, maxTokens) {
-
-					responseChannel <- content
-				}
-			} else if selectedUpstream.Type == "openai" {
-				// Assuming you have a corresponding function for OpenAI completion
-				for content := range CreateOpenAICompletion(cfg, logger, selectedUpstream.APIKey, prompt, maxTokens) {
-					responseChannel <- content
-				}
-			} else {
-				responseChannel <- "Invalid upstream type for completion"
+		ctx, call := startUpstreamCall(ctx, selectedUpstreamName, selectedUpstream, requestData, len(route.skipped) > 0)
+
+		defer func() { call.finish(cfg, logger, outcome) }()
+
+		upstreamChannel := streamUpstream(ctx, cfg, logger, selectedUpstreamName, selectedUpstream, requestData, outcome)
+		if upstreamChannel == nil {
+			switch {
+			case errors.Is(outcome.err, ErrNoUpstreamAvailable):
+				responseChannel <- "No upstream available"
+			case outcome.err != nil:
+				responseChannel <- "Invalid upstream type for " + requestType
+			default:
+				responseChannel <- "Unknown request type"
 			}
 
-		default:
-			responseChannel <- "Unknown request type"
+			return
+		}
+
+		for content := range upstreamChannel {
+			call.received(content)
+			responseChannel <- content
 		}
+
+		outcome.finished = true
 	}()
-	// Return the response channel and the selected upstream name
-	return responseChannel, selectedUpstreamName
+
+	// The outcome is complete once the response channel is closed.
+	return responseChannel, selectedUpstreamName, outcome
+}
+
+// streamUpstream sends the request to the given upstream and returns the channel its answer is
+// streamed on, or nil when the upstream or request type isn't supported.
+func streamUpstream(
+	ctx context.Context,
+	cfg *Config,
+	logger *log.Entry,
+	name string,
+	upstream Upstream,
+	requestData RequestData,
+	outcome *upstreamOutcome,
+) <-chan string {
+	messages := requestData.Messages
+	prompt := requestData.Prompt
+	maxTokens := requestData.MaxTokens
+	model := upstreamModel(upstream, requestData.RequestType)
+
+	// Every upstream the request may use was taken out of rotation.
+	if name == "" {
+		outcome.fail(ErrNoUpstreamAvailable)
+		return nil
+	}
+
+	client, err := upstreamClient(name, upstream)
+	if err != nil {
+		outcome.fail(err)
+		return nil
+	}
+
+	switch requestData.RequestType {
+	case "chat":
+		if upstream.Type == "azure" {
+			return CreateAzureChatCompletionStream(ctx, cfg, logger, client, model, messages, maxTokens, outcome)
+		} else if upstream.Type == "openai" {
+			return CreateOpenAIChatCompletionStream(ctx, cfg, logger, client, model, messages, maxTokens, outcome)
+		}
+
+	case "completion":
+		if upstream.Type == "azure" {
+			return CreateAzureOpenAICompletion(ctx, cfg, logger, client, model, prompt, maxTokens, outcome)
+		} else if upstream.Type == "openai" {
+			return CreateOpenAICompletion(ctx, cfg, logger, client, model, prompt, maxTokens, outcome)
+		}
+
+	default:
+		return nil
+	}
+
+	outcome.fail(ErrInvalidUpstreamType)
+
+	return nil
+}
+
+// CompleteRequest sends the request to the named upstream and waits for the whole answer. Unlike
+// CreateOpenAIRequest it bypasses upstream selection, which is what replaying traffic needs.
+func CompleteRequest(ctx context.Context, cfg *Config, logger *log.Entry, upstreamName string, requestData RequestData) (string, error) {
+	upstream, ok := cfg.Upstreams[upstreamName]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownUpstream, upstreamName)
+	}
+
+	outcome := &upstreamOutcome{}
+
+	upstreamChannel := streamUpstream(ctx, cfg, logger, upstreamName, upstream, requestData, outcome)
+	if upstreamChannel == nil {
+		if outcome.err != nil {
+			return "", outcome.err
+		}
+
+		return "", fmt.Errorf("%w: %s", ErrUnknownRequestType, requestData.RequestType)
+	}
+
+	var completion strings.Builder
+	for content := range upstreamChannel {
+		completion.WriteString(content)
+	}
+
+	return completion.String(), outcome.err
 }
 
 // CreateOpenAIChatCompletionStream creates a chat completion stream using OpenAI.
 func CreateOpenAIChatCompletionStream(
+	ctx context.Context,
 	cfg *Config,
-	logger *log.Logger,
-	apiKey string,
+	logger *log.Entry,
+	client *openai.Client,
+	model string,
 	messages []openai.ChatCompletionMessage,
 	maxTokens int,
+	outcome *upstreamOutcome,
 ) <-chan string {
 	responseChannel := make(chan string)
 
 	go func() {
 		defer close(responseChannel)
 
-		client := openai.NewClient(apiKey)
-
-		ctx := context.Background()
-
 		req := openai.ChatCompletionRequest{
-			Model:            openai.GPT3Dot5Turbo,
+			Model:            model,
 			MaxTokens:        maxTokens,
 			Messages:         messages,
 			Stream:           true,
@@ -148,7 +313,8 @@ func CreateOpenAIChatCompletionStream(
 
 		stream, err := client.CreateChatCompletionStream(ctx, req)
 		if err != nil {
-			logger.WithFields(log.Fields{"error": err}).Error("openai api error")
+			outcome.fail(err)
+			upstreamLogger(ctx, logger).WithFields(log.Fields{"error": err}).Error("openai api error")
 
 			return
 		}
@@ -160,7 +326,8 @@ func CreateOpenAIChatCompletionStream(
 			}
 
 			if err != nil {
-				logger.WithFields(log.Fields{"error": err}).Error("stream error")
+				outcome.fail(err)
+				upstreamLogger(ctx, logger).WithFields(log.Fields{"error": err}).Error("stream error")
 
 				return
 			}
@@ -174,24 +341,21 @@ func CreateOpenAIChatCompletionStream(
 
 // CreateAzureChatCompletionStream creates a chat completion stream using Azure.
 func CreateAzureChatCompletionStream(
+	ctx context.Context,
 	cfg *Config,
-	logger *log.Logger,
-	apiKey string,
-	azureURL string,
+	logger *log.Entry,
+	client *openai.Client,
+	model string,
 	messages []openai.ChatCompletionMessage,
 	maxTokens int,
+	outcome *upstreamOutcome,
 ) <-chan string {
 	responseChannel := make(chan string)
 	go func() {
 		defer close(responseChannel)
 
-		config := openai.DefaultAzureConfig(apiKey, azureURL)
-		client := openai.NewClientWithConfig(config)
-
-		ctx := context.Background()
-
 		req := openai.ChatCompletionRequest{
-			Model:            openai.GPT3Dot5Turbo,
+			Model:            model,
 			MaxTokens:        maxTokens,
 			Messages:         messages,
 			Stream:           true,
@@ -209,7 +373,8 @@ func CreateAzureChatCompletionStream(
 
 		stream, err := client.CreateChatCompletionStream(ctx, req)
 		if err != nil {
-			logger.WithFields(log.Fields{"error": err}).Error("openai api error")
+			outcome.fail(err)
+			upstreamLogger(ctx, logger).WithFields(log.Fields{"error": err}).Error("openai api error")
 			return
 		}
 
@@ -220,7 +385,8 @@ func CreateAzureChatCompletionStream(
 			}
 
 			if err != nil {
-				logger.WithFields(log.Fields{"error": err}).Error("stream error")
+				outcome.fail(err)
+				upstreamLogger(ctx, logger).WithFields(log.Fields{"error": err}).Error("stream error")
 
 				return
 			}
@@ -234,42 +400,30 @@ func CreateAzureChatCompletionStream(
 
 // CreateAzureOpenAICompletionStream creates an OpenAI completion stream using Azure.
 func CreateAzureOpenAICompletion(
+	ctx context.Context,
 	cfg *Config,
-	logger *log.Logger,
-	apiKey string,
-	azureURL string,
+	logger *log.Entry,
+	client *openai.Client,
+	model string,
 	prompt string,
 	maxTokens int,
+	outcome *upstreamOutcome,
 ) <-chan string {
 	responseChannel := make(chan string)
 
-	logger.WithFields(log.Fields{"qqqqq": prompt, "maxtokens": maxTokens}).Debug("I'm a CreateAzureOpenAICompletion")
-
 	go func() {
 		defer close(responseChannel)
 
-		config := openai.DefaultAzureConfig(apiKey, azureURL) // Assuming you have a similar method for this
-		client := openai.NewClientWithConfig(config)
-
-		ctx := context.Background()
-
 		req := openai.CompletionRequest{
-			Model:     openai.GPT3Ada, // Model used for completion
+			Model:     model,
 			MaxTokens: maxTokens,
 			Prompt:    prompt,
 		}
 
 		resp, err := client.CreateCompletion(ctx, req)
-		logger.WithFields(log.Fields{
-			"error":    err,
-			"response": resp, // log the whole response object
-		}).Debug("openai api debug")
-
 		if err != nil {
-			logger.WithFields(log.Fields{
-				"error":    err,
-				"response": resp, // log the whole response object
-			}).Error("openai api error")
+			outcome.fail(err)
+			upstreamLogger(ctx, logger).WithFields(log.Fields{"error": err}).Error("openai api error")
 			return
 		}
 
@@ -282,33 +436,30 @@ func CreateAzureOpenAICompletion(
 
 // CreateOpenAICompletion creates a completion stream using OpenAI (non-Azure).
 func CreateOpenAICompletion(
+	ctx context.Context,
 	cfg *Config,
-	logger *log.Logger,
-	apiKey string,
+	logger *log.Entry,
+	client *openai.Client,
+	model string,
 	prompt string,
 	maxTokens int,
+	outcome *upstreamOutcome,
 ) <-chan string {
 	responseChannel := make(chan string)
 
 	go func() {
 		defer close(responseChannel)
 
-		client := openai.NewClient(apiKey)
-
-		ctx := context.Background()
-
 		req := openai.CompletionRequest{
-			Model:     openai.GPT3Dot5Turbo, // Model used for completion
+			Model:     model,
 			MaxTokens: maxTokens,
 			Prompt:    prompt,
 		}
 
 		resp, err := client.CreateCompletion(ctx, req)
 		if err != nil {
-			logger.WithFields(log.Fields{
-				"error":    err,
-				"response": resp, // log the whole response object
-			}).Error("openai api error")
+			outcome.fail(err)
+			upstreamLogger(ctx, logger).WithFields(log.Fields{"error": err}).Error("openai api error")
 			return
 		}
 
@@ -318,3 +469,66 @@ func CreateOpenAICompletion(
 
 	return responseChannel
 }
+
+// CreateChatCompletion sends a chat to the upstream and waits for the whole answer. It is used by
+// the proxy itself, e.g. to summarize, rather than to answer clients.
+func CreateChatCompletion(
+	ctx context.Context,
+	cfg *Config,
+	logger *log.Entry,
+	name string,
+	upstream Upstream,
+	messages []openai.ChatCompletionMessage,
+	maxTokens int,
+) (string, error) {
+	client, err := upstreamClient(name, upstream)
+	if err != nil {
+		return "", err
+	}
+
+	req := openai.ChatCompletionRequest{
+		Model:     upstreamModel(upstream, "chat"),
+		MaxTokens: maxTokens,
+		Messages:  messages,
+	}
+
+	resp, err := client.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("chat completion failed: %w", err)
+	}
+
+	if len(resp.Choices) == 0 {
+		return "", ErrEmptyCompletion
+	}
+
+	return resp.Choices[0].Message.Content, nil
+}
+
+// CreateEmbedding embeds text with the given embeddings model on the upstream.
+func CreateEmbedding(ctx context.Context, cfg *Config, name string, upstream Upstream, model string, text string) ([]float32, error) {
+	client, err := upstreamClient(name, upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	var embeddingModel openai.EmbeddingModel
+	if err := embeddingModel.UnmarshalText([]byte(model)); err != nil {
+		return nil, fmt.Errorf("unknown embedding model %s: %w", model, err)
+	}
+
+	req := openai.EmbeddingRequest{
+		Input: []string{text},
+		Model: embeddingModel,
+	}
+
+	resp, err := client.CreateEmbeddings(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("embedding failed: %w", err)
+	}
+
+	if len(resp.Data) == 0 {
+		return nil, ErrEmptyCompletion
+	}
+
+	return resp.Data[0].Embedding, nil
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const anonymousClient = "anonymous"
+
+var ErrUnknownClientKey = errors.New("unknown API key")
+
+// identifyClient maps the key a client presents to a configured virtual key. When no keys
+// are configured the proxy is open and every request is attributed to the anonymous client.
+// A verified client certificate mapped to a key identifies the client as well. The profile of
+// the listener may require one or the other, or no authentication at all.
+func identifyClient(cfg *Config, r *http.Request) (string, error) {
+	switch profileFor(cfg, requestProfile(r)).Auth {
+	case ProfileAuthNone:
+		return anonymousClient, nil
+	case ProfileAuthKey:
+		return keyClient(cfg, r)
+	case ProfileAuthClientCert:
+		if client, ok := clientCertIdentity(r); ok {
+			return client, nil
+		}
+
+		return "", ErrClientCertRequired
+	}
+
+	if client, ok := clientCertIdentity(r); ok {
+		return client, nil
+	}
+
+	if len(cfg.Keys) == 0 {
+		return anonymousClient, nil
+	}
+
+	return keyClient(cfg, r)
+}
+
+// keyClient identifies the client by the key it sends.
+func keyClient(cfg *Config, r *http.Request) (string, error) {
+	token := clientToken(r)
+
+	key, ok := cfg.Keys[Secret(token)]
+	if !ok || token == "" {
+		return "", ErrUnknownClientKey
+	}
+
+	if key.Name == "" {
+		return unnamedKeyClient(token), nil
+	}
+
+	return key.Name, nil
+}
+
+// lookupVirtualKey returns the virtual key with the given client name, if any.
+func lookupVirtualKey(cfg *Config, client string) *VirtualKey {
+	for token, key := range cfg.Keys {
+		if key.Name == client || (key.Name == "" && unnamedKeyClient(token.Value()) == client) {
+			key := key
+			return &key
+		}
+	}
+
+	return nil
+}
+
+// clientToken reads the key from either the OpenAI or the Azure style header.
+func clientToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+
+	return r.Header.Get("api-key")
+}
+
+// unnamedKeyClient is the client name of a key without a name: the redacted key, to recognize it
+// in logs, and a hash of the whole key, so that keys which redact alike have separate limits and
+// budgets.
+func unnamedKeyClient(token string) string {
+	const hashLength = 6
+
+	sum := sha256.Sum256([]byte(token))
+
+	return redactKey(token) + "-" + hex.EncodeToString(sum[:hashLength])
+}
+
+// redactKey keeps enough of a key to tell keys apart in logs without exposing it.
+func redactKey(key string) string {
+	const visible = 4
+
+	if len(key) <= visible*2 {
+		return "****"
+	}
+
+	return key[:visible] + "..." + key[len(key)-visible:]
+}
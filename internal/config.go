@@ -1,22 +1,10 @@
 package internal
 
-import (
-	"fmt"
-	"os"
-
-	"gopkg.in/yaml.v2"
-)
+import "os"
 
+// LoadConfig reads the configuration file with the environment variable overrides applied.
 func LoadConfig(filename string) (*Config, error) {
-	buf, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, fmt.Errorf("config file read failed: %w", err)
-	}
-
-	var cfg Config
-	if err := yaml.Unmarshal(buf, &cfg); err != nil {
-		return nil, fmt.Errorf("yaml parse failed: %w", err)
-	}
+	cfg, _, err := LoadConfigLayers(filename, ConfigLayers{Env: os.Environ()})
 
-	return &cfg, nil
+	return cfg, err
 }
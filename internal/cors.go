@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrInvalidOriginPattern = errors.New("invalid origin pattern")
+
+// defaultCORS is the policy of listeners without one: any origin may call the API, without
+// credentials, which browsers don't allow together with a wildcard origin anyway.
+var defaultCORS = ListenerCORS{AllowedOrigins: []string{"*"}}
+
+// Methods and headers allowed when a policy doesn't list its own.
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodOptions}
+	defaultCORSHeaders = []string{
+		"Accept", "Authorization", "Content-Type", "Origin", "X-Requested-With", RequestIDHeader, CacheHeader,
+	}
+)
+
+// corsExposedHeaders are the response headers scripts may read.
+var corsExposedHeaders = strings.Join([]string{RequestIDHeader, CacheHeader}, ", ")
+
+// corsPolicy returns the CORS policy of the listener a request arrived on.
+func corsPolicy(r *http.Request) ListenerCORS {
+	if listener := listenerFrom(r.Context()); listener != nil && listener.CORS != nil {
+		return *listener.CORS
+	}
+
+	return defaultCORS
+}
+
+// originAllowed matches an origin against the allowed ones: exact origins, "*" for any, or
+// patterns like "https://*.example.com". Origins are compared case-insensitively.
+func originAllowed(policy ListenerCORS, origin string) bool {
+	origin = strings.ToLower(origin)
+
+	for _, allowed := range policy.AllowedOrigins {
+		allowed = strings.ToLower(allowed)
+
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+
+		if matched, err := path.Match(allowed, origin); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// anyOrigin reports whether the policy allows every origin.
+func anyOrigin(policy ListenerCORS) bool {
+	for _, allowed := range policy.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func corsMethods(policy ListenerCORS) []string {
+	if len(policy.AllowedMethods) > 0 {
+		return policy.AllowedMethods
+	}
+
+	return defaultCORSMethods
+}
+
+func corsHeaders(policy ListenerCORS) []string {
+	if len(policy.AllowedHeaders) > 0 {
+		return policy.AllowedHeaders
+	}
+
+	return defaultCORSHeaders
+}
+
+// containsFold reports whether list contains value, or "*", ignoring case.
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if item == "*" || strings.EqualFold(item, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// corsAnswer lists the allowed methods or headers for a preflight response.
+func corsAnswer(allowed []string, requested string) string {
+	for _, item := range allowed {
+		if item == "*" {
+			return requested
+		}
+	}
+
+	return strings.Join(allowed, ", ")
+}
+
+// handleCORS applies the CORS policy of the listener. It answers preflight requests and rejects
+// requests from origins the policy doesn't allow, and reports whether the request should still be
+// served. Requests without an Origin header don't come from a browser script and pass through.
+func handleCORS(logger *log.Logger, w http.ResponseWriter, r *http.Request) bool {
+	policy := corsPolicy(r)
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+	w.Header().Add("Vary", "Origin")
+
+	if origin == "" {
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Allow", strings.Join(corsMethods(policy), ", "))
+			w.WriteHeader(http.StatusNoContent)
+
+			return false
+		}
+
+		return true
+	}
+
+	if !originAllowed(policy, origin) {
+		logger.WithFields(log.Fields{"origin": origin, "remoteAddr": r.RemoteAddr}).Warn("Origin not allowed")
+		writeAPIError(w, http.StatusForbidden, "Origin not allowed", "invalid_request_error", "origin_not_allowed")
+
+		return false
+	}
+
+	// A wildcard origin can't be combined with credentials, so those policies echo the origin.
+	if anyOrigin(policy) && !policy.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if policy.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !preflight {
+		w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Allow", strings.Join(corsMethods(policy), ", "))
+			w.WriteHeader(http.StatusNoContent)
+
+			return false
+		}
+
+		return true
+	}
+
+	method := r.Header.Get("Access-Control-Request-Method")
+	if !containsFold(corsMethods(policy), method) {
+		logger.WithFields(log.Fields{"origin": origin, "method": method}).Warn("Method not allowed by CORS policy")
+		writeAPIError(w, http.StatusForbidden, "Method not allowed", "invalid_request_error", "")
+
+		return false
+	}
+
+	for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		header = strings.TrimSpace(header)
+		if header != "" && !containsFold(corsHeaders(policy), header) {
+			logger.WithFields(log.Fields{"origin": origin, "header": header}).Warn("Header not allowed by CORS policy")
+			writeAPIError(w, http.StatusForbidden, "Header not allowed: "+header, "invalid_request_error", "")
+
+			return false
+		}
+	}
+
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+	// A "*" in the lists is answered with what was asked for, as browsers take it literally when
+	// credentials are allowed.
+	w.Header().Set("Access-Control-Allow-Methods", corsAnswer(corsMethods(policy), method))
+	w.Header().Set("Access-Control-Allow-Headers", corsAnswer(corsHeaders(policy), r.Header.Get("Access-Control-Request-Headers")))
+
+	if policy.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return false
+}
+
+func validateListenerCORS(problems *configProblems, i int, listener Listener) {
+	policy := listener.CORS
+	if policy == nil {
+		return
+	}
+
+	setting := fmt.Sprintf("listeners[%d].cors", i)
+
+	if len(policy.AllowedOrigins) == 0 {
+		problems.add(setting+".allowedOrigins", "at least one origin is required, or \"*\" for any")
+	}
+
+	for j, origin := range policy.AllowedOrigins {
+		if _, err := path.Match(origin, ""); err != nil {
+			problems.addErr(fmt.Sprintf("%s.allowedOrigins[%d]", setting, j), fmt.Errorf("%w: %q", ErrInvalidOriginPattern, origin))
+		}
+	}
+
+	if policy.AllowCredentials && anyOrigin(*policy) {
+		problems.add(setting+".allowCredentials", "can't be combined with the \"*\" origin, list the origins instead")
+	}
+
+	for j, method := range policy.AllowedMethods {
+		if method != strings.ToUpper(method) || strings.ContainsAny(method, " ,") {
+			problems.add(fmt.Sprintf("%s.allowedMethods[%d]", setting, j), "%q is not an upper case method name", method)
+		}
+	}
+
+	if policy.MaxAge < 0 {
+		problems.add(setting+".maxAge", "can't be negative")
+	}
+}
@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{"wildcard", []string{"*"}, "https://anything.example", true},
+		{"exact", []string{"https://chat.example.com"}, "https://chat.example.com", true},
+		{"case-insensitive", []string{"https://Chat.Example.com"}, "https://chat.example.COM", true},
+		{"other origin", []string{"https://chat.example.com"}, "https://evil.example.com", false},
+		{"other scheme", []string{"https://chat.example.com"}, "http://chat.example.com", false},
+		{"pattern", []string{"https://*.example.com"}, "https://a.example.com", true},
+		{"pattern doesn't match the apex", []string{"https://*.example.com"}, "https://example.com", false},
+		{"pattern doesn't match a suffix", []string{"https://*.example.com"}, "https://a.example.com.evil.net", false},
+		{"no origins", nil, "https://chat.example.com", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := originAllowed(ListenerCORS{AllowedOrigins: test.allowed}, test.origin); got != test.want {
+				t.Errorf("originAllowed(%v, %q) = %v, want %v", test.allowed, test.origin, got, test.want)
+			}
+		})
+	}
+}
+
+func TestHandleCORS(t *testing.T) {
+	restricted := &ListenerCORS{
+		AllowedOrigins:   []string{"https://chat.example.com"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		MaxAge:           10 * time.Minute,
+		AllowCredentials: true,
+	}
+
+	tests := []struct {
+		name        string
+		policy      *ListenerCORS
+		method      string
+		headers     map[string]string
+		wantServe   bool
+		wantStatus  int
+		wantHeaders map[string]string
+	}{
+		{
+			name:      "no origin",
+			method:    http.MethodPost,
+			wantServe: true,
+		},
+		{
+			name:       "options without origin",
+			method:     http.MethodOptions,
+			wantStatus: http.StatusNoContent,
+			wantHeaders: map[string]string{
+				"Allow": "GET, POST, OPTIONS",
+			},
+		},
+		{
+			name:      "default policy allows any origin",
+			method:    http.MethodPost,
+			headers:   map[string]string{"Origin": "https://anything.example"},
+			wantServe: true,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "",
+				"Access-Control-Expose-Headers":    "X-Request-ID, X-Proxy-Cache",
+			},
+		},
+		{
+			name:      "allowed origin with credentials is echoed",
+			policy:    restricted,
+			method:    http.MethodPost,
+			headers:   map[string]string{"Origin": "https://chat.example.com"},
+			wantServe: true,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://chat.example.com",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		},
+		{
+			name:       "origin not allowed",
+			policy:     restricted,
+			method:     http.MethodPost,
+			headers:    map[string]string{"Origin": "https://evil.example.com"},
+			wantStatus: http.StatusForbidden,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "",
+			},
+		},
+		{
+			name:   "preflight",
+			policy: restricted,
+			method: http.MethodOptions,
+			headers: map[string]string{
+				"Origin":                         "https://chat.example.com",
+				"Access-Control-Request-Method":  "POST",
+				"Access-Control-Request-Headers": "authorization, content-type",
+			},
+			wantStatus: http.StatusNoContent,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":  "https://chat.example.com",
+				"Access-Control-Allow-Methods": "GET, POST, OPTIONS",
+				"Access-Control-Allow-Headers": "Authorization, Content-Type",
+				"Access-Control-Max-Age":       "600",
+			},
+		},
+		{
+			name:   "preflight with a method not allowed",
+			policy: restricted,
+			method: http.MethodOptions,
+			headers: map[string]string{
+				"Origin":                        "https://chat.example.com",
+				"Access-Control-Request-Method": "DELETE",
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:   "preflight with a header not allowed",
+			policy: restricted,
+			method: http.MethodOptions,
+			headers: map[string]string{
+				"Origin":                         "https://chat.example.com",
+				"Access-Control-Request-Method":  "POST",
+				"Access-Control-Request-Headers": "Authorization, X-Custom",
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:   "preflight with wildcard headers answers what was asked",
+			policy: &ListenerCORS{AllowedOrigins: []string{"*"}, AllowedHeaders: []string{"*"}},
+			method: http.MethodOptions,
+			headers: map[string]string{
+				"Origin":                         "https://anything.example",
+				"Access-Control-Request-Method":  "POST",
+				"Access-Control-Request-Headers": "X-Custom",
+			},
+			wantStatus: http.StatusNoContent,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Headers": "X-Custom",
+			},
+		},
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "/v1/chat/completions", nil)
+			for name, value := range test.headers {
+				r.Header.Set(name, value)
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), listenerContextKey{}, &Listener{CORS: test.policy}))
+			w := httptest.NewRecorder()
+
+			if serve := handleCORS(logger, w, r); serve != test.wantServe {
+				t.Errorf("handleCORS() = %v, want %v", serve, test.wantServe)
+			}
+
+			if !test.wantServe && w.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, test.wantStatus)
+			}
+
+			for name, want := range test.wantHeaders {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateListenerCORS(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *ListenerCORS
+		want   []string
+	}{
+		{"no policy", nil, nil},
+		{"valid", &ListenerCORS{AllowedOrigins: []string{"https://*.example.com"}, AllowedMethods: []string{"POST"}}, nil},
+		{"no origins", &ListenerCORS{}, []string{"listeners[0].cors.allowedOrigins"}},
+		{"bad pattern", &ListenerCORS{AllowedOrigins: []string{"https://[example.com"}}, []string{"listeners[0].cors.allowedOrigins[0]"}},
+		{"credentials with any origin", &ListenerCORS{AllowedOrigins: []string{"*"}, AllowCredentials: true}, []string{"listeners[0].cors.allowCredentials"}},
+		{"lower case method", &ListenerCORS{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"post"}}, []string{"listeners[0].cors.allowedMethods[0]"}},
+		{"negative max age", &ListenerCORS{AllowedOrigins: []string{"*"}, MaxAge: -time.Second}, []string{"listeners[0].cors.maxAge"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var problems configProblems
+
+			validateListenerCORS(&problems, 0, Listener{CORS: test.policy})
+
+			if len(problems) != len(test.want) {
+				t.Fatalf("got problems %v, want %v", problems, test.want)
+			}
+
+			for i, problem := range problems {
+				var configError *ConfigError
+				if !errors.As(problem, &configError) || configError.Setting != test.want[i] {
+					t.Errorf("problem %d = %v, want one for %s", i, problem, test.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,425 @@
+package internal
+
+import (
+	"bytes"
+	"embed"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultRecentRequests is how many finished requests the dashboard keeps for its table.
+	DefaultRecentRequests = 1000
+	// dashboardMinutes is how far back the traffic charts go.
+	dashboardMinutes = 60
+)
+
+// dashboardLatencyBounds are the upper bounds, in milliseconds, of the latency buckets the
+// percentiles are estimated from.
+var dashboardLatencyBounds = []int64{100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+//go:embed dashboard/index.html dashboard/dashboard.js dashboard/dashboard.css
+var dashboardFiles embed.FS
+
+// dashboardAssets maps the paths of the dashboard's files to the embedded files. Nothing else is
+// served from the embedded files, or without the admin token.
+var dashboardAssets = map[string]string{
+	"/admin/dashboard/":              "dashboard/index.html",
+	"/admin/dashboard/index.html":    "dashboard/index.html",
+	"/admin/dashboard/dashboard.js":  "dashboard/dashboard.js",
+	"/admin/dashboard/dashboard.css": "dashboard/dashboard.css",
+}
+
+// RecentRequest is a finished request as the dashboard shows it. Content is redacted, and only
+// kept with includeContent.
+type RecentRequest struct {
+	ID               string                         `json:"id"`
+	UpstreamID       string                         `json:"upstreamRequestId,omitempty"`
+	Time             time.Time                      `json:"time"`
+	Client           string                         `json:"client"`
+	Model            string                         `json:"model"`
+	RequestType      string                         `json:"requestType"`
+	Upstream         string                         `json:"upstream"`
+	Status           int                            `json:"status"`
+	LatencyMs        int64                          `json:"latencyMs"`
+	PromptTokens     int                            `json:"promptTokens"`
+	CompletionTokens int                            `json:"completionTokens"`
+	Cache            string                         `json:"cache,omitempty"`
+	Error            string                         `json:"error,omitempty"`
+	Messages         []openai.ChatCompletionMessage `json:"messages,omitempty"`
+	Prompt           string                         `json:"prompt,omitempty"`
+	Completion       string                         `json:"completion,omitempty"`
+}
+
+// failed reports whether the request counts towards the error rate.
+func (r RecentRequest) failed() bool {
+	return r.Status >= http.StatusInternalServerError || r.Error != ""
+}
+
+// trafficCounts aggregates the requests of one upstream in one minute.
+type trafficCounts struct {
+	requests  int
+	errors    int
+	latencyMs int64
+	latencies []int // Per bucket of dashboardLatencyBounds, plus one for longer requests
+}
+
+type trafficMinute struct {
+	minute    int64 // Unix time in minutes
+	upstreams map[string]*trafficCounts
+}
+
+// dashboard keeps recent requests and per-minute traffic in memory.
+type dashboard struct {
+	mu             sync.Mutex
+	includeContent bool
+	recent         []RecentRequest // Ring buffer, next is the oldest once it is full
+	next           int
+	minutes        [dashboardMinutes]trafficMinute
+}
+
+var dashboardState *dashboard
+
+// InitializeDashboard starts recording requests for the dashboard, if it is enabled.
+func InitializeDashboard(cfg *DashboardConfig) {
+	if !cfg.Enabled {
+		return
+	}
+
+	size := cfg.RecentRequests
+	if size <= 0 {
+		size = DefaultRecentRequests
+	}
+
+	dashboardState = &dashboard{includeContent: cfg.IncludeContent, recent: make([]RecentRequest, 0, size)}
+}
+
+// recordDashboardRequest adds a finished request to the dashboard.
+func recordDashboardRequest(entry *auditEntry, w *metricsResponseWriter, requestData RequestData) {
+	if dashboardState == nil {
+		return
+	}
+
+	request := RecentRequest{
+		ID:               entry.requestID,
+		UpstreamID:       entry.upstreamID,
+		Time:             entry.started,
+		Client:           requestData.Client,
+		Model:            requestData.Model,
+		RequestType:      requestData.RequestType,
+		Upstream:         w.upstream,
+		Status:           w.statusCode(),
+		LatencyMs:        time.Since(entry.started).Milliseconds(),
+		PromptTokens:     entry.promptTokens,
+		CompletionTokens: entry.completionTokens,
+		Cache:            w.Header().Get(CacheHeader),
+	}
+
+	// Cache hits never reach an upstream, they are shown as one of their own.
+	if request.Upstream == "" && strings.HasSuffix(request.Cache, "HIT") {
+		request.Upstream = "cache"
+	}
+
+	if entry.upstreamError != nil {
+		request.Error = redactor.Redact(entry.upstreamError.Error())
+	}
+
+	if dashboardState.includeContent {
+		request.Messages = redactor.RedactMessages(requestData.Messages)
+		request.Prompt = redactor.Redact(requestData.Prompt)
+		request.Completion = redactor.Redact(entry.completion)
+	}
+
+	dashboardState.record(request)
+}
+
+func (d *dashboard) record(request RecentRequest) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.recent) < cap(d.recent) {
+		d.recent = append(d.recent, request)
+	} else {
+		d.recent[d.next] = request
+		d.next = (d.next + 1) % len(d.recent)
+	}
+
+	// Traffic is counted when requests finish, so a long stream can't land in a rotated out minute.
+	minute := request.Time.Add(time.Duration(request.LatencyMs)*time.Millisecond).Unix() / 60
+	slot := &d.minutes[minute%dashboardMinutes]
+
+	if slot.minute != minute {
+		*slot = trafficMinute{minute: minute, upstreams: map[string]*trafficCounts{}}
+	}
+
+	counts, ok := slot.upstreams[request.Upstream]
+	if !ok {
+		counts = &trafficCounts{latencies: make([]int, len(dashboardLatencyBounds)+1)}
+		slot.upstreams[request.Upstream] = counts
+	}
+
+	counts.requests++
+	counts.latencyMs += request.LatencyMs
+	counts.latencies[sort.Search(len(dashboardLatencyBounds), func(i int) bool {
+		return request.LatencyMs <= dashboardLatencyBounds[i]
+	})]++
+
+	if request.failed() {
+		counts.errors++
+	}
+}
+
+// TrafficPoint is the traffic of one minute.
+type TrafficPoint struct {
+	Time         time.Time `json:"time"`
+	Requests     int       `json:"requests"`
+	Errors       int       `json:"errors"`
+	AvgLatencyMs int64     `json:"avgLatencyMs"`
+}
+
+// UpstreamTraffic summarizes the traffic of an upstream over the window.
+type UpstreamTraffic struct {
+	Upstream          string  `json:"upstream"`
+	Requests          int     `json:"requests"`
+	RequestsPerMinute float64 `json:"requestsPerMinute"`
+	Errors            int     `json:"errors"`
+	ErrorRate         float64 `json:"errorRate"`
+	AvgLatencyMs      int64   `json:"avgLatencyMs"`
+	P50LatencyMs      int64   `json:"p50LatencyMs"` // Upper bound of the latency bucket
+	P95LatencyMs      int64   `json:"p95LatencyMs"`
+}
+
+// traffic returns the traffic of the last minutes, per minute and per upstream.
+func (d *dashboard) traffic(minutes int, now time.Time) ([]TrafficPoint, []UpstreamTraffic) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	points := make([]TrafficPoint, 0, minutes)
+	totals := map[string]*trafficCounts{}
+	current := now.Unix() / 60
+
+	for minute := current - int64(minutes) + 1; minute <= current; minute++ {
+		point := TrafficPoint{Time: time.Unix(minute*60, 0).UTC()}
+		latencyMs := int64(0)
+
+		if slot := d.minutes[minute%dashboardMinutes]; slot.minute == minute {
+			for upstream, counts := range slot.upstreams {
+				point.Requests += counts.requests
+				point.Errors += counts.errors
+				latencyMs += counts.latencyMs
+
+				total, ok := totals[upstream]
+				if !ok {
+					total = &trafficCounts{latencies: make([]int, len(dashboardLatencyBounds)+1)}
+					totals[upstream] = total
+				}
+
+				total.requests += counts.requests
+				total.errors += counts.errors
+				total.latencyMs += counts.latencyMs
+
+				for i, n := range counts.latencies {
+					total.latencies[i] += n
+				}
+			}
+		}
+
+		if point.Requests > 0 {
+			point.AvgLatencyMs = latencyMs / int64(point.Requests)
+		}
+
+		points = append(points, point)
+	}
+
+	upstreams := make([]UpstreamTraffic, 0, len(totals))
+
+	for upstream, total := range totals {
+		upstreams = append(upstreams, UpstreamTraffic{
+			Upstream:          upstream,
+			Requests:          total.requests,
+			RequestsPerMinute: float64(total.requests) / float64(minutes),
+			Errors:            total.errors,
+			ErrorRate:         float64(total.errors) / float64(total.requests),
+			AvgLatencyMs:      total.latencyMs / int64(total.requests),
+			P50LatencyMs:      latencyPercentile(total.latencies, 0.5),
+			P95LatencyMs:      latencyPercentile(total.latencies, 0.95),
+		})
+	}
+
+	sort.Slice(upstreams, func(i, j int) bool { return upstreams[i].Upstream < upstreams[j].Upstream })
+
+	return points, upstreams
+}
+
+// latencyPercentile estimates a percentile as the upper bound of the bucket it falls in. Requests
+// slower than the last bound are reported as that bound.
+func latencyPercentile(buckets []int, percentile float64) int64 {
+	total := 0
+	for _, n := range buckets {
+		total += n
+	}
+
+	seen := 0
+
+	for i, n := range buckets {
+		seen += n
+		if float64(seen) >= percentile*float64(total) && i < len(dashboardLatencyBounds) {
+			return dashboardLatencyBounds[i]
+		}
+	}
+
+	return dashboardLatencyBounds[len(dashboardLatencyBounds)-1]
+}
+
+// search returns the recent requests matching query, newest first, up to limit.
+func (d *dashboard) search(query string, limit int) []RecentRequest {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	query = strings.ToLower(query)
+	found := []RecentRequest{}
+
+	for i := 0; i < len(d.recent) && len(found) < limit; i++ {
+		// Walk backwards from the newest entry.
+		request := d.recent[(d.next-1-i+2*len(d.recent))%len(d.recent)]
+
+		if query == "" || strings.Contains(strings.ToLower(searchText(request)), query) {
+			found = append(found, request)
+		}
+	}
+
+	return found
+}
+
+// searchText is what the search box matches against: the fields of the table and any content.
+func searchText(request RecentRequest) string {
+	parts := []string{
+		request.ID, request.UpstreamID, request.Client, request.Model, request.RequestType, request.Upstream,
+		strconv.Itoa(request.Status), request.Error, request.Prompt, request.Completion,
+	}
+
+	for _, message := range request.Messages {
+		parts = append(parts, message.Content)
+	}
+
+	return strings.Join(parts, "\n")
+}
+
+func (d *dashboard) lookup(id string) (RecentRequest, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, request := range d.recent {
+		if request.ID == id {
+			return request, true
+		}
+	}
+
+	return RecentRequest{}, false
+}
+
+// withoutContent leaves the content of requests to the detail view, to keep the table light.
+func withoutContent(requests []RecentRequest) []RecentRequest {
+	for i := range requests {
+		requests[i].Messages, requests[i].Prompt, requests[i].Completion = nil, "", ""
+	}
+
+	return requests
+}
+
+// isDashboardPage reports whether path is one of the files of an enabled dashboard. They hold no
+// data, which comes from the token protected API, so they are served without the token.
+func isDashboardPage(path string) bool {
+	_, ok := dashboardAssets[path]
+
+	return dashboardState != nil && ok
+}
+
+// dashboardStatic serves the files of the dashboard.
+func dashboardStatic() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dashboardState == nil {
+			writeAPIError(w, http.StatusNotFound, "The dashboard is not enabled", "invalid_request_error", "")
+			return
+		}
+
+		name, ok := dashboardAssets[r.URL.Path]
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "Not found", "invalid_request_error", "")
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed", "invalid_request_error", "")
+			return
+		}
+
+		content, err := dashboardFiles.ReadFile(name)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "Dashboard file missing", "server_error", "")
+			return
+		}
+
+		http.ServeContent(w, r, path.Base(name), time.Time{}, bytes.NewReader(content))
+	})
+}
+
+// handleDashboardAPI answers the dashboard's requests:
+//
+//	GET /admin/dashboard/api/traffic?minutes=15
+//	GET /admin/dashboard/api/requests?q=gpt-4&limit=100
+//	GET /admin/dashboard/api/requests/{id}
+func handleDashboardAPI(logger *log.Logger, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed", "invalid_request_error", "")
+		return
+	}
+
+	if dashboardState == nil {
+		writeAPIError(w, http.StatusNotFound, "The dashboard is not enabled", "invalid_request_error", "")
+		return
+	}
+
+	query := r.URL.Query()
+	path := strings.TrimPrefix(r.URL.Path, "/admin/dashboard/api/")
+
+	switch {
+	case path == "traffic":
+		minutes, err := strconv.Atoi(query.Get("minutes"))
+		if err != nil || minutes <= 0 || minutes > dashboardMinutes {
+			minutes = 15
+		}
+
+		points, upstreams := dashboardState.traffic(minutes, time.Now())
+
+		writeAdminJSON(logger, w, map[string]interface{}{"minutes": points, "upstreams": upstreams})
+	case path == "requests":
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 100
+		}
+
+		writeAdminJSON(logger, w, map[string]interface{}{
+			"data":           withoutContent(dashboardState.search(query.Get("q"), limit)),
+			"includeContent": dashboardState.includeContent,
+		})
+	case strings.HasPrefix(path, "requests/"):
+		request, ok := dashboardState.lookup(strings.TrimPrefix(path, "requests/"))
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "Request not found, it may have rotated out", "invalid_request_error", "")
+			return
+		}
+
+		writeAdminJSON(logger, w, request)
+	default:
+		writeAPIError(w, http.StatusNotFound, "Not found", "invalid_request_error", "")
+	}
+}
@@ -0,0 +1,258 @@
+// Dashboard of the admin listener. The page itself is public, its data comes from the admin API,
+// which takes the admin token kept in sessionStorage for this tab.
+(function () {
+  "use strict";
+
+  const refreshInterval = 10000;
+  const usageDays = 14;
+  const colors = ["#0969da", "#1a7f37", "#bf3989", "#9a6700", "#8250df", "#cf222e", "#1b7c83", "#57606a"];
+
+  const $ = (id) => document.getElementById(id);
+  let timer = null;
+
+  class Unauthorized extends Error {}
+
+  async function api(path) {
+    const response = await fetch(path, {
+      headers: { Authorization: "Bearer " + sessionStorage.getItem("adminToken") },
+    });
+
+    if (response.status === 401) {
+      throw new Unauthorized();
+    }
+
+    const body = await response.json();
+    if (!response.ok) {
+      throw new Error(body.error ? body.error.message : response.statusText);
+    }
+
+    return body;
+  }
+
+  function element(tag, attributes, text) {
+    const node = document.createElementNS(
+      tag === "svg" || ["rect", "polyline", "text", "line"].includes(tag) ? "http://www.w3.org/2000/svg" : "http://www.w3.org/1999/xhtml",
+      tag,
+    );
+
+    for (const [name, value] of Object.entries(attributes || {})) {
+      node.setAttribute(name, value);
+    }
+
+    if (text !== undefined) {
+      node.textContent = text;
+    }
+
+    return node;
+  }
+
+  function row(cells, className) {
+    const tr = element("tr", className ? { class: className } : {});
+    for (const cell of cells) {
+      tr.appendChild(element("td", {}, String(cell)));
+    }
+
+    return tr;
+  }
+
+  function percent(value) {
+    return (value * 100).toFixed(1) + "%";
+  }
+
+  function clockTime(value) {
+    return new Date(value).toLocaleTimeString([], { hour: "2-digit", minute: "2-digit" });
+  }
+
+  // lineChart draws series of {label, values} over the labels of the x axis.
+  function lineChart(svg, labels, series, format) {
+    const width = svg.clientWidth || 400;
+    const height = svg.clientHeight || 140;
+    const left = 44;
+    const bottom = 18;
+    const top = 6;
+
+    svg.replaceChildren();
+    svg.setAttribute("viewBox", `0 0 ${width} ${height}`);
+
+    const highest = Math.max(1e-9, ...series.flatMap((s) => s.values));
+    const x = (i) => left + (labels.length > 1 ? (i * (width - left - 4)) / (labels.length - 1) : 0);
+    const y = (value) => top + (height - top - bottom) * (1 - value / highest);
+
+    svg.appendChild(element("line", { x1: left, y1: y(0), x2: width, y2: y(0), stroke: "#d0d7de" }));
+    svg.appendChild(element("text", { x: left - 4, y: y(highest) + 8, "text-anchor": "end", class: "axis" }, format(highest)));
+    svg.appendChild(element("text", { x: left - 4, y: y(0), "text-anchor": "end", class: "axis" }, format(0)));
+
+    if (labels.length > 0) {
+      svg.appendChild(element("text", { x: left, y: height - 4, class: "axis" }, labels[0]));
+      svg.appendChild(element("text", { x: width - 4, y: height - 4, "text-anchor": "end", class: "axis" }, labels[labels.length - 1]));
+    }
+
+    series.forEach((s, i) => {
+      const points = s.values.map((value, j) => `${x(j)},${y(value)}`).join(" ");
+      svg.appendChild(element("polyline", { points, fill: "none", stroke: colors[i % colors.length], "stroke-width": 2 }));
+    });
+  }
+
+  function legend(list, series) {
+    list.replaceChildren();
+    series.forEach((s, i) => {
+      const item = element("li");
+      item.appendChild(element("span", { style: "background:" + colors[i % colors.length] }));
+      item.appendChild(document.createTextNode(s.label));
+      list.appendChild(item);
+    });
+  }
+
+  async function loadTraffic() {
+    const traffic = await api("api/traffic?minutes=" + $("minutes").value);
+    const labels = traffic.minutes.map((point) => clockTime(point.time));
+
+    lineChart($("chart-requests"), labels, [{ values: traffic.minutes.map((p) => p.requests) }], (v) => Math.round(v));
+    lineChart($("chart-errors"), labels, [{ values: traffic.minutes.map((p) => (p.requests ? p.errors / p.requests : 0)) }], percent);
+    lineChart($("chart-latency"), labels, [{ values: traffic.minutes.map((p) => p.avgLatencyMs) }], (v) => Math.round(v));
+
+    $("upstreams").replaceChildren(
+      ...traffic.upstreams.map((u) =>
+        row(
+          [u.upstream || "(none)", u.requests, u.requestsPerMinute.toFixed(1), u.errors, percent(u.errorRate),
+            u.avgLatencyMs + " ms", "≤ " + u.p50LatencyMs + " ms", "≤ " + u.p95LatencyMs + " ms"],
+          u.errors > 0 ? "failed" : "",
+        ),
+      ),
+    );
+  }
+
+  // usageSeries turns a usage report grouped by day and field into one series per value of field,
+  // the top ones by tokens and the rest summed up as "other".
+  function usageSeries(report, field, days) {
+    const totals = {};
+    const byValue = {};
+
+    for (const summary of report.data) {
+      const value = summary.group[field] || "(anonymous)";
+      const tokens = summary.promptTokens + summary.completionTokens;
+
+      totals[value] = (totals[value] || 0) + tokens;
+      byValue[value] = byValue[value] || {};
+      byValue[value][summary.group.day] = tokens;
+    }
+
+    const ranked = Object.keys(totals).sort((a, b) => totals[b] - totals[a]);
+    const top = ranked.slice(0, colors.length - 1);
+    const series = top.map((value) => ({ label: value, values: days.map((day) => byValue[value][day] || 0) }));
+
+    if (ranked.length > top.length) {
+      const rest = ranked.slice(top.length);
+      series.push({ label: "other", values: days.map((day) => rest.reduce((sum, value) => sum + (byValue[value][day] || 0), 0)) });
+    }
+
+    return series;
+  }
+
+  async function loadUsage() {
+    const days = [];
+    for (let i = usageDays - 1; i >= 0; i--) {
+      days.push(new Date(Date.now() - i * 86400000).toISOString().slice(0, 10));
+    }
+
+    const from = days[0];
+
+    try {
+      const [keys, models] = await Promise.all([
+        api(`../usage?groupBy=day,key&from=${from}`),
+        api(`../usage?groupBy=day,model&from=${from}`),
+      ]);
+
+      $("usage-note").textContent = "";
+
+      for (const [field, report, chart, list] of [["key", keys, "chart-keys", "legend-keys"], ["model", models, "chart-models", "legend-models"]]) {
+        const series = usageSeries(report, field, days);
+        lineChart($(chart), days.map((day) => day.slice(5)), series, (v) => Math.round(v).toLocaleString());
+        legend($(list), series);
+      }
+    } catch (error) {
+      if (error instanceof Unauthorized) {
+        throw error;
+      }
+
+      $("usage-note").textContent = error.message;
+    }
+  }
+
+  async function loadRequests() {
+    const query = encodeURIComponent($("search").value.trim());
+    const recent = await api("api/requests?limit=200&q=" + query);
+
+    $("requests").replaceChildren(
+      ...recent.data.map((request) => {
+        const tr = row(
+          [new Date(request.time).toLocaleTimeString(), request.id, request.client || "(anonymous)", request.model, request.requestType,
+            request.upstream || "(none)", request.status, request.latencyMs + " ms",
+            request.promptTokens + request.completionTokens, request.cache || ""],
+          request.status >= 500 || request.error ? "failed" : "",
+        );
+
+        tr.addEventListener("click", () => showRequest(request.id));
+
+        return tr;
+      }),
+    );
+  }
+
+  async function showRequest(id) {
+    const request = await api("api/requests/" + encodeURIComponent(id)).catch((error) => ({ error: error.message }));
+
+    $("detail-body").textContent = JSON.stringify(request, null, 2);
+    $("detail").showModal();
+  }
+
+  async function refresh() {
+    try {
+      await Promise.all([loadTraffic(), loadUsage(), loadRequests()]);
+    } catch (error) {
+      if (error instanceof Unauthorized) {
+        signOut("Invalid admin token");
+        return;
+      }
+
+      console.error(error);
+    }
+  }
+
+  function signIn() {
+    $("login").hidden = true;
+    $("content").hidden = false;
+    refresh();
+    timer = setInterval(refresh, refreshInterval);
+  }
+
+  function signOut(message) {
+    sessionStorage.removeItem("adminToken");
+    clearInterval(timer);
+    $("content").hidden = true;
+    $("login").hidden = false;
+    $("login-error").textContent = message || "";
+  }
+
+  $("login").addEventListener("submit", (event) => {
+    event.preventDefault();
+    sessionStorage.setItem("adminToken", $("token").value);
+    $("token").value = "";
+    signIn();
+  });
+
+  $("logout").addEventListener("click", () => signOut());
+  $("minutes").addEventListener("change", refresh);
+
+  let searchDelay = null;
+  $("search").addEventListener("input", () => {
+    clearTimeout(searchDelay);
+    searchDelay = setTimeout(() => loadRequests().catch(console.error), 300);
+  });
+
+  if (sessionStorage.getItem("adminToken")) {
+    signIn();
+  } else {
+    signOut();
+  }
+})();
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// useTestDashboard enables the dashboard for one test.
+func useTestDashboard(t *testing.T, cfg DashboardConfig) *dashboard {
+	t.Helper()
+
+	previous := dashboardState
+
+	cfg.Enabled = true
+	InitializeDashboard(&cfg)
+
+	t.Cleanup(func() { dashboardState = previous })
+
+	return dashboardState
+}
+
+func requestIDs(requests []RecentRequest) []string {
+	ids := make([]string, 0, len(requests))
+	for _, request := range requests {
+		ids = append(ids, request.ID)
+	}
+
+	return ids
+}
+
+func TestDashboardSearch(t *testing.T) {
+	d := useTestDashboard(t, DashboardConfig{RecentRequests: 3})
+
+	started := time.Now()
+	for i, model := range []string{"gpt-4", "gpt-3.5-turbo", "gpt-4", "gpt-3.5-turbo"} {
+		d.record(RecentRequest{ID: fmt.Sprintf("req-%d", i), Time: started, Model: model, Status: http.StatusOK})
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		limit int
+		want  []string
+	}{
+		{name: "newest first, oldest rotated out", limit: 10, want: []string{"req-3", "req-2", "req-1"}},
+		{name: "limit", limit: 2, want: []string{"req-3", "req-2"}},
+		{name: "query matches case-insensitively", query: "GPT-4", limit: 10, want: []string{"req-2"}},
+		{name: "no match", query: "claude", limit: 10, want: []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := requestIDs(d.search(test.query, test.limit)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("search(%q) = %v, want %v", test.query, got, test.want)
+			}
+		})
+	}
+
+	if _, ok := d.lookup("req-0"); ok {
+		t.Error("a rotated out request can still be looked up")
+	}
+}
+
+func TestDashboardTraffic(t *testing.T) {
+	d := useTestDashboard(t, DashboardConfig{})
+
+	now := time.Date(2023, 10, 1, 12, 30, 30, 0, time.UTC)
+
+	// The minute an hour ago shares its slot with the current one, which replaces it.
+	for _, request := range []RecentRequest{
+		{Time: now.Add(-time.Hour), Upstream: "backup", Status: http.StatusOK, LatencyMs: 100},
+		{Time: now.Add(-2 * time.Minute), Upstream: "primary", Status: http.StatusOK, LatencyMs: 200},
+		{Time: now.Add(-2 * time.Minute), Upstream: "primary", Status: http.StatusBadGateway, LatencyMs: 400},
+		{Time: now, Upstream: "primary", Status: http.StatusOK, LatencyMs: 50},
+		{Time: now, Upstream: "primary", Status: http.StatusOK, Error: "stream cut off", LatencyMs: 20000},
+	} {
+		d.record(request)
+	}
+
+	points, upstreams := d.traffic(5, now)
+
+	wantRequests := []int{0, 0, 2, 0, 2}
+	for i, point := range points {
+		if point.Requests != wantRequests[i] {
+			t.Errorf("minute %d: %d requests, want %d", i, point.Requests, wantRequests[i])
+		}
+	}
+
+	want := []UpstreamTraffic{{
+		Upstream:          "primary",
+		Requests:          4,
+		RequestsPerMinute: 0.8,
+		Errors:            2,
+		ErrorRate:         0.5,
+		AvgLatencyMs:      5162,
+		P50LatencyMs:      250,
+		P95LatencyMs:      30000,
+	}}
+
+	if !reflect.DeepEqual(upstreams, want) {
+		t.Errorf("traffic() = %+v, want %+v", upstreams, want)
+	}
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	tests := []struct {
+		name       string
+		buckets    []int
+		percentile float64
+		want       int64
+	}{
+		{name: "all in the first bucket", buckets: []int{4, 0, 0, 0, 0, 0, 0, 0, 0, 0}, percentile: 0.95, want: 100},
+		{name: "median", buckets: []int{1, 1, 1, 1, 0, 0, 0, 0, 0, 0}, percentile: 0.5, want: 250},
+		{name: "slower than the last bound", buckets: []int{0, 0, 0, 0, 0, 0, 0, 0, 0, 2}, percentile: 0.5, want: 60000},
+	}
+
+	for _, test := range tests {
+		if got := latencyPercentile(test.buckets, test.percentile); got != test.want {
+			t.Errorf("%s: latencyPercentile() = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDashboardAuthorization(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		path    string
+		token   string
+		want    int
+	}{
+		{name: "page without the token", enabled: true, path: "/admin/dashboard/", want: http.StatusOK},
+		{name: "script without the token", enabled: true, path: "/admin/dashboard/dashboard.js", want: http.StatusOK},
+		{name: "unlisted file without the token", enabled: true, path: "/admin/dashboard/secrets.txt", want: http.StatusUnauthorized},
+		{name: "unlisted file with the token", enabled: true, path: "/admin/dashboard/notes.md", token: "admin-token", want: http.StatusNotFound},
+		{name: "API without the token", enabled: true, path: "/admin/dashboard/api/traffic", want: http.StatusUnauthorized},
+		{name: "API with the token", enabled: true, path: "/admin/dashboard/api/requests", token: "admin-token", want: http.StatusOK},
+		{name: "unknown request", enabled: true, path: "/admin/dashboard/api/requests/nope", token: "admin-token", want: http.StatusNotFound},
+		{name: "disabled dashboard", path: "/admin/dashboard/", want: http.StatusUnauthorized},
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	handler := AdminHandler(testLiveConfig(&Config{Admin: AdminConfig{Token: "admin-token"}}), logger)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			previous := dashboardState
+			dashboardState = nil
+
+			t.Cleanup(func() { dashboardState = previous })
+
+			if test.enabled {
+				useTestDashboard(t, DashboardConfig{})
+			}
+
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.want {
+				t.Errorf("%s answered %d, want %d", test.path, w.Code, test.want)
+			}
+		})
+	}
+}
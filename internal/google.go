@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
@@ -16,13 +17,13 @@ var (
 )
 
 // Interceptor function.
-func GoogleSearchInterceptor(cfg *Config, logger *log.Logger, requestData *RequestData) error {
-	logger.WithFields(log.Fields{"raw_request": requestData}).Info("Received request data")
-
+func GoogleSearchInterceptor(_ context.Context, cfg *Config, logger *log.Entry, requestData *RequestData) error {
 	if requestData == nil {
 		return fmt.Errorf("%w", ErrRequestDataNil)
 	}
 
+	logger.WithFields(log.Fields{"client": requestData.Client, "model": requestData.Model}).Debug("Received request data")
+
 	if requestData.RequestType == "completion" {
 		// Handle completion type request logic here if needed
 		// For now, we just return
@@ -48,7 +49,7 @@ func GoogleSearchInterceptor(cfg *Config, logger *log.Logger, requestData *Reque
 				searchResult, err := PerformGoogleSearch(cfg, logger, searchQuery)
 
 				if err == nil {
-					logger.WithFields(log.Fields{"result": searchResult}).Info("google result")
+					logger.WithFields(log.Fields{"resultBytes": len(searchResult)}).Debug("Added google results to the message")
 
 					requestData.Messages[message].Content += "\n\nThe google search results are: ```" +
 						searchResult + "``` use them to answer the user's question."
@@ -65,10 +66,10 @@ func GoogleSearchInterceptor(cfg *Config, logger *log.Logger, requestData *Reque
 }
 
 // Function to perform a Google search using the rocketlaunchr/google-search package.
-func PerformGoogleSearch(cfg *Config, logger *log.Logger, query string) (string, error) {
+func PerformGoogleSearch(cfg *Config, logger *log.Entry, query string) (string, error) {
 
 	results, err := googlesearch.Search(nil, query) // pass the context instead of nil
-	logger.WithFields(log.Fields{"results": results}).Info("raw google results")
+	logger.WithFields(log.Fields{"results": len(results)}).Debug("Google search finished")
 
 	if err != nil {
 		return "", fmt.Errorf("failed to perform Google search: %w", err) // Wrap the external error
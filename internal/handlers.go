@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,138 +9,313 @@ import (
 	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type RequestInterceptor func(cfg *Config, logger *log.Logger, requestData *RequestData) error
+// RequestInterceptor may change a request before it is forwarded. ctx ends with the request.
+type RequestInterceptor func(ctx context.Context, cfg *Config, logger *log.Entry, requestData *RequestData) error
 
-// You can define a list of interceptors here, if you like.
-var interceptors = []RequestInterceptor{
-	GoogleSearchInterceptor,
+// Interceptors that can be enabled by name with the interceptors setting in config.yaml.
+var interceptors = map[string]RequestInterceptor{
+	"googleSearch": GoogleSearchInterceptor,
+	"truncation":   TruncationInterceptor,
 	// Add more interceptors here
 }
 
-// Prevent Content-Security-Policy Errors when used with webapps served from a different domain.
-func SetCommonHeaders(w http.ResponseWriter, contentType string) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
-	w.Header().Set("Access-Control-Allow-Methods", "GET,HEAD,OPTIONS,POST,PUT")
-	w.Header().Set("Access-Control-Allow-Headers", `
-	Origin, 
-	Accept, 
-	X-Requested-With, 
-	Content-Type, 
-	Access-Control-Request-Method, 
-	Access-Control-Request-Headers, 
-	Authorization`)
-}
+var ErrUnknownInterceptor = errors.New("unknown interceptor")
 
-func HandleOptionsRequest(w http.ResponseWriter) {
-	SetCommonHeaders(w, "application/json") // Use the refactored function
-	w.WriteHeader(http.StatusOK)
-	_, err := w.Write([]byte("OK"))
+// runInterceptors passes the request through the interceptors of its profile in order.
+func runInterceptors(ctx context.Context, cfg *Config, logger *log.Entry, requestData *RequestData) error {
+	for _, name := range interceptorNames(cfg, requestData.Profile) {
+		interceptor, ok := interceptors[name]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownInterceptor, name)
+		}
 
-	if err != nil {
-		return
+		interceptorCtx, span := tracer.Start(ctx, "proxy.interceptor", trace.WithAttributes(attribute.String("proxy.interceptor", name)))
+		err := interceptor(interceptorCtx, cfg, logger, requestData)
+
+		if err != nil {
+			failSpan(span, err)
+			span.End()
+
+			return fmt.Errorf("interceptor %s: %w", name, err)
+		}
+
+		span.End()
+	}
+
+	return nil
+}
+
+// requestTypeForPath maps the endpoint to the request type, or "" for unknown endpoints.
+func requestTypeForPath(path string) string {
+	switch {
+	case strings.HasSuffix(path, "/chat/completions"):
+		return "chat"
+	case strings.HasSuffix(path, "/completions"):
+		return "completion"
+	default:
+		return ""
 	}
 }
 
 // New function to handle different request types
 func handleRequestType(
 	cfg *Config,
-	logger *log.Logger,
+	logger *log.Entry,
 	writer http.ResponseWriter,
 	request *http.Request,
 	requestData RequestData,
 ) {
-	switch {
-	case strings.HasSuffix(request.URL.Path, "/chat/completions"):
-		requestData.RequestType = "chat"
+	switch requestData.RequestType {
+	case "chat":
 		handleChatCompletion(cfg, logger, writer, request, requestData)
-	case strings.HasSuffix(request.URL.Path, "/completions"):
-		requestData.RequestType = "completion"
+	case "completion":
 		handleTextCompletion(cfg, logger, writer, request, requestData)
 	default:
 		http.Error(writer, "Unknown endpoint", http.StatusNotFound)
 	}
 }
 
+// Response serves a client request. Everything logged while serving it carries its request ID.
 func Response(
 	cfg *Config,
-	logger *log.Logger,
+	baseLogger *log.Logger,
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
-	SetCommonHeaders(w, "text/event-stream") // Stream is the default assumed
+	if !handleCORS(baseLogger, w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream") // Stream is the default assumed
+
+	var requestData RequestData
+
+	recorder := &metricsResponseWriter{ResponseWriter: w}
+	w = recorder
+
+	r, span := startRequestSpan(r)
+	r, audit := startAudit(r)
+	r, capture := startCapture(r, audit.requestID)
+
+	logger := baseLogger.WithFields(log.Fields{"requestId": audit.requestID})
+	w.Header().Set(RequestIDHeader, audit.requestID)
+	span.SetAttributes(attribute.String("proxy.request_id", audit.requestID))
+
+	defer func() {
+		observeRequest(recorder, requestData)
+		endRequestSpan(span, recorder.statusCode(), requestData)
+		writeAuditEntry(audit, recorder, r, requestData)
+		recordDashboardRequest(audit, recorder, requestData)
+
+		if err := writeCaptureRecord(capture, recorder, requestData, audit.completion); err != nil {
+			logger.WithFields(log.Fields{"error": err}).Error("Failed to capture request")
+		}
+	}()
+
+	client, err := identifyClient(cfg, r)
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err, "remoteAddr": r.RemoteAddr}).Warn("Rejected request")
+		message := "Incorrect API key provided"
+		if errors.Is(err, ErrClientCertRequired) {
+			message = "A client certificate is required"
+		}
+
+		writeAPIError(w, http.StatusUnauthorized, message, "invalid_request_error", "invalid_api_key")
 
-	if r.Method == "OPTIONS" {
-		HandleOptionsRequest(w)
 		return
 	}
 
-	requestData, err := ReadAndUnmarshalBody(cfg, logger, w, r)
+	_, parseSpan := tracer.Start(r.Context(), "proxy.parse_body")
+	requestData, err = ReadAndUnmarshalBody(cfg, logger, w, r)
+	parseSpan.End()
+
 	if err != nil {
 		handleError(w, logger, err, "Error reading or parsing request body")
 		return
 	}
 
+	requestData.Client = client
+	requestData.RequestID = audit.requestID
+	requestData.Profile = requestProfile(r)
+	requestData.RequestType = requestTypeForPath(r.URL.Path)
+
+	if !enforceProfile(cfg, logger, w, requestData) {
+		return
+	}
+
+	requestData.route = routeRequest(r.Context(), cfg, requestData)
+	defer releaseRoute(requestData.route)
+
+	if err := runInterceptors(r.Context(), cfg, logger, &requestData); err != nil {
+		var tooLong *contextLengthError
+		if errors.As(err, &tooLong) {
+			logger.WithFields(log.Fields{"error": err, "model": resolvedModel(requestData)}).Warn("Prompt exceeds context window")
+			writeAPIError(w, http.StatusBadRequest,
+				fmt.Sprintf("Your last message resulted in %d tokens, but only %d tokens of this model's context window are "+
+					"available for it. Please reduce the length of the message.", tooLong.tokens, tooLong.available),
+				"invalid_request_error", "context_length_exceeded")
+
+			return
+		}
+
+		handleError(w, logger, err, "Error running request interceptors")
+		return
+	}
+
 	// Determine and handle the request type
 	handleRequestType(cfg, logger, w, r, requestData)
 
 }
 
 // HandleChatCompletion handles the logic specific to chat completions.
-func handleChatCompletion(cfg *Config, logger *log.Logger, w http.ResponseWriter, r *http.Request, requestData RequestData) {
-	responseChannel, upstreamName := CreateOpenAIRequest(cfg, logger, requestData.RequestType, requestData.Messages, requestData.Prompt, requestData.MaxTokens)
-	sendResponseFromChannel(w, responseChannel, upstreamName, logger, "chat", requestData)
+func handleChatCompletion(cfg *Config, logger *log.Entry, w http.ResponseWriter, r *http.Request, requestData RequestData) {
+	serveCompletion(cfg, logger, w, r, requestData)
 }
 
 // HandleTextCompletion handles the logic specific to text completions.
-func handleTextCompletion(cfg *Config, logger *log.Logger, w http.ResponseWriter, r *http.Request, requestData RequestData) {
-	responseChannel, upstreamName := CreateOpenAIRequest(cfg, logger, requestData.RequestType, requestData.Messages, requestData.Prompt, requestData.MaxTokens)
-	sendResponseFromChannel(w, responseChannel, upstreamName, logger, "completion", requestData)
+func handleTextCompletion(cfg *Config, logger *log.Entry, w http.ResponseWriter, r *http.Request, requestData RequestData) {
+	serveCompletion(cfg, logger, w, r, requestData)
+}
+
+// serveCompletion runs the checks shared by all completion types, then answers the request from
+// the cache or the upstream.
+func serveCompletion(cfg *Config, logger *log.Entry, w http.ResponseWriter, r *http.Request, requestData RequestData) {
+	if !enforceContextWindow(cfg, logger, w, &requestData) {
+		return
+	}
+
+	// Cache hits cost nothing upstream, so they skip budgets and rate limits.
+	cached, lookup := lookupCachedResponse(cfg, logger, w, r, requestData)
+	if cached != nil {
+		setUpstreamLabel(w, cachedUpstream)
+
+		completedResponse := sendResponse(cfg, w, replayCachedResponse(cached), cachedUpstream, logger, requestData)
+		auditFrom(r.Context()).recordCompletion(
+			promptTokens(cfg, requestData), countTokens(cfg, resolvedModel(requestData), completedResponse), completedResponse)
+		return
+	}
+
+	if !enforceBudget(cfg, logger, w, requestData) {
+		return
+	}
+
+	finish, ok := enforceRateLimits(cfg, logger, w, requestData)
+	if !ok {
+		return
+	}
+
+	responseChannel, upstreamName, outcome := CreateOpenAIRequest(r.Context(), cfg, logger, requestData)
+	setUpstreamLabel(w, upstreamName)
+
+	ctx, span := tracer.Start(r.Context(), "proxy.stream", trace.WithAttributes(attribute.String("proxy.upstream", upstreamName)))
+	defer span.End()
+
+	completedResponse := sendResponse(cfg, w, responseChannel, upstreamName, logger, requestData)
+	completionTokens := countTokens(cfg, resolvedModel(requestData), completedResponse)
+	promptTokens := promptTokens(cfg, requestData)
+
+	finish(completionTokens)
+	observeTokens(upstreamName, requestData, promptTokens, completionTokens)
+	setTokenAttributes(ctx, promptTokens, completionTokens)
+	auditFrom(ctx).recordCompletion(promptTokens, completionTokens, completedResponse)
+
+	// Failed, cut off or cancelled calls leave an error message or part of an answer, which must not
+	// be served to later requests.
+	if outcome.succeeded() && r.Context().Err() == nil {
+		storeCachedResponse(r.Context(), cfg, logger, lookup, requestData, upstreamName, completedResponse)
+	}
 }
 
-// sendResponseFromChannel handles sending the response to the client from the response channel.
-func sendResponseFromChannel(w http.ResponseWriter, responseChannel <-chan string, upstreamName string, logger *log.Logger, requestType string, requestData RequestData) {
+// sendResponse streams the response unless the client explicitly asked for a single JSON body.
+func sendResponse(cfg *Config, w http.ResponseWriter, responseChannel <-chan string, upstreamName string, logger *log.Entry, requestData RequestData) string {
+	if requestData.Stream != nil && !*requestData.Stream {
+		return sendCompleteResponse(cfg, w, responseChannel, upstreamName, logger, requestData)
+	}
+
+	return sendResponseFromChannel(cfg, w, responseChannel, upstreamName, logger, requestData.RequestType, requestData)
+}
+
+// sendCompleteResponse waits for the whole response and sends it as one JSON body.
+func sendCompleteResponse(cfg *Config, w http.ResponseWriter, responseChannel <-chan string, upstreamName string, logger *log.Entry, requestData RequestData) string {
+	var accumulatedContents []string
+	for content := range responseChannel {
+		accumulatedContents = append(accumulatedContents, content)
+	}
+
+	completedResponse := strings.Join(accumulatedContents, "")
+
+	if err := logCompletedResponse(cfg, logger, upstreamName, requestData, completedResponse); err != nil {
+		handleError(w, logger, err, "Failed to marshal final content to JSON")
+		return completedResponse
+	}
+
+	resp := createJSONResponse(requestData.RequestID, completedResponse, getResponseType(requestData.RequestType), false)
+	resp.Usage = usageFor(cfg, requestData, completedResponse)
+
+	for i := range resp.Choices {
+		resp.Choices[i].Delta = nil
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		handleError(w, logger, err, "Failed to marshal final content to JSON")
+		return completedResponse
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_, err = w.Write(data)
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err}).Debug("Failed to write response")
+	}
+
+	return completedResponse
+}
+
+// sendResponseFromChannel handles sending the response to the client from the response channel
+// and returns the completed response.
+func sendResponseFromChannel(cfg *Config, w http.ResponseWriter, responseChannel <-chan string, upstreamName string, logger *log.Entry, requestType string, requestData RequestData) string {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		handleError(w, logger, errors.New("streaming not supported"), "Streaming not supported")
-		return
+		return ""
 	}
 
 	var accumulatedContents []string
 	for content := range responseChannel {
 		accumulatedContents = append(accumulatedContents, content)
 		responseType := getResponseType(requestType)
-		resp := createJSONResponse(content, responseType, false)
+		resp := createJSONResponse(requestData.RequestID, content, responseType, false)
+
+		// Text completions arrive in one piece, so the usage is known with the first response.
+		if requestType == "completion" {
+			resp.Usage = usageFor(cfg, requestData, content)
+		}
+
 		sendJSONResponse(w, resp, flusher, requestType)
 	}
 
 	// After the channel is closed, send the final response.
-	sendFinalResponse(w, accumulatedContents, upstreamName, logger, requestType, flusher, requestData)
+	sendFinalResponse(cfg, w, accumulatedContents, upstreamName, logger, requestType, flusher, requestData)
+
+	return strings.Join(accumulatedContents, "")
 }
 
 // sendFinalResponse sends the final response after all the streaming content has been sent.
-func sendFinalResponse(w http.ResponseWriter, accumulatedContents []string, upstreamName string, logger *log.Logger, requestType string, flusher http.Flusher, requestData RequestData) {
+func sendFinalResponse(cfg *Config, w http.ResponseWriter, accumulatedContents []string, upstreamName string, logger *log.Entry, requestType string, flusher http.Flusher, requestData RequestData) {
 	completedResponse := strings.Join(accumulatedContents, "")
-	finalContentMap := map[string]interface{}{
-		"completedResponse": completedResponse,
-		"requestMessages":   requestData.Messages,
-	}
-	jsonFinalContent, err := json.Marshal(finalContentMap)
-	if err != nil {
+	if err := logCompletedResponse(cfg, logger, upstreamName, requestData, completedResponse); err != nil {
 		handleError(w, logger, err, "Failed to marshal final content to JSON")
 		return
 	}
 
-	logger.WithFields(log.Fields{
-		"response":     string(jsonFinalContent),
-		"upstreamName": upstreamName,
-	}).Info("JSON Completed Response")
-
 	if requestType == "chat" {
-		closingResp := createJSONResponse("", "chat.completion", true)
+		closingResp := createJSONResponse(requestData.RequestID, "", "chat.completion", true)
+		closingResp.Usage = usageFor(cfg, requestData, completedResponse)
 		closingData, err := json.Marshal(closingResp)
 		if err != nil {
 			handleError(w, logger, err, "Failed to marshal final content to JSON")
@@ -152,6 +328,28 @@ func sendFinalResponse(w http.ResponseWriter, accumulatedContents []string, upst
 	flusher.Flush() // Ensure all data is sent before closing
 }
 
+// logCompletedResponse logs and records the usage of a finished response.
+func logCompletedResponse(cfg *Config, logger *log.Entry, upstreamName string, requestData RequestData, completedResponse string) error {
+	finalContentMap := map[string]interface{}{
+		"completedResponse": redactor.Redact(completedResponse),
+		"requestMessages":   redactor.RedactMessages(requestData.Messages),
+	}
+	jsonFinalContent, err := json.Marshal(finalContentMap)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrJSONMarshalFailed, err)
+	}
+
+	logger.WithFields(log.Fields{
+		"response":     string(jsonFinalContent),
+		"upstreamName": upstreamName,
+		"client":       requestData.Client,
+	}).Debug("JSON Completed Response")
+
+	recordUsage(cfg, logger, upstreamName, requestData, completedResponse)
+
+	return nil
+}
+
 // getResponseType determines the response type based on the request type.
 func getResponseType(requestType string) string {
 	if requestType == "chat" {
@@ -160,8 +358,32 @@ func getResponseType(requestType string) string {
 	return "text_completion"
 }
 
+// writeAPIError sends an error body in the format OpenAI clients expect.
+func writeAPIError(w http.ResponseWriter, status int, message string, errorType string, code string) {
+	body, err := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    errorType,
+			"param":   nil,
+			"code":    code,
+		},
+	})
+	if err != nil {
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_, err = w.Write(body)
+	if err != nil {
+		return
+	}
+}
+
 // New function to handle errors consistently
-func handleError(w http.ResponseWriter, logger *log.Logger, err error, contextMessage string) {
+func handleError(w http.ResponseWriter, logger *log.Entry, err error, contextMessage string) {
 	logger.WithFields(log.Fields{"error": err}).Error(contextMessage)
 	http.Error(w, contextMessage, http.StatusInternalServerError)
 }
@@ -0,0 +1,362 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The configuration is built in layers, each changing only the settings it names: defaults, the
+// YAML file, PROXY_* environment variables and then command line flags.
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+
+	configEnvPrefix = "PROXY_"
+)
+
+var ErrUnknownSetting = errors.New("unknown setting")
+
+// ConfigOverride sets one setting, e.g. "upstreams.Primary.apiKey" or "listeners[0].port". Lists,
+// maps and sections take a YAML value such as "[a, b]" or "{logLevel: debug}".
+type ConfigOverride struct {
+	Path  string
+	Value string
+}
+
+// ConfigLayers are applied on top of the configuration file.
+type ConfigLayers struct {
+	Env   []string // KEY=value pairs, usually os.Environ()
+	Flags []ConfigOverride
+}
+
+// ConfigSources records the layer each setting came from, keyed by setting path.
+type ConfigSources map[string]string
+
+// Source returns the layer that set path, or one of the sections containing it.
+func (s ConfigSources) Source(path string) string {
+	for {
+		if source, ok := s[path]; ok {
+			return source
+		}
+
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			return SourceDefault
+		}
+
+		path = path[:i]
+	}
+}
+
+// set records source for path, replacing what was recorded for the settings inside it.
+func (s ConfigSources) set(path string, source string) {
+	for recorded := range s {
+		if strings.HasPrefix(recorded, path+".") || strings.HasPrefix(recorded, path+"[") {
+			delete(s, recorded)
+		}
+	}
+
+	s[path] = source
+}
+
+// ConfigSetting is an effective setting and the layer it came from.
+type ConfigSetting struct {
+	Path   string
+	Value  string
+	Source string
+}
+
+// EffectiveSettings lists every setting that isn't empty, with secrets masked.
+func EffectiveSettings(cfg *Config, sources ConfigSources) []ConfigSetting {
+	flattened := flattenConfig(cfg)
+
+	settings := make([]ConfigSetting, 0, len(flattened))
+	for path, value := range flattened {
+		settings = append(settings, ConfigSetting{Path: path, Value: maskSetting(path, value), Source: sources.Source(path)})
+	}
+
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Path < settings[j].Path })
+
+	return settings
+}
+
+func defaultConfig() Config {
+	return Config{
+		LogConfig: LogConfig{LogOutput: "stdout", LogLevel: "info"},
+		Shutdown:  ShutdownConfig{DrainTimeout: 30 * time.Second},
+	}
+}
+
+// LoadConfigLayers reads the configuration file and applies the other layers to it.
+func LoadConfigLayers(filename string, layers ConfigLayers) (*Config, ConfigSources, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("config file read failed: %w", err)
+	}
+
+	cfg := defaultConfig()
+	defaults := flattenConfig(&cfg)
+
+	if err := readConfigFile(buf, &cfg); err != nil {
+		return nil, nil, err
+	}
+
+	sources := ConfigSources{}
+
+	if err := applyEnvOverrides(&cfg, sources, layers.Env); err != nil {
+		return nil, nil, err
+	}
+
+	for _, override := range layers.Flags {
+		path, err := setConfigValue(reflect.ValueOf(&cfg).Elem(), "", settingSegments(override.Path), ".", override.Value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("flag %s: %w", override.Path, err)
+		}
+
+		sources.set(path, SourceFlag)
+	}
+
+	if err := resolveConfigValues(&cfg); err != nil {
+		return nil, nil, fmt.Errorf("resolving config values: %w", err)
+	}
+
+	// Settings are compared once references are resolved, so that a secret read from the
+	// environment counts as set by the file that references it.
+	for path, value := range flattenConfig(&cfg) {
+		if sources.Source(path) == SourceDefault && defaults[path] != value {
+			sources[path] = SourceFile
+		}
+	}
+
+	return &cfg, sources, nil
+}
+
+// renamedSettings maps the top-level settings that moved to where they are now. The old names are
+// still read, with a warning.
+var renamedSettings = map[string]string{
+	"logLevel": "logConfig.logLevel",
+}
+
+// readConfigFile parses the configuration file into cfg.
+func readConfigFile(buf []byte, cfg *Config) error {
+	// A file that isn't a map fails below, with the error of the strict parse.
+	var document yaml.MapSlice
+	if err := yaml.Unmarshal(buf, &document); err != nil {
+		document = nil
+	}
+
+	renamed := map[string]string{}
+	kept := yaml.MapSlice{}
+
+	for _, item := range document {
+		if name, ok := item.Key.(string); ok && renamedSettings[name] != "" {
+			renamed[name] = ""
+			if item.Value != nil {
+				renamed[name] = fmt.Sprint(item.Value)
+			}
+
+			continue
+		}
+
+		kept = append(kept, item)
+	}
+
+	if len(renamed) > 0 {
+		var err error
+		if buf, err = yaml.Marshal(kept); err != nil {
+			return fmt.Errorf("yaml parse failed: %w", err)
+		}
+	}
+
+	// Unknown fields are errors, so that a misspelled setting isn't silently ignored.
+	if err := yaml.UnmarshalStrict(buf, cfg); err != nil {
+		return fmt.Errorf("yaml parse failed: %w", err)
+	}
+
+	for name, value := range renamed {
+		path := renamedSettings[name]
+
+		if fileHasSetting(kept, settingSegments(path)) {
+			cfg.warnings = append(cfg.warnings, fmt.Sprintf("%s is deprecated and ignored, as %s is also set", name, path))
+			continue
+		}
+
+		cfg.warnings = append(cfg.warnings, fmt.Sprintf("%s is deprecated, use %s", name, path))
+
+		if _, err := setConfigValue(reflect.ValueOf(cfg).Elem(), "", settingSegments(path), ".", value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// fileHasSetting tells whether the parsed file sets the setting named by segments.
+func fileHasSetting(document yaml.MapSlice, segments []string) bool {
+	for _, item := range document {
+		if name, ok := item.Key.(string); !ok || name != segments[0] {
+			continue
+		}
+
+		if len(segments) == 1 {
+			return true
+		}
+
+		section, ok := item.Value.(yaml.MapSlice)
+
+		return ok && fileHasSetting(section, segments[1:])
+	}
+
+	return false
+}
+
+// Warnings lists the problems found while loading the configuration that didn't stop it, to be
+// logged once the logger is set up.
+func (c *Config) Warnings() []string {
+	return c.warnings
+}
+
+// applyEnvOverrides applies PROXY_ variables, named after the setting path in upper case with
+// underscores, e.g. PROXY_LOGCONFIG_LOGLEVEL or PROXY_UPSTREAMS_PRIMARY_APIKEY. Variables that
+// don't name a setting are skipped with a warning, as the prefix may be shared with other tools.
+func applyEnvOverrides(cfg *Config, sources ConfigSources, env []string) error {
+	sorted := append([]string(nil), env...)
+	sort.Strings(sorted)
+
+	var problems []error
+
+	for _, pair := range sorted {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || !strings.HasPrefix(name, configEnvPrefix) || name == SecretsKeyEnv || name == SecretsKeyFileEnv {
+			continue
+		}
+
+		segments := strings.Split(strings.TrimPrefix(name, configEnvPrefix), "_")
+
+		path, err := setConfigValue(reflect.ValueOf(cfg).Elem(), "", segments, "_", value)
+		if errors.Is(err, ErrUnknownSetting) {
+			cfg.warnings = append(cfg.warnings, fmt.Sprintf("environment variable %s skipped: %v", name, err))
+			continue
+		} else if err != nil {
+			problems = append(problems, fmt.Errorf("environment variable %s: %w", name, err))
+			continue
+		}
+
+		sources.set(path, SourceEnv)
+	}
+
+	return errors.Join(problems...)
+}
+
+// settingSegments splits "listeners[0].port" into listeners, 0 and port.
+func settingSegments(path string) []string {
+	return strings.Split(strings.NewReplacer("[", ".", "]", "").Replace(path), ".")
+}
+
+// setConfigValue sets the setting named by segments below v, which are matched case-insensitively.
+// It returns the path of the setting as it is spelled in the configuration file.
+func setConfigValue(v reflect.Value, path string, segments []string, separator string, value string) (string, error) {
+	if len(segments) == 0 {
+		return path, assignSetting(v, value)
+	}
+
+	switch v.Kind() { //nolint:exhaustive
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+
+		return setConfigValue(v.Elem(), path, segments, separator, value)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			name := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+			if v.Type().Field(i).IsExported() && strings.EqualFold(name, segments[0]) {
+				return setConfigValue(v.Field(i), joinSettingPath(path, name), segments[1:], separator, value)
+			}
+		}
+	case reflect.Slice:
+		index, err := strconv.Atoi(segments[0])
+		if err == nil && index >= 0 && index <= v.Len() {
+			// One past the end appends an entry.
+			if index == v.Len() {
+				v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			}
+
+			return setConfigValue(v.Index(index), fmt.Sprintf("%s[%d]", path, index), segments[1:], separator, value)
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+
+		key, rest := matchMapKey(v, segments, separator)
+
+		name := key.String()
+		if path == "keys" {
+			name = redactKey(name)
+		}
+
+		entry := reflect.New(v.Type().Elem()).Elem()
+		if existing := v.MapIndex(key); existing.IsValid() {
+			entry.Set(existing)
+		}
+
+		settingPath, err := setConfigValue(entry, joinSettingPath(path, name), rest, separator, value)
+		if err != nil {
+			return "", err
+		}
+
+		v.SetMapIndex(key, entry)
+
+		return settingPath, nil
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrUnknownSetting, joinSettingPath(path, strings.Join(segments, separator)))
+}
+
+// matchMapKey finds the entry segments refer to. Existing entries match regardless of case and may
+// span several segments, e.g. an upstream named "azure_east"; anything else adds an entry named
+// after the first segment.
+func matchMapKey(v reflect.Value, segments []string, separator string) (reflect.Value, []string) {
+	for n := len(segments); n > 0; n-- {
+		candidate := strings.Join(segments[:n], separator)
+
+		for _, existing := range v.MapKeys() {
+			if strings.EqualFold(existing.String(), candidate) {
+				return existing, segments[n:]
+			}
+		}
+	}
+
+	return reflect.ValueOf(segments[0]).Convert(v.Type().Key()), segments[1:]
+}
+
+// assignSetting parses value into v. Strings are taken as they are, anything else is YAML merged
+// into the current value.
+func assignSetting(v reflect.Value, value string) error {
+	if v.Kind() == reflect.String {
+		v.SetString(value)
+		return nil
+	}
+
+	parsed := reflect.New(v.Type())
+	parsed.Elem().Set(v)
+
+	if err := yaml.UnmarshalStrict([]byte(value), parsed.Interface()); err != nil {
+		return fmt.Errorf("parsing %q: %w", value, err)
+	}
+
+	v.Set(parsed.Elem())
+
+	return nil
+}
@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// systemdFirstFD is the first file descriptor systemd passes, after stdin, stdout and stderr.
+const systemdFirstFD = 3
+
+var (
+	ErrInvalidListener = errors.New("invalid listener")
+	ErrNoSystemdSocket = errors.New("no such socket passed by systemd")
+)
+
+var (
+	systemdSocketsOnce sync.Once
+	systemdSockets     map[string]*os.File
+)
+
+// Address describes where a listener listens, for logs.
+func (l Listener) Address() string {
+	switch {
+	case l.Socket != "":
+		return "unix:" + l.Socket
+	case l.Systemd != "":
+		return "systemd:" + l.Systemd
+	}
+
+	return net.JoinHostPort(l.Interface, l.Port)
+}
+
+// ParseListener reads a listener from the command line: "interface:port" (with IPv6 interfaces in
+// brackets, e.g. "[::1]:6001"), "unix:/path/to/socket" or "systemd:name".
+func ParseListener(spec string) (Listener, error) {
+	if path, ok := strings.CutPrefix(spec, "unix:"); ok {
+		if path == "" {
+			return Listener{}, fmt.Errorf("%w: %q has no socket path", ErrInvalidListener, spec)
+		}
+
+		return Listener{Socket: path}, nil
+	}
+
+	if name, ok := strings.CutPrefix(spec, "systemd:"); ok {
+		if name == "" {
+			return Listener{}, fmt.Errorf("%w: %q has no socket name", ErrInvalidListener, spec)
+		}
+
+		return Listener{Systemd: name}, nil
+	}
+
+	host, port, err := net.SplitHostPort(spec)
+	if err != nil {
+		return Listener{}, fmt.Errorf("%w: %w", ErrInvalidListener, err)
+	}
+
+	return Listener{Interface: host, Port: port}, nil
+}
+
+// Listen opens the socket of a listener: a TCP port, a Unix socket or a socket passed by systemd.
+func Listen(listener Listener) (net.Listener, error) {
+	switch {
+	case listener.Socket != "":
+		return listenUnix(listener)
+	case listener.Systemd != "":
+		return listenSystemd(listener.Systemd)
+	}
+
+	tcp, err := net.Listen("tcp", net.JoinHostPort(listener.Interface, listener.Port))
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", listener.Address(), err)
+	}
+
+	return tcp, nil
+}
+
+func listenUnix(listener Listener) (net.Listener, error) {
+	// A socket left behind by a previous run would make the bind fail.
+	if info, err := os.Lstat(listener.Socket); err == nil && info.Mode().Type() == fs.ModeSocket {
+		if err := os.Remove(listener.Socket); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+
+	unix, err := net.Listen("unix", listener.Socket)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", listener.Address(), err)
+	}
+
+	if err := setSocketPermissions(listener); err != nil {
+		unix.Close()
+		return nil, err
+	}
+
+	return unix, nil
+}
+
+// setSocketPermissions applies socketMode, socketOwner and socketGroup to a Unix socket.
+func setSocketPermissions(listener Listener) error {
+	if listener.SocketMode != "" {
+		mode, err := strconv.ParseUint(listener.SocketMode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("%w: socketMode %q is not an octal mode", ErrInvalidListener, listener.SocketMode)
+		}
+
+		if err := os.Chmod(listener.Socket, fs.FileMode(mode)); err != nil {
+			return fmt.Errorf("setting socket mode: %w", err)
+		}
+	}
+
+	if listener.SocketOwner == "" && listener.SocketGroup == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+
+	if listener.SocketOwner != "" {
+		owner, err := lookupID(listener.SocketOwner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err //nolint:wrapcheck
+			}
+
+			return u.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("socket owner: %w", err)
+		}
+
+		uid = owner
+	}
+
+	if listener.SocketGroup != "" {
+		group, err := lookupID(listener.SocketGroup, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err //nolint:wrapcheck
+			}
+
+			return g.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("socket group: %w", err)
+		}
+
+		gid = group
+	}
+
+	if err := os.Chown(listener.Socket, uid, gid); err != nil {
+		return fmt.Errorf("setting socket owner: %w", err)
+	}
+
+	return nil
+}
+
+// lookupID accepts a numeric ID or looks up a name.
+func lookupID(nameOrID string, lookup func(name string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return id, nil
+	}
+
+	id, err := lookup(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(id) //nolint:wrapcheck
+}
+
+// listenSystemd returns a socket passed with systemd socket activation, by its
+// FileDescriptorName or its position among the passed sockets.
+func listenSystemd(name string) (net.Listener, error) {
+	systemdSocketsOnce.Do(func() { systemdSockets = readSystemdSockets() })
+
+	file, ok := systemdSockets[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoSystemdSocket, name)
+	}
+
+	socket, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("using systemd socket %s: %w", name, err)
+	}
+
+	return socket, nil
+}
+
+// readSystemdSockets reads the sockets passed in LISTEN_FDS, keyed by both name and position.
+func readSystemdSockets() map[string]*os.File {
+	sockets := map[string]*os.File{}
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return sockets
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return sockets
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < count; i++ {
+		name := strconv.Itoa(i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(systemdFirstFD+i), name)
+		sockets[name] = file
+		sockets[strconv.Itoa(i)] = file
+	}
+
+	// Child processes must not think the sockets are meant for them.
+	for _, variable := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(variable)
+	}
+
+	return sockets
+}
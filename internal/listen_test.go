@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseListener(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Listener
+		address string
+		wantErr bool
+	}{
+		{spec: "127.0.0.1:6001", want: Listener{Interface: "127.0.0.1", Port: "6001"}, address: "127.0.0.1:6001"},
+		{spec: ":6001", want: Listener{Port: "6001"}, address: ":6001"},
+		{spec: "[::1]:6001", want: Listener{Interface: "::1", Port: "6001"}, address: "[::1]:6001"},
+		{spec: "unix:/run/proxy.sock", want: Listener{Socket: "/run/proxy.sock"}, address: "unix:/run/proxy.sock"},
+		{spec: "systemd:api", want: Listener{Systemd: "api"}, address: "systemd:api"},
+		{spec: "systemd:0", want: Listener{Systemd: "0"}, address: "systemd:0"},
+		{spec: "6001", wantErr: true},
+		{spec: "::1:6001", wantErr: true},
+		{spec: "", wantErr: true},
+		{spec: "unix:", wantErr: true},
+		{spec: "systemd:", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			listener, err := ParseListener(test.spec)
+			if test.wantErr {
+				if !errors.Is(err, ErrInvalidListener) {
+					t.Fatalf("ParseListener(%q) = %v, want %v", test.spec, err, ErrInvalidListener)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if listener.Interface != test.want.Interface || listener.Port != test.want.Port ||
+				listener.Socket != test.want.Socket || listener.Systemd != test.want.Systemd {
+				t.Errorf("ParseListener(%q) = %+v, want %+v", test.spec, listener, test.want)
+			}
+
+			if address := listener.Address(); address != test.address {
+				t.Errorf("Address() = %q, want %q", address, test.address)
+			}
+		})
+	}
+}
+
+func TestLookupID(t *testing.T) {
+	names := map[string]string{"proxy": "1001", "broken": "not a number"}
+	lookup := func(name string) (string, error) {
+		if id, ok := names[name]; ok {
+			return id, nil
+		}
+
+		return "", fmt.Errorf("unknown %s", name)
+	}
+
+	tests := []struct {
+		nameOrID string
+		want     int
+		wantErr  bool
+	}{
+		{nameOrID: "0", want: 0},
+		{nameOrID: "33", want: 33},
+		{nameOrID: "proxy", want: 1001},
+		{nameOrID: "nobody-here", wantErr: true},
+		{nameOrID: "broken", wantErr: true},
+	}
+
+	for _, test := range tests {
+		id, err := lookupID(test.nameOrID, lookup)
+		if (err != nil) != test.wantErr || id != test.want {
+			t.Errorf("lookupID(%q) = %d, %v, want %d (error %v)", test.nameOrID, id, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing func(path string) error
+		mode     string
+		wantMode fs.FileMode
+		wantErr  bool
+	}{
+		{name: "new socket"},
+		{name: "with mode", mode: "0600", wantMode: 0o600},
+		{
+			name: "stale socket is replaced",
+			existing: func(path string) error {
+				stale, err := net.Listen("unix", path)
+				if err != nil {
+					return err
+				}
+
+				// Keep the file behind, like a process that was killed.
+				stale.(*net.UnixListener).SetUnlinkOnClose(false)
+
+				return stale.Close()
+			},
+		},
+		{
+			name:     "other files are left alone",
+			existing: func(path string) error { return os.WriteFile(path, []byte("data"), 0o600) },
+			wantErr:  true,
+		},
+		{name: "bad mode", mode: "rw-rw----", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "proxy.sock")
+
+			if test.existing != nil {
+				if err := test.existing(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			listener, err := Listen(Listener{Socket: path, SocketMode: test.mode})
+			if test.wantErr {
+				if err == nil {
+					listener.Close()
+					t.Fatal("Listen() succeeded")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+
+			if test.wantMode != 0 {
+				info, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if mode := info.Mode().Perm(); mode != test.wantMode {
+					t.Errorf("socket mode = %o, want %o", mode, test.wantMode)
+				}
+			}
+		})
+	}
+}
+
+// systemdHelperEnv makes TestSystemdHelper act as a process started by systemd socket activation.
+const systemdHelperEnv = "PROXY_TEST_SYSTEMD_HELPER"
+
+func TestListenSystemd(t *testing.T) {
+	tests := []struct {
+		name    string
+		pid     string // "self" for the PID of the started process
+		names   string
+		lookups map[string]int // socket name to the index of the listener it opens, -1 for none
+	}{
+		{
+			name:    "named",
+			pid:     "self",
+			names:   "api:admin",
+			lookups: map[string]int{"api": 0, "admin": 1, "0": 0, "1": 1, "metrics": -1},
+		},
+		{
+			name:    "unnamed",
+			pid:     "self",
+			lookups: map[string]int{"0": 0, "1": 1, "2": -1},
+		},
+		{
+			name:    "partly named",
+			pid:     "self",
+			names:   "api:",
+			lookups: map[string]int{"api": 0, "1": 1},
+		},
+		{
+			name:    "meant for another process",
+			pid:     "1",
+			names:   "api:admin",
+			lookups: map[string]int{"api": -1, "0": -1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				files     []*os.File
+				addresses []string
+			)
+
+			for i := 0; i < 2; i++ {
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer listener.Close()
+
+				file, err := listener.(*net.TCPListener).File()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer file.Close()
+
+				files = append(files, file)
+				addresses = append(addresses, listener.Addr().String())
+			}
+
+			var lookups []string
+			for name := range test.lookups {
+				lookups = append(lookups, name)
+			}
+
+			cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdHelper$")
+			cmd.ExtraFiles = files
+			cmd.Env = append(os.Environ(),
+				systemdHelperEnv+"="+strings.Join(lookups, ","),
+				"LISTEN_PID="+test.pid,
+				"LISTEN_FDS="+strconv.Itoa(len(files)),
+				"LISTEN_FDNAMES="+test.names,
+			)
+
+			output, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("helper failed: %v\n%s", err, output)
+			}
+
+			got := map[string]string{}
+			for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+				if name, address, ok := strings.Cut(line, " "); ok {
+					got[name] = address
+				}
+			}
+
+			for name, index := range test.lookups {
+				want := "none"
+				if index >= 0 {
+					want = addresses[index]
+				}
+
+				if got[name] != want {
+					t.Errorf("socket %q = %s, want %s", name, got[name], want)
+				}
+			}
+
+			if got["environment"] != "cleared" {
+				t.Errorf("LISTEN_* variables were %s for child processes", got["environment"])
+			}
+		})
+	}
+}
+
+// TestSystemdHelper runs in the process started by TestListenSystemd and prints the address of
+// every socket it was asked to look up.
+func TestSystemdHelper(t *testing.T) {
+	lookups, ok := os.LookupEnv(systemdHelperEnv)
+	if !ok {
+		t.Skip("only run by TestListenSystemd")
+	}
+
+	if os.Getenv("LISTEN_PID") == "self" {
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	}
+
+	for _, name := range strings.Split(lookups, ",") {
+		listener, err := listenSystemd(name)
+		if errors.Is(err, ErrNoSystemdSocket) {
+			fmt.Println(name, "none")
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		fmt.Println(name, listener.Addr())
+		listener.Close()
+	}
+
+	environment := "cleared"
+	if os.Getenv("LISTEN_FDS") != "" && os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		environment = "kept"
+	}
+
+	fmt.Println("environment", environment)
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"fmt"
+	"io"
 	"os"
 
 	log "github.com/sirupsen/logrus"
@@ -47,3 +48,14 @@ func InitializeLogger(cfg *LogConfig) (*log.Logger, error) {
 
 	return logger, nil
 }
+
+// CloseLogger flushes and closes the log file logger writes to, if any.
+func CloseLogger(logger *log.Logger) error {
+	if closer, ok := logger.Out.(io.Closer); ok && logger.Out != os.Stdout {
+		if err := closer.Close(); err != nil {
+			return fmt.Errorf("closing log file: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	requestLabels = []string{"upstream", "model", "request_type"}
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_requests_total",
+		Help: "Client requests by the HTTP status they were answered with.",
+	}, append(requestLabels, "status"))
+
+	upstreamErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_upstream_errors_total",
+		Help: "Failed upstream calls by the upstream's HTTP status, or \"error\" when it sent none.",
+	}, append(requestLabels, "status"))
+
+	timeToFirstToken = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_time_to_first_token_seconds",
+		Help:    "Time from calling the upstream until the first chunk arrived.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30},
+	}, requestLabels)
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_request_duration_seconds",
+		Help:    "Time from calling the upstream until its response was complete.",
+		Buckets: []float64{0.25, 0.5, 1, 2, 5, 10, 30, 60, 120, 300},
+	}, requestLabels)
+
+	tokensTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_tokens_total",
+		Help: "Tokens sent to (prompt) and received from (completion) upstreams.",
+	}, append(requestLabels, "direction"))
+
+	inflightStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_inflight_streams",
+		Help: "Upstream responses currently being streamed.",
+	}, requestLabels)
+
+	cacheLookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_cache_lookups_total",
+		Help: "Response cache lookups by result: hit, semantic_hit, miss or bypass.",
+	}, []string{"model", "request_type", "result"})
+
+	circuitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_upstream_circuit_state",
+		Help: "Circuit breaker state per upstream: 0 closed, 1 half-open, 2 open.",
+	}, []string{"upstream"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		upstreamErrorsTotal,
+		timeToFirstToken,
+		upstreamDuration,
+		tokensTotal,
+		inflightStreams,
+		cacheLookupsTotal,
+		circuitState,
+	)
+}
+
+// InitializeMetrics publishes a closed circuit for every configured upstream, so dashboards
+// show upstreams before their first request.
+func InitializeMetrics(cfg *Config) {
+	for name := range cfg.Upstreams {
+		circuitState.WithLabelValues(name).Set(CircuitClosed)
+	}
+}
+
+// MetricsHandler serves the metrics in the Prometheus exposition format.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+func observeTokens(upstream string, requestData RequestData, promptTokens int, completionTokens int) {
+	labels := []string{upstream, requestData.Model, requestData.RequestType}
+
+	tokensTotal.WithLabelValues(append(labels, "prompt")...).Add(float64(promptTokens))
+	tokensTotal.WithLabelValues(append(labels, "completion")...).Add(float64(completionTokens))
+}
+
+func observeCacheLookup(requestData RequestData, result string) {
+	cacheLookupsTotal.WithLabelValues(requestData.Model, requestData.RequestType, result).Inc()
+}
+
+// metricsResponseWriter remembers the status and upstream of a response for proxy_requests_total.
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	status   int
+	upstream string
+}
+
+func (w *metricsResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(data) //nolint:wrapcheck
+}
+
+func (w *metricsResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// setUpstreamLabel records which upstream answered, when w is instrumented.
+func setUpstreamLabel(w http.ResponseWriter, upstream string) {
+	if instrumented, ok := w.(*metricsResponseWriter); ok {
+		instrumented.upstream = upstream
+	}
+}
+
+// statusCode is the status the response was sent with.
+func (w *metricsResponseWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+
+	return w.status
+}
+
+func observeRequest(w *metricsResponseWriter, requestData RequestData) {
+	requestsTotal.WithLabelValues(w.upstream, requestData.Model, requestData.RequestType, strconv.Itoa(w.statusCode())).Inc()
+}
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+	log "github.com/sirupsen/logrus"
+)
+
+// scrapeMetrics returns the metrics page the way Prometheus sees it.
+func scrapeMetrics(t *testing.T) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("/metrics answered %d", w.Code)
+	}
+
+	return w.Body.String()
+}
+
+func TestObserveRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		model    string
+		upstream string
+		respond  func(w http.ResponseWriter)
+		want     string
+	}{
+		{
+			name:     "streamed",
+			model:    "metrics-test-streamed",
+			upstream: "primary",
+			respond:  func(w http.ResponseWriter) { io.WriteString(w, "data: {}\n\n") },
+			want:     `proxy_requests_total{model="metrics-test-streamed",request_type="chat",status="200",upstream="primary"} 1`,
+		},
+		{
+			name:    "rejected before an upstream was chosen",
+			model:   "metrics-test-rejected",
+			respond: func(w http.ResponseWriter) { w.WriteHeader(http.StatusTooManyRequests) },
+			want:    `proxy_requests_total{model="metrics-test-rejected",request_type="chat",status="429",upstream=""} 1`,
+		},
+		{
+			name:     "status of the first header only",
+			model:    "metrics-test-first-header",
+			upstream: "backup",
+			respond: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusBadGateway)
+				w.WriteHeader(http.StatusOK)
+			},
+			want: `proxy_requests_total{model="metrics-test-first-header",request_type="chat",status="502",upstream="backup"} 1`,
+		},
+		{
+			name:    "nothing written",
+			model:   "metrics-test-empty",
+			respond: func(w http.ResponseWriter) {},
+			want:    `proxy_requests_total{model="metrics-test-empty",request_type="chat",status="200",upstream=""} 1`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := &metricsResponseWriter{ResponseWriter: httptest.NewRecorder()}
+
+			setUpstreamLabel(recorder, test.upstream)
+			test.respond(recorder)
+			observeRequest(recorder, RequestData{Model: test.model, RequestType: "chat"})
+
+			if page := scrapeMetrics(t); !strings.Contains(page, test.want) {
+				t.Errorf("metrics don't contain %s", test.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamOutcomeStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"API error", &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}, "429"},
+		{"request error", &openai.RequestError{HTTPStatusCode: http.StatusBadGateway}, "502"},
+		{"connection error", errors.New("connection refused"), "error"},
+	}
+
+	for _, test := range tests {
+		outcome := &upstreamOutcome{}
+		outcome.fail(test.err)
+
+		if got := outcome.status(); got != test.want {
+			t.Errorf("%s: status() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestUpstreamCallMetrics(t *testing.T) {
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	requestData := RequestData{Model: "metrics-test-call", RequestType: "chat"}
+
+	_, call := startUpstreamCall(context.Background(), "primary", Upstream{Type: "openai"}, requestData, false)
+	if page := scrapeMetrics(t); !strings.Contains(page, `proxy_inflight_streams{model="metrics-test-call",request_type="chat",upstream="primary"} 1`) {
+		t.Error("the call isn't counted in flight")
+	}
+
+	call.received("Hello")
+	call.finish(&Config{}, log.NewEntry(logger), &upstreamOutcome{err: &openai.APIError{HTTPStatusCode: http.StatusInternalServerError}})
+
+	page := scrapeMetrics(t)
+
+	for _, want := range []string{
+		`proxy_inflight_streams{model="metrics-test-call",request_type="chat",upstream="primary"} 0`,
+		`proxy_time_to_first_token_seconds_count{model="metrics-test-call",request_type="chat",upstream="primary"} 1`,
+		`proxy_request_duration_seconds_count{model="metrics-test-call",request_type="chat",upstream="primary"} 1`,
+		`proxy_upstream_errors_total{model="metrics-test-call",request_type="chat",status="500",upstream="primary"} 1`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("metrics don't contain %s", want)
+		}
+	}
+}
+
+func TestMetricsAuthorization(t *testing.T) {
+	tests := []struct {
+		name          string
+		publicMetrics bool
+		path          string
+		token         string
+		want          int
+	}{
+		{name: "metrics with the token", path: "/metrics", token: "admin-token", want: http.StatusOK},
+		{name: "metrics without the token", path: "/metrics", want: http.StatusUnauthorized},
+		{name: "public metrics without the token", publicMetrics: true, path: "/metrics", want: http.StatusOK},
+		{name: "public metrics keep the rest private", publicMetrics: true, path: "/admin/usage", want: http.StatusUnauthorized},
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{Admin: AdminConfig{Token: "admin-token", PublicMetrics: test.publicMetrics}}
+
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+
+			w := httptest.NewRecorder()
+			AdminHandler(testLiveConfig(cfg), logger).ServeHTTP(w, r)
+
+			if w.Code != test.want {
+				t.Errorf("%s answered %d, want %d", test.path, w.Code, test.want)
+			}
+		})
+	}
+}
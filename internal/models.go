@@ -1,29 +1,276 @@
 package internal
 
 import (
+	"time"
+
 	openai "github.com/sashabaranov/go-openai"
 )
 
+// Listener is a TCP interface and port, a Unix socket or a socket passed by systemd.
 type Listener struct {
-	Interface string `yaml:"interface"`
-	Port      string `yaml:"port"`
+	Interface string `yaml:"interface,omitempty"`
+	Port      string `yaml:"port,omitempty"`
+	// Socket is the path of a Unix socket to listen on instead of a TCP port
+	Socket      string `yaml:"socket,omitempty"`
+	SocketMode  string `yaml:"socketMode,omitempty"`  // Octal permissions, e.g. "0660"
+	SocketOwner string `yaml:"socketOwner,omitempty"` // User name or ID
+	SocketGroup string `yaml:"socketGroup,omitempty"` // Group name or ID
+	// Systemd is the FileDescriptorName (or the position) of a socket passed by systemd socket
+	// activation
+	Systemd string `yaml:"systemd,omitempty"`
+	// Timeouts, with defaults from server.go when zero. WriteTimeout applies to every write rather
+	// than the whole response, so a stream may last as long as chunks keep arriving.
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout,omitempty"`
+	ReadTimeout       time.Duration `yaml:"readTimeout,omitempty"` // Whole request, including the body
+	IdleTimeout       time.Duration `yaml:"idleTimeout,omitempty"` // Between requests on a keep-alive connection
+	WriteTimeout      time.Duration `yaml:"writeTimeout,omitempty"`
+	// TLS of this listener. Listeners without it use the global certFile and keyFile if useTLS is set.
+	TLS *ListenerTLS `yaml:"tls,omitempty"`
+	// HTTP2 tunes HTTP/2, which TLS listeners always offer, and enables it without TLS (h2c)
+	HTTP2 *ListenerHTTP2 `yaml:"http2,omitempty"`
+	// Profile names the entry of profiles that applies to requests on this listener
+	Profile string `yaml:"profile,omitempty"`
+	// CORS controls which web pages may call the API from a browser; any origin without credentials
+	// when unset
+	CORS *ListenerCORS `yaml:"cors,omitempty"`
+}
+
+// ListenerCORS is the CORS policy of a listener. Empty method and header lists allow the defaults
+// in cors.go, and "*" in them allows any.
+type ListenerCORS struct {
+	// AllowedOrigins are exact origins like "https://app.example.com", patterns like
+	// "https://*.example.com" or "*" for any
+	AllowedOrigins   []string      `yaml:"allowedOrigins"`
+	AllowedMethods   []string      `yaml:"allowedMethods"`
+	AllowedHeaders   []string      `yaml:"allowedHeaders"`
+	MaxAge           time.Duration `yaml:"maxAge"`           // How long browsers may cache a preflight response
+	AllowCredentials bool          `yaml:"allowCredentials"` // Cookies and client certificates; requires listed origins
+}
+
+// ListenerHTTP2 lets clients multiplex many streams on one connection. Zero values keep Go's defaults.
+type ListenerHTTP2 struct {
+	H2C                  bool   `yaml:"h2c"`                  // Accept cleartext HTTP/2 on a listener without TLS
+	MaxConcurrentStreams uint32 `yaml:"maxConcurrentStreams"` // Per connection, 250 by default
+	// Flow-control windows for request bodies in bytes, 1 MiB by default. How fast responses stream
+	// is up to the windows of the client.
+	ConnectionWindowSize int32 `yaml:"connectionWindowSize"`
+	StreamWindowSize     int32 `yaml:"streamWindowSize"`
+}
+
+// Profile limits what the clients of a listener can do. Empty lists allow everything.
+type Profile struct {
+	Upstreams []string `yaml:"upstreams"` // Upstreams requests are routed to, by priority
+	Models    []string `yaml:"models"`    // Models clients may ask for
+	Endpoints []string `yaml:"endpoints"` // "chat" and "completion"
+	// Interceptors replace the global interceptors when set; an empty list runs none
+	Interceptors *[]string `yaml:"interceptors"`
+	Auth         string    `yaml:"auth"` // "none", "key" or "clientCert"; see profiles.go for the default
+}
+
+// ListenerTLS serves a listener over TLS. The files are reloaded when they change.
+type ListenerTLS struct {
+	CertFile     string   `yaml:"certFile"`
+	KeyFile      string   `yaml:"keyFile"`
+	MinVersion   string   `yaml:"minVersion"`   // "1.2" (default) or "1.3"
+	CipherSuites []string `yaml:"cipherSuites"` // crypto/tls names, for TLS 1.2; Go's defaults when empty
+	ClientCAFile string   `yaml:"clientCAFile"` // Enables mutual TLS with client certificates signed by this CA
+	ClientAuth   string   `yaml:"clientAuth"`   // "require" (default) or "optional" with a clientCAFile
+	// ClientIdentities maps the common name or a DNS, email or URI name of a client certificate to
+	// the name of a client key, whose limits and budgets then apply without a bearer token.
+	ClientIdentities map[string]string `yaml:"clientIdentities"`
 }
 
 type Upstream struct {
 	Type     string `yaml:"type"`
-	URL      string `yaml:"url,omitempty"`
+	URL      string `yaml:"url,omitempty" references:"allow"`
 	Model    string `yaml:"model"`
 	Priority int    `yaml:"priority"`
-	APIKey   string `yaml:"apiKey"`
+	Weight   int    `yaml:"weight"` // Share of the traffic among upstreams of the same priority, 1 when unset
+	APIKey   Secret `yaml:"apiKey"`
+	// Transport tunes the pooled connections to the upstream
+	Transport UpstreamTransport `yaml:"transport"`
+}
+
+// UpstreamTransport configures the connections to an upstream. Zero values keep the defaults from
+// transport.go.
+type UpstreamTransport struct {
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+	// ResponseHeaderTimeout limits the wait for the upstream to start answering, unlimited when zero
+	ResponseHeaderTimeout time.Duration `yaml:"responseHeaderTimeout"`
+	IdleTimeout           time.Duration `yaml:"idleTimeout"`        // Pooled connections are closed after this long unused
+	MaxConnections        int           `yaml:"maxConnections"`     // Unlimited when zero
+	MaxIdleConnections    int           `yaml:"maxIdleConnections"` // Kept open for reuse
+	Proxy                 string        `yaml:"proxy"`              // http, https or socks5 URL; HTTPS_PROXY and friends when empty
+	CAFile                string        `yaml:"caFile"`             // Trusted in addition to the system roots
+	CertFile              string        `yaml:"certFile"`           // Client certificate for mutual TLS
+	KeyFile               string        `yaml:"keyFile"`
 }
 
 type Config struct {
-	Upstreams map[string]Upstream `yaml:"upstreams"`
-	Listeners []Listener          `yaml:"listeners"`
-	CertFile  string              `yaml:"certFile"`
-	KeyFile   string              `yaml:"keyFile"`
-	UseTLS    bool                `yaml:"useTLS"`
-	LogConfig LogConfig           `yaml:"logConfig"`
+	Upstreams  map[string]Upstream    `yaml:"upstreams"`
+	Listeners  []Listener             `yaml:"listeners"`
+	CertFile   string                 `yaml:"certFile"`
+	KeyFile    string                 `yaml:"keyFile"`
+	UseTLS     bool                   `yaml:"useTLS"`
+	LogConfig  LogConfig              `yaml:"logConfig"`
+	Keys       map[Secret]VirtualKey  `yaml:"keys"` // Keyed by the bearer token clients send
+	RateLimits RateLimitConfig        `yaml:"rateLimits"`
+	Pricing    map[string]ModelPrice  `yaml:"pricing"` // Keyed by model name
+	Usage      UsageConfig            `yaml:"usage"`
+	Admin      AdminConfig            `yaml:"admin"`
+	Models     map[string]ModelConfig `yaml:"models"`
+	// What to do with chats that don't fit the context window: "reject" (default) or "trim"
+	ContextOverflow string             `yaml:"contextOverflow"`
+	Interceptors    []string           `yaml:"interceptors"` // Names of the interceptors to run, in order
+	Truncation      TruncationConfig   `yaml:"truncation"`
+	Cache           CacheConfig        `yaml:"cache"`
+	CircuitBreaker  CircuitBreaker     `yaml:"circuitBreaker"`
+	Tracing         TracingConfig      `yaml:"tracing"`
+	Audit           AuditConfig        `yaml:"audit"`
+	Redaction       RedactionConfig    `yaml:"redaction"`
+	Capture         CaptureConfig      `yaml:"capture"`
+	SecretsFile     string             `yaml:"secretsFile"` // Encrypted secrets for "secret:NAME" values
+	Shutdown        ShutdownConfig     `yaml:"shutdown"`
+	Profiles        map[string]Profile `yaml:"profiles"` // Referenced by listeners
+	warnings        []string           // Problems found while loading that don't stop it, see Warnings
+}
+
+// ShutdownConfig controls how the proxy stops on SIGTERM or SIGINT.
+type ShutdownConfig struct {
+	// DrainTimeout is how long active streams may take to finish before their upstream calls are
+	// cancelled
+	DrainTimeout time.Duration `yaml:"drainTimeout"`
+}
+
+// CaptureConfig records full request/response pairs for the replay command.
+type CaptureConfig struct {
+	Path        string   `yaml:"path"`        // JSONL archive, capturing is off when empty
+	SampleRatio *float64 `yaml:"sampleRatio"` // Share of requests captured, all when unset
+	Redact      bool     `yaml:"redact"`      // Apply the redaction rules to captured content
+}
+
+type AuditConfig struct {
+	Output         LogConfig `yaml:"output"`         // Where audit entries go, the audit log is off without a logOutput
+	IncludeContent bool      `yaml:"includeContent"` // Also log the redacted messages and completion
+}
+
+// RedactionConfig masks sensitive data in everything logged about request and response content.
+type RedactionConfig struct {
+	Builtin  []string           `yaml:"builtin"` // Any of email, creditCard, apiKey; all of them when unset
+	Patterns []RedactionPattern `yaml:"patterns"`
+}
+
+type RedactionPattern struct {
+	Name        string `yaml:"name"`
+	Pattern     string `yaml:"pattern"`     // Go regular expression
+	Replacement string `yaml:"replacement"` // Defaults to [REDACTED]
+}
+
+type TracingConfig struct {
+	Exporter    string            `yaml:"exporter"` // "otlp" or "none", tracing is off when empty
+	Endpoint    string            `yaml:"endpoint"` // host:port of the OTLP/HTTP collector
+	Insecure    bool              `yaml:"insecure"` // Export over plain HTTP
+	Headers     map[string]Secret `yaml:"headers"`
+	ServiceName string            `yaml:"serviceName"`
+	SampleRatio *float64          `yaml:"sampleRatio"` // Share of new traces recorded, all when unset
+}
+
+// CircuitBreaker stops routing to an upstream after FailureThreshold consecutive failures until
+// Cooldown has passed. A zero FailureThreshold disables it.
+type CircuitBreaker struct {
+	FailureThreshold int           `yaml:"failureThreshold"`
+	Cooldown         time.Duration `yaml:"cooldown"`
+}
+
+type CacheConfig struct {
+	Backend    string              `yaml:"backend"` // "memory" or "disk", caching is off when empty
+	Path       string              `yaml:"path"`    // Directory for the disk backend
+	TTL        time.Duration       `yaml:"ttl"`
+	MaxEntries int                 `yaml:"maxEntries"`
+	MaxBytes   int64               `yaml:"maxBytes"`
+	Semantic   SemanticCacheConfig `yaml:"semantic"`
+}
+
+// SemanticCacheConfig serves cached answers to questions that are similar rather than identical.
+type SemanticCacheConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	Upstream   string        `yaml:"upstream"`   // Upstream that computes embeddings
+	Model      string        `yaml:"model"`      // Embeddings model, defaults to text-embedding-ada-002
+	Threshold  float64       `yaml:"threshold"`  // Minimum cosine similarity for a hit, defaults to 0.95
+	MaxEntries int           `yaml:"maxEntries"` // Across all conversations, defaults to 1000
+	Timeout    time.Duration `yaml:"timeout"`    // Limit on embedding a message, defaults to 5s
+}
+
+type TruncationConfig struct {
+	Strategy         string        `yaml:"strategy"`         // keepLastTurns, slidingWindow or summarize
+	DropSystemPrompt bool          `yaml:"dropSystemPrompt"` // System prompts are kept by default
+	LastTurns        int           `yaml:"lastTurns"`        // For keepLastTurns
+	MaxTokens        int           `yaml:"maxTokens"`        // Prompt budget, defaults to the context window minus the reserve
+	ReserveTokens    int           `yaml:"reserveTokens"`    // Room left for the reply when using the context window
+	SummaryUpstream  string        `yaml:"summaryUpstream"`  // Upstream that writes summaries, defaults to the selected one
+	SummaryMaxTokens int           `yaml:"summaryMaxTokens"`
+	SummaryTimeout   time.Duration `yaml:"summaryTimeout"` // Limit on writing a summary, defaults to 10s
+}
+
+type ModelConfig struct {
+	ContextWindow int    `yaml:"contextWindow"`
+	Encoding      string `yaml:"encoding"` // cl100k_base or o200k_base, guessed from the model name when empty
+}
+
+// VirtualKey identifies a client of the proxy.
+type VirtualKey struct {
+	Name            string               `yaml:"name"`
+	Team            string               `yaml:"team"`
+	RateLimit       *RateLimit           `yaml:"rateLimit,omitempty"`
+	ModelRateLimits map[string]RateLimit `yaml:"modelRateLimits,omitempty"`
+	Budget          Budget               `yaml:"budget"`
+}
+
+// Budget caps spend in the currency of the pricing table. Zero means no cap.
+type Budget struct {
+	Daily   float64 `yaml:"daily"`
+	Monthly float64 `yaml:"monthly"`
+}
+
+// ModelPrice is the cost per 1000 tokens.
+type ModelPrice struct {
+	Prompt     float64 `yaml:"prompt"`
+	Completion float64 `yaml:"completion"`
+}
+
+type UsageConfig struct {
+	Path string `yaml:"path"` // BoltDB file, usage isn't tracked when empty
+}
+
+// AdminConfig configures the listener serving the admin API.
+type AdminConfig struct {
+	Interface string `yaml:"interface"`
+	Port      string `yaml:"port"`
+	Token     Secret `yaml:"token"` // Bearer token required by the admin API
+	// PublicMetrics serves /metrics without the token, for scrapers on a trusted network
+	PublicMetrics bool            `yaml:"publicMetrics"`
+	Dashboard     DashboardConfig `yaml:"dashboard"`
+}
+
+// DashboardConfig configures the web dashboard served on the admin listener.
+type DashboardConfig struct {
+	Enabled        bool `yaml:"enabled"`
+	RecentRequests int  `yaml:"recentRequests"` // Finished requests kept for the table, 1000 by default
+	// IncludeContent keeps the redacted prompts and responses of recent requests for drill-down
+	IncludeContent bool `yaml:"includeContent"`
+}
+
+// RateLimit values of zero mean "unlimited".
+type RateLimit struct {
+	RequestsPerMinute int `yaml:"requestsPerMinute"`
+	TokensPerMinute   int `yaml:"tokensPerMinute"`
+	ConcurrentStreams int `yaml:"concurrentStreams"`
+}
+
+type RateLimitConfig struct {
+	Store   string               `yaml:"store"` // Defaults to "memory"
+	Default RateLimit            `yaml:"default"`
+	Models  map[string]RateLimit `yaml:"models"`
 }
 
 type LogConfig struct {
@@ -40,12 +287,18 @@ type Message struct {
 }
 
 type RequestData struct {
-	RequestType string                         `json:"requestType"`
-	Prompt      string                         `json:"prompt,omitempty"`
-	Model       string                         `json:"model"`
-	Temperature float64                        `json:"temperature"`
-	MaxTokens   int                            `json:"maxTokens"`
-	Messages    []openai.ChatCompletionMessage `json:"messages"`
+	RequestType  string                         `json:"requestType"`
+	Prompt       string                         `json:"prompt,omitempty"`
+	Model        string                         `json:"model"`
+	Temperature  float64                        `json:"temperature"`
+	MaxTokens    int                            `json:"maxTokens"`
+	Stream       *bool                          `json:"stream,omitempty"` // Responses are streamed unless this is false
+	Messages     []openai.ChatCompletionMessage `json:"messages"`
+	Client       string                         `json:"-"` // Name of the virtual key that sent the request
+	Profile      string                         `json:"-"` // Profile of the listener the request arrived on
+	RequestID    string                         `json:"-"` // ID of the request, also the ID of the response
+	route        *upstreamRoute                 // Upstream the request is sent to, chosen before the interceptors run
+	promptTokens int                            // Size of the prompt, once enforceContextWindow has counted it
 }
 
 type JSONResponse struct {
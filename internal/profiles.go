@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How clients of a profile authenticate. The default, "", accepts a mapped client certificate or a
+// key, and everyone when no keys are configured.
+const (
+	ProfileAuthNone       = "none"       // Every request is anonymous, keys are ignored
+	ProfileAuthKey        = "key"        // A client key is required
+	ProfileAuthClientCert = "clientCert" // A client certificate mapped to a client key is required
+)
+
+var (
+	ErrUnknownProfile     = errors.New("unknown profile")
+	ErrClientCertRequired = errors.New("client certificate required")
+	ErrUnknownProfileAuth = errors.New("unknown profile auth")
+	ErrUnknownEndpoint    = errors.New("unknown endpoint")
+)
+
+// endpointNames are the request types a profile can enable.
+var endpointNames = map[string]bool{"chat": true, "completion": true}
+
+// requestProfile returns the name of the profile of the listener a request arrived on.
+func requestProfile(r *http.Request) string {
+	if listener := listenerFrom(r.Context()); listener != nil {
+		return listener.Profile
+	}
+
+	return ""
+}
+
+// profileFor returns the named profile. Listeners without a profile get the empty one, which
+// allows everything.
+func profileFor(cfg *Config, name string) Profile {
+	return cfg.Profiles[name]
+}
+
+// allowedBy reports whether value is in list; an empty list allows everything.
+func allowedBy(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+
+	for _, allowed := range list {
+		if allowed == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// interceptorNames returns the interceptors to run for a profile, its own list or the global one.
+func interceptorNames(cfg *Config, profile string) []string {
+	if names := profileFor(cfg, profile).Interceptors; names != nil {
+		return *names
+	}
+
+	return cfg.Interceptors
+}
+
+// enforceProfile rejects requests for endpoints or models the profile of the listener doesn't
+// enable.
+func enforceProfile(cfg *Config, logger *log.Entry, w http.ResponseWriter, requestData RequestData) bool {
+	profile := profileFor(cfg, requestData.Profile)
+
+	if !allowedBy(profile.Endpoints, requestData.RequestType) {
+		logger.WithFields(log.Fields{"profile": requestData.Profile, "requestType": requestData.RequestType}).Warn("Endpoint not enabled")
+		writeAPIError(w, http.StatusNotFound, "This endpoint is not enabled on this listener", "invalid_request_error", "unknown_url")
+
+		return false
+	}
+
+	if !allowedBy(profile.Models, requestData.Model) {
+		logger.WithFields(log.Fields{"profile": requestData.Profile, "model": requestData.Model}).Warn("Model not allowed")
+		writeAPIError(w, http.StatusForbidden,
+			fmt.Sprintf("The model %q is not available on this listener", requestData.Model),
+			"invalid_request_error", "model_not_found")
+
+		return false
+	}
+
+	return true
+}
+
+func validateProfiles(problems *configProblems, cfg *Config) {
+	for i, listener := range cfg.Listeners {
+		if _, ok := cfg.Profiles[listener.Profile]; listener.Profile != "" && !ok {
+			problems.addErr(fmt.Sprintf("listeners[%d].profile", i), fmt.Errorf("%w: %s", ErrUnknownProfile, listener.Profile))
+			continue
+		}
+
+		if profileFor(cfg, listener.Profile).Auth == ProfileAuthClientCert && (listener.TLS == nil || listener.TLS.ClientCAFile == "") {
+			problems.add(fmt.Sprintf("listeners[%d].profile", i), "profile %s requires client certificates, but the listener has no tls.clientCAFile", listener.Profile)
+		}
+	}
+
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		profile := cfg.Profiles[name]
+		setting := "profiles." + name
+
+		for i, upstream := range profile.Upstreams {
+			validateUpstreamReference(problems, cfg, fmt.Sprintf("%s.upstreams[%d]", setting, i), upstream)
+		}
+
+		for i, endpoint := range profile.Endpoints {
+			if !endpointNames[endpoint] {
+				problems.addErr(fmt.Sprintf("%s.endpoints[%d]", setting, i), fmt.Errorf("%w: %q is not chat or completion", ErrUnknownEndpoint, endpoint))
+			}
+		}
+
+		if profile.Interceptors != nil {
+			for i, interceptor := range *profile.Interceptors {
+				if _, ok := interceptors[interceptor]; !ok {
+					problems.addErr(fmt.Sprintf("%s.interceptors[%d]", setting, i), fmt.Errorf("%w: %s", ErrUnknownInterceptor, interceptor))
+				}
+			}
+		}
+
+		switch profile.Auth {
+		case "", ProfileAuthNone, ProfileAuthClientCert:
+		case ProfileAuthKey:
+			if len(cfg.Keys) == 0 {
+				problems.add(setting+".auth", "key requires client keys to be configured")
+			}
+		default:
+			problems.addErr(setting+".auth", fmt.Errorf("%w: %s", ErrUnknownProfileAuth, profile.Auth))
+		}
+	}
+}
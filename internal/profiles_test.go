@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// profileRequest is a request that arrived on a listener with the given profile.
+func profileRequest(profile string, key string, certName string) *http.Request {
+	listener := &Listener{Profile: profile, TLS: &ListenerTLS{ClientIdentities: map[string]string{"build-agent": "ci"}}}
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	r = r.WithContext(context.WithValue(r.Context(), listenerContextKey{}, listener))
+
+	if key != "" {
+		r.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	if certName != "" {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: certName}}
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	return r
+}
+
+func TestIdentifyClientByProfile(t *testing.T) {
+	cfg := &Config{
+		Keys: map[Secret]VirtualKey{"sk-team-key": {Name: "team"}, "sk-ci-key": {Name: "ci"}},
+		Profiles: map[string]Profile{
+			"open":    {Auth: ProfileAuthNone},
+			"keys":    {Auth: ProfileAuthKey},
+			"mtls":    {Auth: ProfileAuthClientCert},
+			"default": {},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		profile  string
+		key      string
+		certName string
+		want     string
+		wantErr  error
+	}{
+		{name: "none ignores keys", profile: "open", key: "sk-unknown", want: anonymousClient},
+		{name: "key", profile: "keys", key: "sk-team-key", want: "team"},
+		{name: "key ignores certificates", profile: "keys", certName: "build-agent", wantErr: ErrUnknownClientKey},
+		{name: "client certificate", profile: "mtls", certName: "build-agent", want: "ci"},
+		{name: "client certificate required", profile: "mtls", key: "sk-team-key", wantErr: ErrClientCertRequired},
+		{name: "default prefers the certificate", profile: "default", key: "sk-team-key", certName: "build-agent", want: "ci"},
+		{name: "default falls back to the key", profile: "default", key: "sk-team-key", want: "team"},
+		{name: "default rejects unknown keys", profile: "default", key: "sk-unknown", wantErr: ErrUnknownClientKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, err := identifyClient(cfg, profileRequest(test.profile, test.key, test.certName))
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("identifyClient() error = %v, want %v", err, test.wantErr)
+			}
+
+			if client != test.want {
+				t.Errorf("identifyClient() = %q, want %q", client, test.want)
+			}
+		})
+	}
+}
+
+func TestEnforceProfile(t *testing.T) {
+	cfg := &Config{
+		Profiles: map[string]Profile{
+			"internal": {Endpoints: []string{"chat"}, Models: []string{"gpt-3.5-turbo"}},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		profile     string
+		requestType string
+		model       string
+		want        int
+	}{
+		{name: "allowed", profile: "internal", requestType: "chat", model: "gpt-3.5-turbo", want: http.StatusOK},
+		{name: "endpoint not enabled", profile: "internal", requestType: "completion", model: "gpt-3.5-turbo", want: http.StatusNotFound},
+		{name: "model not allowed", profile: "internal", requestType: "chat", model: "gpt-4", want: http.StatusForbidden},
+		{name: "no profile allows everything", requestType: "completion", model: "gpt-4", want: http.StatusOK},
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			requestData := RequestData{Profile: test.profile, RequestType: test.requestType, Model: test.model}
+
+			allowed := enforceProfile(cfg, log.NewEntry(logger), w, requestData)
+			if allowed != (test.want == http.StatusOK) || w.Code != test.want {
+				t.Errorf("enforceProfile() = %v with status %d, want %d", allowed, w.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestProfileRouting(t *testing.T) {
+	none := []string{}
+
+	cfg := &Config{
+		Upstreams: map[string]Upstream{
+			"primary":   {Type: "openai", Priority: 1},
+			"secondary": {Type: "openai", Priority: 2},
+		},
+		Interceptors: []string{"googleSearch"},
+		Profiles: map[string]Profile{
+			"batch": {Upstreams: []string{"secondary"}, Interceptors: &none},
+			"chat":  {Interceptors: &[]string{"truncation"}},
+		},
+	}
+
+	tests := []struct {
+		profile          string
+		wantUpstream     string
+		wantInterceptors []string
+	}{
+		{profile: "", wantUpstream: "primary", wantInterceptors: []string{"googleSearch"}},
+		{profile: "batch", wantUpstream: "secondary", wantInterceptors: []string{}},
+		{profile: "chat", wantUpstream: "primary", wantInterceptors: []string{"truncation"}},
+	}
+
+	for _, test := range tests {
+		if name, _ := selectUpstream(cfg, test.profile); name != test.wantUpstream {
+			t.Errorf("profile %q: selectUpstream() = %s, want %s", test.profile, name, test.wantUpstream)
+		}
+
+		if names := interceptorNames(cfg, test.profile); !reflect.DeepEqual(names, test.wantInterceptors) {
+			t.Errorf("profile %q: interceptorNames() = %v, want %v", test.profile, names, test.wantInterceptors)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrUnknownRateLimitStore = fmt.Errorf("unknown rate limit store")
+
+// RateLimitStore keeps the state behind rate limits. The in-memory store is used by default,
+// deployments running several instances can register a shared store with RegisterRateLimitStore.
+type RateLimitStore interface {
+	// Take consumes one request and the given number of tokens from the buckets under key.
+	// Nothing is consumed when either bucket is short.
+	Take(key string, limit RateLimit, tokens int) (RateLimitStatus, error)
+	// Charge consumes tokens that are only known after the fact, such as completion tokens.
+	Charge(key string, limit RateLimit, tokens int) error
+	// Acquire reserves one of at most limit concurrent stream slots under key.
+	Acquire(key string, limit int) (bool, error)
+	Release(key string) error
+}
+
+// RateLimitStatus describes the buckets after a Take, in the shape of OpenAI's x-ratelimit headers.
+type RateLimitStatus struct {
+	Allowed           bool
+	Exceeded          string // "requests" or "tokens" when not allowed
+	LimitRequests     int
+	RemainingRequests int
+	ResetRequests     time.Duration
+	LimitTokens       int
+	RemainingTokens   int
+	ResetTokens       time.Duration
+}
+
+var (
+	rateLimitStoresMu sync.Mutex
+	rateLimitStores   = map[string]func() RateLimitStore{
+		"memory": func() RateLimitStore { return NewMemoryRateLimitStore() },
+	}
+	rateLimitStore RateLimitStore
+)
+
+// RegisterRateLimitStore makes a store available to the rateLimits.store config setting.
+func RegisterRateLimitStore(name string, factory func() RateLimitStore) {
+	rateLimitStoresMu.Lock()
+	defer rateLimitStoresMu.Unlock()
+
+	rateLimitStores[name] = factory
+}
+
+func rateLimitStoreRegistered(name string) bool {
+	rateLimitStoresMu.Lock()
+	defer rateLimitStoresMu.Unlock()
+
+	_, ok := rateLimitStores[name]
+
+	return ok
+}
+
+// InitializeRateLimiter sets up the store used to enforce rate limits.
+func InitializeRateLimiter(cfg *RateLimitConfig) error {
+	name := cfg.Store
+	if name == "" {
+		name = "memory"
+	}
+
+	rateLimitStoresMu.Lock()
+	factory, ok := rateLimitStores[name]
+	rateLimitStoresMu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownRateLimitStore, name)
+	}
+
+	rateLimitStore = factory()
+
+	return nil
+}
+
+// resolveRateLimit picks the most specific limit for a client and model: the key's per-model
+// limit, then the key's own limit, then the global per-model limit and finally the default.
+func resolveRateLimit(cfg *Config, client string, model string) RateLimit {
+	if key := lookupVirtualKey(cfg, client); key != nil {
+		if limit, ok := key.ModelRateLimits[model]; ok {
+			return limit
+		}
+
+		if key.RateLimit != nil {
+			return *key.RateLimit
+		}
+	}
+
+	if limit, ok := cfg.RateLimits.Models[model]; ok {
+		return limit
+	}
+
+	return cfg.RateLimits.Default
+}
+
+// enforceRateLimits checks the request against its limits before anything is sent upstream.
+// When the request is allowed it returns a function that must be called with the number of
+// completion tokens once the response has finished.
+func enforceRateLimits(
+	cfg *Config,
+	logger *log.Entry,
+	w http.ResponseWriter,
+	requestData RequestData,
+) (func(completionTokens int), bool) {
+	// Limits apply to the model that answers, not whatever name the client asked for.
+	model := resolvedModel(requestData)
+
+	limit := resolveRateLimit(cfg, requestData.Client, model)
+	if rateLimitStore == nil || limit == (RateLimit{}) {
+		return func(int) {}, true
+	}
+
+	key := requestData.Client + "/" + model
+
+	// The stream slot is taken first, so that requests refused for it don't use up requests and
+	// tokens they never get to spend.
+	streams := limit.ConcurrentStreams > 0
+
+	if streams {
+		acquired, err := rateLimitStore.Acquire(key, limit.ConcurrentStreams)
+
+		switch {
+		case err != nil:
+			logger.WithFields(log.Fields{"error": err, "key": key}).Error("Rate limit store failed")
+			streams = false
+		case !acquired:
+			logger.WithFields(log.Fields{"key": key, "exceeded": "streams"}).Warn("Rate limit exceeded")
+			writeAPIError(w, http.StatusTooManyRequests,
+				fmt.Sprintf("Too many concurrent streams for %s on %s", requestData.Client, model),
+				"streams", "rate_limit_exceeded")
+
+			return nil, false
+		}
+	}
+
+	release := func() {
+		if !streams {
+			return
+		}
+
+		if err := rateLimitStore.Release(key); err != nil {
+			logger.WithFields(log.Fields{"error": err, "key": key}).Error("Rate limit store failed")
+		}
+	}
+
+	status, err := rateLimitStore.Take(key, limit, promptTokens(cfg, requestData))
+	if err != nil {
+		// Fail open: a broken store shouldn't take the proxy down with it.
+		logger.WithFields(log.Fields{"error": err, "key": key}).Error("Rate limit store failed")
+		return func(int) { release() }, true
+	}
+
+	setRateLimitHeaders(w, status)
+
+	if !status.Allowed {
+		release()
+
+		logger.WithFields(log.Fields{"key": key, "exceeded": status.Exceeded}).Warn("Rate limit exceeded")
+		writeAPIError(w, http.StatusTooManyRequests,
+			fmt.Sprintf("Rate limit reached for %s on %s: %s per minute", requestData.Client, model, status.Exceeded),
+			status.Exceeded, "rate_limit_exceeded")
+
+		return nil, false
+	}
+
+	return func(completionTokens int) {
+		if err := rateLimitStore.Charge(key, limit, completionTokens); err != nil {
+			logger.WithFields(log.Fields{"error": err, "key": key}).Error("Rate limit store failed")
+		}
+
+		release()
+	}, true
+}
+
+// setRateLimitHeaders mirrors the x-ratelimit-* headers OpenAI sends.
+func setRateLimitHeaders(w http.ResponseWriter, status RateLimitStatus) {
+	if status.LimitRequests > 0 {
+		w.Header().Set("x-ratelimit-limit-requests", strconv.Itoa(status.LimitRequests))
+		w.Header().Set("x-ratelimit-remaining-requests", strconv.Itoa(status.RemainingRequests))
+		w.Header().Set("x-ratelimit-reset-requests", status.ResetRequests.String())
+	}
+
+	if status.LimitTokens > 0 {
+		w.Header().Set("x-ratelimit-limit-tokens", strconv.Itoa(status.LimitTokens))
+		w.Header().Set("x-ratelimit-remaining-tokens", strconv.Itoa(status.RemainingTokens))
+		w.Header().Set("x-ratelimit-reset-tokens", status.ResetTokens.String())
+	}
+
+	if !status.Allowed {
+		reset := status.ResetRequests
+		if status.Exceeded == "tokens" {
+			reset = status.ResetTokens
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+	}
+}
+
+// tokenBucket refills continuously so that capacity units become available every minute.
+type tokenBucket struct {
+	available float64
+	updated   time.Time
+}
+
+func (b *tokenBucket) refill(capacity int, now time.Time) {
+	if b.updated.IsZero() {
+		b.available = float64(capacity)
+	} else {
+		perSecond := float64(capacity) / time.Minute.Seconds()
+		b.available = math.Min(float64(capacity), b.available+now.Sub(b.updated).Seconds()*perSecond)
+	}
+
+	b.updated = now
+}
+
+// untilFull is how long it takes the bucket to return to capacity.
+func (b *tokenBucket) untilFull(capacity int) time.Duration {
+	missing := float64(capacity) - b.available
+	if missing <= 0 {
+		return 0
+	}
+
+	seconds := missing / (float64(capacity) / time.Minute.Seconds())
+
+	return time.Duration(seconds * float64(time.Second)).Round(time.Millisecond)
+}
+
+type memoryBuckets struct {
+	requests tokenBucket
+	tokens   tokenBucket
+	streams  int
+}
+
+// MemoryRateLimitStore keeps token buckets in process memory.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBuckets
+	now     func() time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*memoryBuckets{}, now: time.Now}
+}
+
+func (s *MemoryRateLimitStore) get(key string) *memoryBuckets {
+	buckets, ok := s.buckets[key]
+	if !ok {
+		buckets = &memoryBuckets{}
+		s.buckets[key] = buckets
+	}
+
+	return buckets
+}
+
+func (s *MemoryRateLimitStore) Take(key string, limit RateLimit, tokens int) (RateLimitStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buckets := s.get(key)
+	now := s.now()
+	status := RateLimitStatus{Allowed: true, LimitRequests: limit.RequestsPerMinute, LimitTokens: limit.TokensPerMinute}
+
+	if limit.RequestsPerMinute > 0 {
+		buckets.requests.refill(limit.RequestsPerMinute, now)
+
+		if buckets.requests.available < 1 {
+			status.Allowed, status.Exceeded = false, "requests"
+		}
+	}
+
+	if limit.TokensPerMinute > 0 {
+		buckets.tokens.refill(limit.TokensPerMinute, now)
+
+		// A request bigger than the whole bucket can never succeed, so let it through once full.
+		needed := math.Min(float64(tokens), float64(limit.TokensPerMinute))
+		if status.Allowed && buckets.tokens.available < needed {
+			status.Allowed, status.Exceeded = false, "tokens"
+		}
+	}
+
+	if status.Allowed && limit.RequestsPerMinute > 0 {
+		buckets.requests.available--
+	}
+
+	if status.Allowed && limit.TokensPerMinute > 0 {
+		buckets.tokens.available -= float64(tokens)
+	}
+
+	status.RemainingRequests = int(math.Max(0, buckets.requests.available))
+	status.ResetRequests = buckets.requests.untilFull(limit.RequestsPerMinute)
+	status.RemainingTokens = int(math.Max(0, buckets.tokens.available))
+	status.ResetTokens = buckets.tokens.untilFull(limit.TokensPerMinute)
+
+	return status, nil
+}
+
+func (s *MemoryRateLimitStore) Charge(key string, limit RateLimit, tokens int) error {
+	if limit.TokensPerMinute <= 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buckets := s.get(key)
+	buckets.tokens.refill(limit.TokensPerMinute, s.now())
+	buckets.tokens.available -= float64(tokens)
+
+	return nil
+}
+
+func (s *MemoryRateLimitStore) Acquire(key string, limit int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buckets := s.get(key)
+	if buckets.streams >= limit {
+		return false, nil
+	}
+
+	buckets.streams++
+
+	return true, nil
+}
+
+func (s *MemoryRateLimitStore) Release(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if buckets := s.get(key); buckets.streams > 0 {
+		buckets.streams--
+	}
+
+	return nil
+}
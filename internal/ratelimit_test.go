@@ -0,0 +1,272 @@
+package internal
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMemoryRateLimitStoreTake(t *testing.T) {
+	type take struct {
+		after     time.Duration // since the previous take
+		tokens    int
+		allowed   bool
+		exceeded  string
+		remaining int // requests or tokens left, depending on the limit
+		reset     time.Duration
+	}
+
+	tests := []struct {
+		name  string
+		limit RateLimit
+		takes []take
+	}{
+		{
+			name:  "requests run out",
+			limit: RateLimit{RequestsPerMinute: 2},
+			takes: []take{
+				{allowed: true, remaining: 1, reset: 30 * time.Second},
+				{allowed: true, remaining: 0, reset: time.Minute},
+				{allowed: false, exceeded: "requests", remaining: 0, reset: time.Minute},
+			},
+		},
+		{
+			name:  "requests refill over the minute",
+			limit: RateLimit{RequestsPerMinute: 2},
+			takes: []take{
+				{allowed: true, remaining: 1, reset: 30 * time.Second},
+				{allowed: true, remaining: 0, reset: time.Minute},
+				{after: 15 * time.Second, allowed: false, exceeded: "requests", remaining: 0, reset: 45 * time.Second},
+				{after: 15 * time.Second, allowed: true, remaining: 0, reset: time.Minute},
+			},
+		},
+		{
+			name:  "refill stops at capacity",
+			limit: RateLimit{RequestsPerMinute: 2},
+			takes: []take{
+				{allowed: true, remaining: 1, reset: 30 * time.Second},
+				{after: time.Hour, allowed: true, remaining: 1, reset: 30 * time.Second},
+			},
+		},
+		{
+			name:  "tokens run out",
+			limit: RateLimit{TokensPerMinute: 1000},
+			takes: []take{
+				{tokens: 600, allowed: true, remaining: 400, reset: 36 * time.Second},
+				{tokens: 600, allowed: false, exceeded: "tokens", remaining: 400, reset: 36 * time.Second},
+				{after: 12 * time.Second, tokens: 600, allowed: true, remaining: 0, reset: time.Minute},
+			},
+		},
+		{
+			name:  "request bigger than the bucket passes once full",
+			limit: RateLimit{TokensPerMinute: 1000},
+			takes: []take{
+				{tokens: 5000, allowed: true, remaining: 0, reset: 5 * time.Minute},
+				{after: time.Minute, tokens: 5000, allowed: false, exceeded: "tokens", remaining: 0, reset: 4 * time.Minute},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC)
+			store := NewMemoryRateLimitStore()
+			store.now = func() time.Time { return now }
+
+			for i, take := range test.takes {
+				now = now.Add(take.after)
+
+				status, err := store.Take("client/model", test.limit, take.tokens)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if status.Allowed != take.allowed || status.Exceeded != take.exceeded {
+					t.Errorf("take %d: allowed = %v (%q), want %v (%q)", i, status.Allowed, status.Exceeded, take.allowed, take.exceeded)
+				}
+
+				remaining, reset := status.RemainingRequests, status.ResetRequests
+				if test.limit.TokensPerMinute > 0 {
+					remaining, reset = status.RemainingTokens, status.ResetTokens
+				}
+
+				if remaining != take.remaining || reset != take.reset {
+					t.Errorf("take %d: remaining %d reset in %s, want %d in %s", i, remaining, reset, take.remaining, take.reset)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryRateLimitStoreCharge(t *testing.T) {
+	now := time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC)
+	store := NewMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+	limit := RateLimit{TokensPerMinute: 1000}
+
+	if _, err := store.Take("key", limit, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Charge("key", limit, 800); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := store.Take("key", limit, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Allowed || status.RemainingTokens != 100 {
+		t.Errorf("after charging: allowed = %v with %d tokens left, want refused with 100", status.Allowed, status.RemainingTokens)
+	}
+}
+
+func TestMemoryRateLimitStoreStreams(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+
+	for i, want := range []bool{true, true, false} {
+		if acquired, _ := store.Acquire("key", 2); acquired != want {
+			t.Errorf("acquire %d = %v, want %v", i, acquired, want)
+		}
+	}
+
+	if err := store.Release("key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if acquired, _ := store.Acquire("key", 2); !acquired {
+		t.Error("acquire after release refused")
+	}
+
+	// Releasing more than was acquired doesn't open extra slots.
+	for i := 0; i < 5; i++ {
+		store.Release("other")
+	}
+
+	for i, want := range []bool{true, false} {
+		if acquired, _ := store.Acquire("other", 1); acquired != want {
+			t.Errorf("acquire %d on other = %v, want %v", i, acquired, want)
+		}
+	}
+}
+
+func TestResolveRateLimit(t *testing.T) {
+	keyLimit := RateLimit{RequestsPerMinute: 20}
+
+	cfg := &Config{
+		Keys: map[Secret]VirtualKey{
+			"sk-team": {
+				Name:            "team",
+				RateLimit:       &keyLimit,
+				ModelRateLimits: map[string]RateLimit{"gpt-4": {RequestsPerMinute: 5}},
+			},
+			"sk-plain": {Name: "plain"},
+		},
+		RateLimits: RateLimitConfig{
+			Default: RateLimit{RequestsPerMinute: 100},
+			Models:  map[string]RateLimit{"gpt-4": {RequestsPerMinute: 10}},
+		},
+	}
+
+	tests := []struct {
+		client string
+		model  string
+		want   int
+	}{
+		{"team", "gpt-4", 5},
+		{"team", "gpt-3.5-turbo", 20},
+		{"plain", "gpt-4", 10},
+		{"plain", "gpt-3.5-turbo", 100},
+		{"anonymous", "gpt-4", 10},
+	}
+
+	for _, test := range tests {
+		if got := resolveRateLimit(cfg, test.client, test.model); got.RequestsPerMinute != test.want {
+			t.Errorf("resolveRateLimit(%s, %s) = %d requests per minute, want %d", test.client, test.model, got.RequestsPerMinute, test.want)
+		}
+	}
+}
+
+func TestEnforceRateLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		limit      RateLimit
+		streams    int // already open before the request
+		wantOK     bool
+		wantStatus int
+		wantLeft   int // requests left in the bucket afterwards
+	}{
+		{
+			name:     "allowed",
+			limit:    RateLimit{RequestsPerMinute: 10, ConcurrentStreams: 1},
+			wantOK:   true,
+			wantLeft: 9,
+		},
+		{
+			name:       "too many streams doesn't use up a request",
+			limit:      RateLimit{RequestsPerMinute: 10, ConcurrentStreams: 1},
+			streams:    1,
+			wantStatus: http.StatusTooManyRequests,
+			wantLeft:   10,
+		},
+		{
+			name:       "out of requests frees the stream slot",
+			limit:      RateLimit{RequestsPerMinute: 1, ConcurrentStreams: 1},
+			wantStatus: http.StatusTooManyRequests,
+		},
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryRateLimitStore()
+			rateLimitStore = store
+			defer func() { rateLimitStore = nil }()
+
+			cfg := &Config{RateLimits: RateLimitConfig{Models: map[string]RateLimit{openai.GPT3Dot5Turbo: test.limit}}}
+			requestData := RequestData{Client: "tester", Model: openai.GPT3Dot5Turbo, RequestType: "chat", promptTokens: 10}
+			key := "tester/" + openai.GPT3Dot5Turbo
+
+			for i := 0; i < test.streams; i++ {
+				store.Acquire(key, test.limit.ConcurrentStreams)
+			}
+
+			// A request that was already served leaves the bucket empty when it only holds one.
+			if test.limit.RequestsPerMinute == 1 {
+				store.Take(key, test.limit, 0)
+			}
+
+			w := httptest.NewRecorder()
+
+			done, ok := enforceRateLimits(cfg, log.NewEntry(logger), w, requestData)
+			if ok != test.wantOK {
+				t.Fatalf("enforceRateLimits() allowed = %v, want %v", ok, test.wantOK)
+			}
+
+			if ok {
+				done(5)
+			} else if w.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, test.wantStatus)
+			}
+
+			if streams := store.buckets[key].streams; streams != test.streams {
+				t.Errorf("%d streams open afterwards, want %d", streams, test.streams)
+			}
+
+			if test.limit.RequestsPerMinute > 1 {
+				status, _ := store.Take(key, RateLimit{RequestsPerMinute: test.limit.RequestsPerMinute}, 0)
+				if left := status.RemainingRequests + 1; left != test.wantLeft {
+					t.Errorf("%d requests left, want %d", left, test.wantLeft)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync/atomic"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+var ErrUnknownRedactionRule = errors.New("unknown redaction rule")
+
+type redactionRule struct {
+	name        string
+	pattern     *regexp.Regexp
+	replacement string
+	// valid filters out matches that only look like sensitive data, e.g. numbers failing the Luhn check
+	valid func(match string) bool
+}
+
+// builtinRedactionRules can be enabled by name with redaction.builtin.
+var builtinRedactionRules = map[string]redactionRule{
+	"email": {
+		pattern:     regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+		replacement: "[EMAIL]",
+	},
+	"creditCard": {
+		pattern:     regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+		replacement: "[CREDIT_CARD]",
+		valid:       luhnValid,
+	},
+	"apiKey": {
+		pattern: regexp.MustCompile(
+			`\b(?:sk-[A-Za-z0-9_-]{16,}|AKIA[0-9A-Z]{16}|gh[pousr]_[A-Za-z0-9]{36,}|xox[abpr]-[A-Za-z0-9-]{10,}|AIza[0-9A-Za-z_-]{35})\b` +
+				`|(?i:bearer)\s+[A-Za-z0-9._~+/-]{16,}=*`),
+		replacement: "[API_KEY]",
+	},
+}
+
+// Redactor masks sensitive data in text before it is logged. Its rules can be replaced while it
+// is in use.
+type Redactor struct {
+	rules atomic.Pointer[[]redactionRule]
+}
+
+// redactor is applied to everything the proxy logs about request and response content.
+var redactor = &Redactor{}
+
+// InitializeRedaction compiles the configured rules. All built-in rules are used unless a list is
+// given.
+func InitializeRedaction(cfg *RedactionConfig) error {
+	compiled, err := newRedactor(cfg)
+	if err != nil {
+		return err
+	}
+
+	redactor.replaceRules(compiled)
+
+	return nil
+}
+
+func newRedactor(cfg *RedactionConfig) (*Redactor, error) {
+	builtin := cfg.Builtin
+	if builtin == nil {
+		builtin = []string{"email", "creditCard", "apiKey"}
+	}
+
+	rules := make([]redactionRule, 0, len(builtin)+len(cfg.Patterns))
+
+	for _, name := range builtin {
+		rule, ok := builtinRedactionRules[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownRedactionRule, name)
+		}
+
+		rule.name = name
+		rules = append(rules, rule)
+	}
+
+	for _, pattern := range cfg.Patterns {
+		compiled, err := regexp.Compile(pattern.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redaction pattern %q: %w", pattern.Name, err)
+		}
+
+		replacement := pattern.Replacement
+		if replacement == "" {
+			replacement = "[REDACTED]"
+		}
+
+		rules = append(rules, redactionRule{name: pattern.Name, pattern: compiled, replacement: replacement})
+	}
+
+	compiled := &Redactor{}
+	compiled.rules.Store(&rules)
+
+	return compiled, nil
+}
+
+// replaceRules makes r use the rules of other.
+func (r *Redactor) replaceRules(other *Redactor) {
+	r.rules.Store(other.rules.Load())
+}
+
+// Redact returns text with every match of the rules replaced.
+func (r *Redactor) Redact(text string) string {
+	rules := r.rules.Load()
+	if rules == nil {
+		return text
+	}
+
+	for _, rule := range *rules {
+		rule := rule
+		text = rule.pattern.ReplaceAllStringFunc(text, func(match string) string {
+			if rule.valid != nil && !rule.valid(match) {
+				return match
+			}
+
+			return rule.replacement
+		})
+	}
+
+	return text
+}
+
+// RedactMessages returns a redacted copy of a chat.
+func (r *Redactor) RedactMessages(messages []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	redacted := make([]openai.ChatCompletionMessage, len(messages))
+	for i, message := range messages {
+		message.Content = r.Redact(message.Content)
+		redacted[i] = message
+	}
+
+	return redacted
+}
+
+// luhnValid reports whether the digits in s pass the Luhn checksum used by card numbers.
+func luhnValid(s string) bool {
+	sum, digits := 0, 0
+	double := false
+
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+
+		digit := int(c - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+
+		sum += digit
+		digits++
+		double = !double
+	}
+
+	return digits >= 13 && sum%10 == 0
+}
@@ -0,0 +1,343 @@
+package internal
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadDebounce groups the several write events editors produce when saving a file.
+const reloadDebounce = 250 * time.Millisecond
+
+// restartOnlySections are read once at startup; changes to them are logged but only take effect
+// after a restart.
+var restartOnlySections = []string{
+	"listeners", "certFile", "keyFile", "useTLS", "logConfig", "admin.interface", "admin.port",
+	"admin.dashboard", "rateLimits.store", "usage", "cache", "tracing", "audit", "capture",
+}
+
+// LiveConfig holds the current configuration. Every request reads it once when it starts and uses
+// that *Config until it is done, so a reload never changes the settings of an in-flight stream.
+type LiveConfig struct {
+	path     string
+	layers   ConfigLayers
+	current  atomic.Pointer[Config]
+	reloadMu sync.Mutex
+}
+
+// NewLiveConfig loads and validates the configuration file. layers are applied after every load,
+// so that environment variables and command line flags keep precedence over the file.
+func NewLiveConfig(path string, layers ConfigLayers) (*LiveConfig, error) {
+	live := &LiveConfig{path: path, layers: layers}
+
+	cfg, err := live.read()
+	if err != nil {
+		return nil, err
+	}
+
+	live.current.Store(cfg)
+
+	return live, nil
+}
+
+// Load returns the current configuration.
+func (l *LiveConfig) Load() *Config {
+	return l.current.Load()
+}
+
+func (l *LiveConfig) read() (*Config, error) {
+	cfg, _, err := LoadConfigLayers(l.path, l.layers)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ValidateConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Reload reads the configuration file again and swaps it in if it is valid. The running
+// configuration is kept when it isn't.
+func (l *LiveConfig) Reload(logger *log.Logger) error {
+	l.reloadMu.Lock()
+	defer l.reloadMu.Unlock()
+
+	next, err := l.read()
+	if err != nil {
+		return err
+	}
+
+	nextRedactor, err := newRedactor(&next.Redaction)
+	if err != nil {
+		return err
+	}
+
+	previous := l.current.Swap(next)
+	redactor.replaceRules(nextRedactor)
+
+	InitializeMetrics(next)
+	logConfigChanges(logger, previous, next)
+
+	for _, warning := range next.Warnings() {
+		logger.Warn(warning)
+	}
+
+	return nil
+}
+
+// Watch reloads the configuration whenever the file changes or the process receives SIGHUP.
+// It blocks, so run it in its own goroutine.
+func (l *LiveConfig) Watch(logger *log.Logger) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	// Watch the directory rather than the file: editors and Kubernetes config maps replace the
+	// file instead of writing to it, which ends a watch on the file itself. Config maps swap a
+	// "..data" symlink in the directory, so events don't name the file and every event is checked
+	// against the file the path resolves to. When the path is a symlink elsewhere, the directory
+	// of its target is watched too.
+	var events chan fsnotify.Event
+
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(filepath.Dir(l.path))
+	}
+
+	if target, evalErr := filepath.EvalSymlinks(l.path); err == nil && evalErr == nil && filepath.Dir(target) != filepath.Dir(l.path) {
+		err = watcher.Add(filepath.Dir(target))
+	}
+
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err, "path": l.path}).Warn("Can't watch config file, reload with SIGHUP")
+	} else {
+		defer watcher.Close()
+
+		events = watcher.Events
+	}
+
+	var debounce <-chan time.Time
+
+	last := statConfigFile(l.path)
+
+	for {
+		select {
+		case <-hangups:
+			_ = l.reloadAndLog(logger, "SIGHUP")
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+
+			if event.Has(fsnotify.Chmod) {
+				continue
+			}
+
+			if current := statConfigFile(l.path); configFileChanged(last, current) {
+				last = current
+				debounce = time.After(reloadDebounce)
+			}
+		case <-debounce:
+			debounce = nil
+
+			_ = l.reloadAndLog(logger, "file change")
+		}
+	}
+}
+
+// statConfigFile describes the file the config path resolves to, nil while it can't be read.
+func statConfigFile(path string) os.FileInfo {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+
+	return info
+}
+
+// configFileChanged reports whether the config path now resolves to another file, or the file was
+// written to.
+func configFileChanged(previous os.FileInfo, current os.FileInfo) bool {
+	if previous == nil || current == nil {
+		return current != nil
+	}
+
+	return !os.SameFile(previous, current) || !previous.ModTime().Equal(current.ModTime()) || previous.Size() != current.Size()
+}
+
+func (l *LiveConfig) reloadAndLog(logger *log.Logger, trigger string) error {
+	if err := l.Reload(logger); err != nil {
+		logger.WithFields(log.Fields{"error": err, "trigger": trigger}).Error("Config reload failed, keeping the running configuration")
+		return err
+	}
+
+	logger.WithFields(log.Fields{"trigger": trigger, "path": l.path}).Info("Config reloaded")
+
+	return nil
+}
+
+// logConfigChanges logs every setting that differs between the two configurations.
+func logConfigChanges(logger *log.Logger, previous *Config, next *Config) {
+	before, after := flattenConfig(previous), flattenConfig(next)
+
+	paths := make([]string, 0, len(before)+len(after))
+	for path := range before {
+		paths = append(paths, path)
+	}
+
+	for path := range after {
+		if _, ok := before[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		old, hadOld := before[path]
+		value, hasValue := after[path]
+
+		if hadOld && hasValue && old == value {
+			continue
+		}
+
+		old, value = maskSetting(path, old), maskSetting(path, value)
+
+		fields := log.Fields{"setting": path, "old": old, "new": value}
+		if !hadOld {
+			fields["old"] = nil
+		}
+
+		if !hasValue {
+			fields["new"] = nil
+		}
+
+		if requiresRestart(path) {
+			logger.WithFields(fields).Warn("Config changed, restart to apply")
+		} else {
+			logger.WithFields(fields).Info("Config changed")
+		}
+	}
+}
+
+func requiresRestart(path string) bool {
+	for _, section := range restartOnlySections {
+		if path == section || strings.HasPrefix(path, section+".") || strings.HasPrefix(path, section+"[") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// flattenConfig lists every setting as "section.key" = value. Client keys are masked, other
+// secrets are kept as they are so that changes to them are noticed; they are masked when logged.
+func flattenConfig(cfg *Config) map[string]string {
+	settings := map[string]string{}
+
+	flattenSetting(settings, "", reflect.ValueOf(cfg).Elem())
+
+	return settings
+}
+
+func flattenSetting(settings map[string]string, path string, v reflect.Value) {
+	switch v.Kind() { //nolint:exhaustive
+	case reflect.Pointer:
+		// Optional settings are listed when set, even to their zero value.
+		if !v.IsNil() && v.Elem().Kind() != reflect.Struct && v.Elem().IsZero() {
+			settings[path] = fmt.Sprint(v.Elem().Interface())
+		} else if !v.IsNil() {
+			flattenSetting(settings, path, v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			flattenSetting(settings, joinSettingPath(path, name), v.Field(i))
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			flattenSetting(settings, fmt.Sprintf("%s[%d]", path, i), v.Index(i))
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			name := fmt.Sprint(iter.Key().Interface())
+			if iter.Key().Kind() == reflect.String {
+				name = iter.Key().String()
+			}
+
+			if path == "keys" {
+				name = redactKey(name)
+			}
+
+			flattenSetting(settings, joinSettingPath(path, name), iter.Value())
+		}
+	case reflect.String:
+		if v.Len() > 0 {
+			settings[path] = v.String()
+		}
+	default:
+		if !v.IsZero() {
+			settings[path] = fmt.Sprint(v.Interface())
+		}
+	}
+}
+
+func joinSettingPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+
+	return path + "." + name
+}
+
+func isSecretSetting(path string) bool {
+	name := path[strings.LastIndex(path, ".")+1:]
+
+	return name == "apiKey" || name == "token" || strings.HasPrefix(path, "tracing.headers.")
+}
+
+// maskSetting hides the secrets in the value of a setting before it is shown: keys and tokens,
+// and the credentials in URLs, e.g. of an upstream's proxy.
+func maskSetting(path string, value string) string {
+	if isSecretSetting(path) {
+		return redactKey(value)
+	}
+
+	return maskURLCredentials(value)
+}
+
+// maskURLCredentials replaces the user and password of a URL with asterisks.
+func maskURLCredentials(value string) string {
+	if !strings.Contains(value, "@") {
+		return value
+	}
+
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.User == nil || parsed.Host == "" {
+		return value
+	}
+
+	parsed.User = nil
+
+	return strings.Replace(parsed.String(), "://", "://****@", 1)
+}
@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// Routing states of an upstream, changed at runtime with the admin API.
+const (
+	UpstreamEnabled  = "enabled"
+	UpstreamDraining = "draining" // No new requests, in-flight ones finish
+	UpstreamDrained  = "drained"  // Draining and nothing in flight anymore
+	UpstreamDisabled = "disabled" // No new requests, in-flight ones were cancelled
+)
+
+var (
+	ErrNoUpstreamAvailable = errors.New("no upstream available")
+	ErrInvalidWeight       = errors.New("weight must be at least 1")
+)
+
+// upstreamOverride holds the runtime changes to an upstream. They outlive configuration reloads,
+// so that an upstream taken out during an incident stays out, and are lost on restart.
+type upstreamOverride struct {
+	state    string
+	priority *int
+	weight   *int
+}
+
+var (
+	upstreamOverridesMu sync.Mutex
+	upstreamOverrides   = map[string]*upstreamOverride{}
+)
+
+// UpstreamStatus describes an upstream for the admin API.
+type UpstreamStatus struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	URL        string `json:"url,omitempty"` // With its credentials masked
+	Model      string `json:"model"`
+	Priority   int    `json:"priority"`
+	Weight     int    `json:"weight"`
+	State      string `json:"state"`
+	Overridden bool   `json:"overridden"` // Priority, weight or state were changed at runtime
+	Circuit    string `json:"circuit"`
+	Failures   int    `json:"failures"`
+	LastError  string `json:"lastError,omitempty"`
+	Inflight   int    `json:"inflight"`
+}
+
+// upstreamRouting returns the priority and weight an upstream is routed with, runtime changes
+// included. Weights default to 1.
+func upstreamRouting(name string, upstream Upstream) (int, int) {
+	priority, weight := upstream.Priority, upstream.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+
+	upstreamOverridesMu.Lock()
+	defer upstreamOverridesMu.Unlock()
+
+	if override, ok := upstreamOverrides[name]; ok {
+		if override.priority != nil {
+			priority = *override.priority
+		}
+
+		if override.weight != nil {
+			weight = *override.weight
+		}
+	}
+
+	return priority, weight
+}
+
+// upstreamInRotation reports whether new requests may go to an upstream.
+func upstreamInRotation(name string) bool {
+	upstreamOverridesMu.Lock()
+	defer upstreamOverridesMu.Unlock()
+
+	override, ok := upstreamOverrides[name]
+
+	return !ok || override.state == "" || override.state == UpstreamEnabled
+}
+
+func overrideOf(name string) *upstreamOverride {
+	override, ok := upstreamOverrides[name]
+	if !ok {
+		override = &upstreamOverride{}
+		upstreamOverrides[name] = override
+	}
+
+	return override
+}
+
+// setUpstreamState takes an upstream out of rotation or puts it back. Disabling it also cancels
+// the calls in flight to it.
+func setUpstreamState(name string, state string) {
+	upstreamOverridesMu.Lock()
+	overrideOf(name).state = state
+	upstreamOverridesMu.Unlock()
+
+	if state == UpstreamDisabled {
+		cancelUpstreamCalls(name)
+	}
+}
+
+// setUpstreamRouting changes the priority and/or weight of an upstream until the next restart.
+func setUpstreamRouting(name string, priority *int, weight *int) error {
+	if weight != nil && *weight < 1 {
+		return ErrInvalidWeight
+	}
+
+	upstreamOverridesMu.Lock()
+	defer upstreamOverridesMu.Unlock()
+
+	override := overrideOf(name)
+
+	if priority != nil {
+		override.priority = priority
+	}
+
+	if weight != nil {
+		override.weight = weight
+	}
+
+	return nil
+}
+
+// resetUpstream drops the runtime changes to an upstream, back to its configuration.
+func resetUpstream(name string) {
+	upstreamOverridesMu.Lock()
+	defer upstreamOverridesMu.Unlock()
+
+	delete(upstreamOverrides, name)
+}
+
+// pickUpstream returns the upstream with the lowest priority number. Upstreams of the same
+// priority share the traffic in proportion to their weights.
+func pickUpstream(cfg *Config, names []string) string {
+	sort.Strings(names)
+
+	lowestPriority := math.MaxInt
+	totalWeight := 0
+
+	var tied []string
+	var weights []int
+
+	for _, name := range names {
+		priority, weight := upstreamRouting(name, cfg.Upstreams[name])
+
+		if priority < lowestPriority {
+			lowestPriority, totalWeight = priority, 0
+			tied, weights = nil, nil
+		}
+
+		if priority == lowestPriority {
+			tied = append(tied, name)
+			weights = append(weights, weight)
+			totalWeight += weight
+		}
+	}
+
+	switch len(tied) {
+	case 0:
+		return ""
+	case 1:
+		return tied[0]
+	}
+
+	pick := rand.Intn(totalWeight) //nolint:gosec
+	for i, weight := range weights {
+		if pick < weight {
+			return tied[i]
+		}
+
+		pick -= weight
+	}
+
+	return tied[len(tied)-1]
+}
+
+// UpstreamStatuses lists the upstreams of cfg with their routing, circuit breaker state and the
+// number of calls in flight to them.
+func UpstreamStatuses(cfg *Config) []UpstreamStatus {
+	inflight := inflightCallsByUpstream()
+
+	statuses := make([]UpstreamStatus, 0, len(cfg.Upstreams))
+
+	for name, upstream := range cfg.Upstreams {
+		priority, weight := upstreamRouting(name, upstream)
+
+		status := UpstreamStatus{
+			Name:     name,
+			Type:     upstream.Type,
+			URL:      maskURLCredentials(upstream.URL),
+			Model:    upstream.Model,
+			Priority: priority,
+			Weight:   weight,
+			State:    UpstreamEnabled,
+			Circuit:  "closed",
+			Inflight: inflight[name],
+		}
+
+		upstreamOverridesMu.Lock()
+		if override, ok := upstreamOverrides[name]; ok {
+			status.Overridden = true
+
+			if override.state != "" {
+				status.State = override.state
+			}
+		}
+		upstreamOverridesMu.Unlock()
+
+		if status.State == UpstreamDraining && status.Inflight == 0 {
+			status.State = UpstreamDrained
+		}
+
+		upstreamHealthMu.Lock()
+		if health, ok := upstreamHealths[name]; ok {
+			status.Circuit = circuitNames[health.state]
+			status.Failures = health.failures
+			status.LastError = health.lastError
+		}
+		upstreamHealthMu.Unlock()
+
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	return statuses
+}
@@ -0,0 +1,323 @@
+package internal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// SecretsKeyEnv holds the base64 key of the encrypted secrets file, SecretsKeyFileEnv the path
+	// of a file containing it.
+	SecretsKeyEnv     = "PROXY_SECRETS_KEY"
+	SecretsKeyFileEnv = "PROXY_SECRETS_KEY_FILE"
+
+	secretsKeyBytes = 32
+)
+
+var (
+	ErrUnsetVariable     = errors.New("environment variable is not set")
+	ErrNoSecretsKey      = errors.New("no secrets key, set " + SecretsKeyEnv + " or " + SecretsKeyFileEnv)
+	ErrInvalidSecretsKey = errors.New("secrets key must be 32 base64 encoded bytes")
+	ErrUnknownSecret     = errors.New("secret not found in secretsFile")
+	ErrNoSecretsFile     = errors.New("secret: references need a secretsFile")
+)
+
+// variablePattern matches ${NAME} and ${NAME:-default}.
+var variablePattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// Secret is a configuration value such as an API key. It prints and marshals masked, so that it
+// can't end up in logs; Value returns the real thing.
+type Secret string
+
+func (s Secret) Value() string {
+	return string(s)
+}
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+
+	return redactKey(string(s))
+}
+
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String()) //nolint:wrapcheck
+}
+
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+// resolveConfigValues replaces references in the secrets of cfg, and in the settings tagged
+// `references:"allow"`: "file:/path" with the contents of the file, "secret:NAME" with an entry of
+// the encrypted secretsFile, and ${VAR} or ${VAR:-default} with environment variables.
+func resolveConfigValues(cfg *Config) error {
+	var secrets map[string]string
+
+	resolve := func(value string) (string, error) {
+		switch {
+		case strings.HasPrefix(value, "file:"):
+			data, err := os.ReadFile(strings.TrimPrefix(value, "file:"))
+			if err != nil {
+				return "", fmt.Errorf("reading secret: %w", err)
+			}
+
+			return strings.TrimRight(string(data), "\r\n"), nil
+		case strings.HasPrefix(value, "secret:"):
+			if secrets == nil {
+				if cfg.SecretsFile == "" {
+					return "", ErrNoSecretsFile
+				}
+
+				var err error
+				if secrets, err = ReadSecretsFile(cfg.SecretsFile); err != nil {
+					return "", err
+				}
+			}
+
+			name := strings.TrimPrefix(value, "secret:")
+
+			secret, ok := secrets[name]
+			if !ok {
+				return "", fmt.Errorf("%w: %s", ErrUnknownSecret, name)
+			}
+
+			return secret, nil
+		}
+
+		return expandVariables(value)
+	}
+
+	return resolveValues(reflect.ValueOf(cfg).Elem(), "", false, resolve)
+}
+
+func expandVariables(value string) (string, error) {
+	var err error
+
+	expanded := variablePattern.ReplaceAllStringFunc(value, func(reference string) string {
+		match := variablePattern.FindStringSubmatch(reference)
+
+		if variable, ok := os.LookupEnv(match[1]); ok {
+			return variable
+		}
+
+		if strings.Contains(reference, ":-") {
+			return match[2]
+		}
+
+		err = fmt.Errorf("%w: %s", ErrUnsetVariable, match[1])
+
+		return reference
+	})
+
+	return expanded, err
+}
+
+var secretType = reflect.TypeOf(Secret(""))
+
+// resolveValues applies resolve to the secrets in v, and to its other strings when allowed. Map
+// keys are names rather than values and are left as they are, so are patterns and other text that
+// may contain "${".
+func resolveValues(v reflect.Value, path string, allowed bool, resolve func(string) (string, error)) error {
+	switch v.Kind() { //nolint:exhaustive
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return resolveValues(v.Elem(), path, allowed, resolve)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			allowed := field.Tag.Get("references") == "allow"
+
+			if err := resolveValues(v.Field(i), joinSettingPath(path, name), allowed, resolve); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := resolveValues(v.Index(i), fmt.Sprintf("%s[%d]", path, i), allowed, resolve); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+
+		resolved := reflect.MakeMapWithSize(v.Type(), v.Len())
+
+		iter := v.MapRange()
+		for iter.Next() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(iter.Value())
+
+			// Client keys are not shown in errors, they are secrets themselves.
+			name := "*"
+			if path != "keys" && iter.Key().Kind() == reflect.String {
+				name = iter.Key().String()
+			}
+
+			if err := resolveValues(value, joinSettingPath(path, name), allowed, resolve); err != nil {
+				return err
+			}
+
+			resolved.SetMapIndex(iter.Key(), value)
+		}
+
+		v.Set(resolved)
+	case reflect.String:
+		if !allowed && v.Type() != secretType {
+			return nil
+		}
+
+		value, err := resolve(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		v.SetString(value)
+	}
+
+	return nil
+}
+
+// LoadSecretsKey reads the key of the encrypted secrets file from the environment.
+func LoadSecretsKey() ([]byte, error) {
+	encoded := os.Getenv(SecretsKeyEnv)
+
+	if path := os.Getenv(SecretsKeyFileEnv); encoded == "" && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading secrets key: %w", err)
+		}
+
+		encoded = string(data)
+	}
+
+	if encoded == "" {
+		return nil, ErrNoSecretsKey
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != secretsKeyBytes {
+		return nil, ErrInvalidSecretsKey
+	}
+
+	return key, nil
+}
+
+// GenerateSecretsKey returns a new random key, base64 encoded.
+func GenerateSecretsKey() (string, error) {
+	key := make([]byte, secretsKeyBytes)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("generating key: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// EncryptSecrets seals a YAML map of secret names to values with AES-256-GCM.
+func EncryptSecrets(key []byte, plaintext []byte) ([]byte, error) {
+	var secrets map[string]string
+	if err := yaml.UnmarshalStrict(plaintext, &secrets); err != nil {
+		return nil, fmt.Errorf("secrets must be a map of names to values: %w", err)
+	}
+
+	aead, err := secretsCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+
+	sealed := aead.Seal(nonce, nonce, plaintext, nil)
+
+	return []byte(base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+// DecryptSecrets opens data sealed by EncryptSecrets and returns the YAML it contains.
+func DecryptSecrets(key []byte, data []byte) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding secrets file: %w", err)
+	}
+
+	aead, err := secretsCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrInvalidSecretsKey
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting secrets file, is it the right key? %w", err)
+	}
+
+	return plaintext, nil
+}
+
+// ReadSecretsFile decrypts the secrets file with the key from the environment.
+func ReadSecretsFile(path string) (map[string]string, error) {
+	key, err := LoadSecretsKey()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading secrets file: %w", err)
+	}
+
+	plaintext, err := DecryptSecrets(key, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets map[string]string
+	if err := yaml.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, fmt.Errorf("parsing secrets file: %w", err)
+	}
+
+	return secrets, nil
+}
+
+func secretsCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSecretsKey, err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("creating cipher: %w", err)
+	}
+
+	return aead, nil
+}
@@ -0,0 +1,281 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testSecretsKey(t *testing.T) []byte {
+	t.Helper()
+
+	encoded, err := GenerateSecretsKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestEncryptSecretsRoundTrip(t *testing.T) {
+	key := testSecretsKey(t)
+	plaintext := []byte("openai: sk-abcdefghijklmnopqrstuvwxyz\nazure: \"0123456789abcdef\"\n")
+
+	sealed, err := EncryptSecrets(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(sealed), "sk-abcdefghijklmnopqrstuvwxyz") {
+		t.Fatal("sealed file contains a secret")
+	}
+
+	again, err := EncryptSecrets(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(again) == string(sealed) {
+		t.Error("sealing twice gave the same output, the nonce isn't random")
+	}
+
+	opened, err := DecryptSecrets(key, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(opened) != string(plaintext) {
+		t.Errorf("DecryptSecrets() = %q, want %q", opened, plaintext)
+	}
+}
+
+func TestDecryptSecretsErrors(t *testing.T) {
+	key := testSecretsKey(t)
+
+	sealed, err := EncryptSecrets(key, []byte("openai: sk-test\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sealed)))
+	raw[len(raw)-1] ^= 1
+	tampered := base64.StdEncoding.EncodeToString(raw)
+
+	tests := []struct {
+		name    string
+		key     []byte
+		data    string
+		wantErr error
+	}{
+		{"wrong key", testSecretsKey(t), string(sealed), nil},
+		{"tampered", key, tampered, nil},
+		{"short key", key[:10], string(sealed), ErrInvalidSecretsKey},
+		{"not base64", key, "not base64!", nil},
+		{"too short", key, base64.StdEncoding.EncodeToString([]byte("abc")), ErrInvalidSecretsKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := DecryptSecrets(test.key, []byte(test.data))
+			if err == nil {
+				t.Fatal("DecryptSecrets() succeeded")
+			}
+
+			if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+				t.Errorf("DecryptSecrets() = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncryptSecretsRejectsOtherYAML(t *testing.T) {
+	for _, plaintext := range []string{"- a list\n- of values\n", "nested:\n  map: value\n"} {
+		if _, err := EncryptSecrets(testSecretsKey(t), []byte(plaintext)); err == nil {
+			t.Errorf("EncryptSecrets(%q) succeeded", plaintext)
+		}
+	}
+}
+
+func TestLoadSecretsKey(t *testing.T) {
+	key := testSecretsKey(t)
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte(encoded+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		env     string
+		file    string
+		wantErr error
+	}{
+		{name: "environment", env: encoded},
+		{name: "file", file: keyFile},
+		{name: "neither", wantErr: ErrNoSecretsKey},
+		{name: "too short", env: base64.StdEncoding.EncodeToString(key[:16]), wantErr: ErrInvalidSecretsKey},
+		{name: "not base64", env: "not base64!", wantErr: ErrInvalidSecretsKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(SecretsKeyEnv, test.env)
+			t.Setenv(SecretsKeyFileEnv, test.file)
+
+			loaded, err := LoadSecretsKey()
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("LoadSecretsKey() = %v, want %v", err, test.wantErr)
+			}
+
+			if err == nil && string(loaded) != string(key) {
+				t.Error("LoadSecretsKey() returned another key")
+			}
+		})
+	}
+}
+
+func TestResolveConfigValues(t *testing.T) {
+	dir := t.TempDir()
+	key := testSecretsKey(t)
+
+	sealed, err := EncryptSecrets(key, []byte("azure: sk-from-the-secrets-file\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secretsFile := filepath.Join(dir, "secrets.enc")
+	if err := os.WriteFile(secretsFile, sealed, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	apiKeyFile := filepath.Join(dir, "api-key")
+	if err := os.WriteFile(apiKeyFile, []byte("sk-from-a-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(SecretsKeyEnv, base64.StdEncoding.EncodeToString(key))
+	t.Setenv(SecretsKeyFileEnv, "")
+	t.Setenv("PROXY_TEST_API_KEY", "sk-from-the-environment")
+
+	tests := []struct {
+		name        string
+		value       string
+		secretsFile string
+		want        string
+		wantErr     error
+	}{
+		{name: "plain", value: "sk-plain", want: "sk-plain"},
+		{name: "file", value: "file:" + apiKeyFile, want: "sk-from-a-file"},
+		{name: "variable", value: "${PROXY_TEST_API_KEY}", want: "sk-from-the-environment"},
+		{name: "variable in text", value: "Bearer ${PROXY_TEST_API_KEY}", want: "Bearer sk-from-the-environment"},
+		{name: "unset variable with default", value: "${PROXY_TEST_UNSET:-fallback}", want: "fallback"},
+		{name: "unset variable", value: "${PROXY_TEST_UNSET}", wantErr: ErrUnsetVariable},
+		{name: "secret", value: "secret:azure", secretsFile: secretsFile, want: "sk-from-the-secrets-file"},
+		{name: "unknown secret", value: "secret:openai", secretsFile: secretsFile, wantErr: ErrUnknownSecret},
+		{name: "secret without a secrets file", value: "secret:azure", wantErr: ErrNoSecretsFile},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{
+				SecretsFile: test.secretsFile,
+				Upstreams:   map[string]Upstream{"azure": {Type: "azure", APIKey: Secret(test.value)}},
+			}
+
+			err := resolveConfigValues(cfg)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("resolveConfigValues() = %v, want %v", err, test.wantErr)
+			}
+
+			if err != nil {
+				if !strings.HasPrefix(err.Error(), "upstreams.azure.apiKey: ") {
+					t.Errorf("error %q doesn't name the setting", err)
+				}
+
+				return
+			}
+
+			if got := cfg.Upstreams["azure"].APIKey.Value(); got != test.want {
+				t.Errorf("apiKey = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSecretIsMasked(t *testing.T) {
+	secret := Secret("sk-abcdefghijklmnopqrstuvwxyz")
+
+	printed := map[string]string{
+		"String": secret.String(),
+		"%v":     fmt.Sprintf("%v", secret),
+		"%#v":    fmt.Sprintf("%#v", secret),
+		"MarshalJSON": func() string {
+			data, _ := json.Marshal(secret)
+			return string(data)
+		}(),
+	}
+
+	for how, text := range printed {
+		if strings.Contains(text, "abcdefghijklmnopqrstuvwxyz") {
+			t.Errorf("%s shows the secret: %s", how, text)
+		}
+	}
+
+	if secret.Value() != "sk-abcdefghijklmnopqrstuvwxyz" {
+		t.Errorf("Value() = %q", secret.Value())
+	}
+}
+
+func TestResolveConfigValuesLeavesOtherSettings(t *testing.T) {
+	t.Setenv("PROXY_TEST_HOST", "azure.example.com")
+	t.Setenv("PROXY_TEST_API_KEY", "sk-from-the-environment")
+
+	cfg := &Config{
+		Upstreams: map[string]Upstream{"${PROXY_TEST_HOST}": {
+			Type:   "azure",
+			URL:    "https://${PROXY_TEST_HOST}",
+			Model:  "${PROXY_TEST_HOST}",
+			APIKey: "${PROXY_TEST_API_KEY}",
+		}},
+		Keys: map[Secret]VirtualKey{"${PROXY_TEST_API_KEY}": {Name: "team"}},
+		Redaction: RedactionConfig{Patterns: []RedactionPattern{
+			{Name: "unset", Pattern: `\$\{[A-Z]+\}`, Replacement: "${UNSET}"},
+		}},
+	}
+
+	if err := resolveConfigValues(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	upstream, ok := cfg.Upstreams["${PROXY_TEST_HOST}"]
+	if !ok {
+		t.Fatalf("upstream renamed: %v", cfg.Upstreams)
+	}
+
+	if upstream.URL != "https://azure.example.com" || upstream.APIKey.Value() != "sk-from-the-environment" {
+		t.Errorf("url = %q, apiKey = %q, want both resolved", upstream.URL, upstream.APIKey.Value())
+	}
+
+	if upstream.Model != "${PROXY_TEST_HOST}" {
+		t.Errorf("model = %q, want it as written", upstream.Model)
+	}
+
+	if _, ok := cfg.Keys["${PROXY_TEST_API_KEY}"]; !ok {
+		t.Error("a client key was resolved")
+	}
+
+	if pattern := cfg.Redaction.Patterns[0]; pattern.Pattern != `\$\{[A-Z]+\}` || pattern.Replacement != "${UNSET}" {
+		t.Errorf("redaction pattern = %+v, want it as written", pattern)
+	}
+}
@@ -0,0 +1,277 @@
+package internal
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultEmbeddingModel      = "text-embedding-ada-002"
+	defaultSimilarityThreshold = 0.95
+	defaultSemanticMaxEntries  = 1000
+	defaultEmbeddingTimeout    = 5 * time.Second
+)
+
+var ErrNoEmbeddingUpstream = errors.New("semantic cache has no embeddings upstream")
+
+type semanticEntry struct {
+	scope    string
+	vector   []float32
+	response *CachedResponse
+}
+
+// SemanticIndex finds cached answers to questions that are worded differently but mean the same.
+// Entries are partitioned by scope, so answers are only ever shared between requests in the same
+// conversation. maxEntries bounds the entries of all scopes together, the least recently used are
+// evicted first, and scopes are dropped with their last entry.
+type SemanticIndex struct {
+	mu         sync.Mutex
+	threshold  float64
+	ttl        time.Duration
+	maxEntries int
+	order      *list.List
+	scopes     map[string]map[*list.Element]struct{}
+}
+
+var semanticIndex *SemanticIndex
+
+func NewSemanticIndex(threshold float64, ttl time.Duration, maxEntries int) *SemanticIndex {
+	if threshold <= 0 {
+		threshold = defaultSimilarityThreshold
+	}
+
+	if maxEntries <= 0 {
+		maxEntries = defaultSemanticMaxEntries
+	}
+
+	return &SemanticIndex{
+		threshold:  threshold,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		order:      list.New(),
+		scopes:     map[string]map[*list.Element]struct{}{},
+	}
+}
+
+// Search returns the most similar entry in scope when it clears the threshold.
+func (i *SemanticIndex) Search(scope string, vector []float32) (*CachedResponse, float64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var best *list.Element
+
+	bestSimilarity := -1.0
+
+	for element := range i.scopes[scope] {
+		entry, _ := element.Value.(*semanticEntry)
+		if entry.response.expired(i.ttl) {
+			i.remove(element)
+			continue
+		}
+
+		if similarity := cosineSimilarity(vector, entry.vector); similarity > bestSimilarity {
+			best, bestSimilarity = element, similarity
+		}
+	}
+
+	if best == nil || bestSimilarity < i.threshold {
+		return nil, bestSimilarity
+	}
+
+	i.order.MoveToFront(best)
+
+	entry, _ := best.Value.(*semanticEntry)
+
+	return entry.response, bestSimilarity
+}
+
+// Add indexes a response, evicting expired entries and then the least recently used ones beyond
+// maxEntries.
+func (i *SemanticIndex) Add(scope string, vector []float32, response *CachedResponse) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	element := i.order.PushFront(&semanticEntry{scope: scope, vector: vector, response: response})
+
+	if i.scopes[scope] == nil {
+		i.scopes[scope] = map[*list.Element]struct{}{}
+	}
+
+	i.scopes[scope][element] = struct{}{}
+
+	for back := i.order.Back(); back != nil && back != element; back = i.order.Back() {
+		entry, _ := back.Value.(*semanticEntry)
+		if !entry.response.expired(i.ttl) && i.order.Len() <= i.maxEntries {
+			break
+		}
+
+		i.remove(back)
+	}
+}
+
+// Len is the number of entries in all scopes.
+func (i *SemanticIndex) Len() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.order.Len()
+}
+
+func (i *SemanticIndex) remove(element *list.Element) {
+	entry, _ := element.Value.(*semanticEntry)
+	i.order.Remove(element)
+
+	delete(i.scopes[entry.scope], element)
+
+	if len(i.scopes[entry.scope]) == 0 {
+		delete(i.scopes, entry.scope)
+	}
+}
+
+func cosineSimilarity(a []float32, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// semanticScope identifies the conversation a question is asked in: the profile, the client, the
+// model and every message but the last user message, which is compared by similarity. Answers are
+// only shared between requests with the same history, and never between clients or profiles.
+func semanticScope(requestData RequestData) string {
+	hash := sha256.New()
+	hash.Write([]byte(requestData.Profile))
+	hash.Write([]byte{0})
+	hash.Write([]byte(requestData.Client))
+	hash.Write([]byte{0})
+	hash.Write([]byte(requestData.Model))
+
+	last := lastUserIndex(requestData)
+
+	for i, message := range requestData.Messages {
+		if i == last {
+			continue
+		}
+
+		hash.Write([]byte{0})
+		hash.Write([]byte(message.Role))
+		hash.Write([]byte{0})
+		hash.Write([]byte(message.Name))
+		hash.Write([]byte{0})
+		hash.Write([]byte(message.Content))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// lastUserIndex is the position of the last user message in a chat, -1 without one.
+func lastUserIndex(requestData RequestData) int {
+	for i := len(requestData.Messages) - 1; i >= 0; i-- {
+		if requestData.Messages[i].Role == openai.ChatMessageRoleUser {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// lastUserMessage is the part of a chat the semantic cache compares.
+func lastUserMessage(requestData RequestData) string {
+	if i := lastUserIndex(requestData); i >= 0 {
+		return requestData.Messages[i].Content
+	}
+
+	return ""
+}
+
+// embedLastUserMessage embeds the last user message with the configured embeddings upstream,
+// giving up after the configured timeout or when the request is cancelled.
+func embedLastUserMessage(ctx context.Context, cfg *Config, requestData RequestData) ([]float32, error) {
+	settings := cfg.Cache.Semantic
+
+	upstream, ok := cfg.Upstreams[settings.Upstream]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNoEmbeddingUpstream, settings.Upstream)
+	}
+
+	model := settings.Model
+	if model == "" {
+		model = defaultEmbeddingModel
+	}
+
+	timeout := settings.Timeout
+	if timeout <= 0 {
+		timeout = defaultEmbeddingTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return CreateEmbedding(ctx, cfg, settings.Upstream, upstream, model, lastUserMessage(requestData))
+}
+
+// semanticLookup embeds the request and searches the index. The embedding is returned so that
+// a miss can be indexed once the upstream has answered.
+func semanticLookup(ctx context.Context, cfg *Config, logger *log.Entry, requestData RequestData) (*CachedResponse, []float32) {
+	if semanticIndex == nil || requestData.RequestType != "chat" || lastUserMessage(requestData) == "" {
+		return nil, nil
+	}
+
+	vector, err := embedLastUserMessage(ctx, cfg, requestData)
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err}).Error("Semantic cache embedding failed")
+		return nil, nil
+	}
+
+	cached, similarity := semanticIndex.Search(semanticScope(requestData), vector)
+	if cached != nil {
+		logger.WithFields(log.Fields{
+			"cache":      "semantic-hit",
+			"similarity": similarity,
+			"client":     requestData.Client,
+		}).Info("Serving semantically cached response")
+	}
+
+	return cached, vector
+}
+
+// semanticStore indexes a completed answer, embedding the request if the lookup didn't.
+func semanticStore(ctx context.Context, cfg *Config, logger *log.Entry, requestData RequestData, vector []float32, response *CachedResponse) {
+	if semanticIndex == nil || requestData.RequestType != "chat" || lastUserMessage(requestData) == "" {
+		return
+	}
+
+	if vector == nil {
+		var err error
+
+		vector, err = embedLastUserMessage(ctx, cfg, requestData)
+		if err != nil {
+			logger.WithFields(log.Fields{"error": err}).Error("Semantic cache embedding failed")
+			return
+		}
+	}
+
+	semanticIndex.Add(semanticScope(requestData), vector, response)
+}
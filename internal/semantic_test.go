@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	log "github.com/sirupsen/logrus"
+)
+
+func chatRequest(client string, messages ...string) RequestData {
+	requestData := RequestData{Client: client, Model: "gpt-3.5-turbo", RequestType: "chat"}
+
+	roles := []string{openai.ChatMessageRoleUser, openai.ChatMessageRoleAssistant}
+	for i, content := range messages {
+		requestData.Messages = append(requestData.Messages, openai.ChatCompletionMessage{Role: roles[i%2], Content: content})
+	}
+
+	return requestData
+}
+
+func TestSemanticScope(t *testing.T) {
+	base := chatRequest("team", "What is Go?", "A programming language.", "Who made it?")
+
+	tests := []struct {
+		name      string
+		request   RequestData
+		wantShare bool
+	}{
+		{name: "reworded last question", request: chatRequest("team", "What is Go?", "A programming language.", "Who created it?"), wantShare: true},
+		{name: "other client", request: chatRequest("ci", "What is Go?", "A programming language.", "Who made it?")},
+		{name: "other history", request: chatRequest("team", "What is Rust?", "A programming language.", "Who made it?")},
+		{name: "other profile", request: func() RequestData {
+			requestData := chatRequest("team", "What is Go?", "A programming language.", "Who made it?")
+			requestData.Profile = "public"
+			return requestData
+		}()},
+		{name: "other model", request: func() RequestData {
+			requestData := chatRequest("team", "What is Go?", "A programming language.", "Who made it?")
+			requestData.Model = "gpt-4"
+			return requestData
+		}()},
+	}
+
+	for _, test := range tests {
+		if shared := semanticScope(test.request) == semanticScope(base); shared != test.wantShare {
+			t.Errorf("%s: shares the scope = %v, want %v", test.name, shared, test.wantShare)
+		}
+	}
+
+	if got := lastUserMessage(base); got != "Who made it?" {
+		t.Errorf("lastUserMessage() = %q, want the last question", got)
+	}
+}
+
+func TestSemanticIndexSearch(t *testing.T) {
+	index := NewSemanticIndex(0.9, time.Minute, 2)
+
+	index.Add("team", []float32{1, 0}, &CachedResponse{Content: "stale", Created: time.Now().Add(-time.Hour)})
+	index.Add("team", []float32{0, 1}, &CachedResponse{Content: "up", Created: time.Now()})
+	index.Add("team", []float32{1, 0.1}, &CachedResponse{Content: "right", Created: time.Now()})
+
+	tests := []struct {
+		name   string
+		scope  string
+		vector []float32
+		want   string
+	}{
+		{name: "similar", scope: "team", vector: []float32{1, 0.05}, want: "right"},
+		{name: "below the threshold", scope: "team", vector: []float32{1, 1}},
+		{name: "other scope", scope: "ci", vector: []float32{0, 1}},
+		{name: "different dimensions", scope: "team", vector: []float32{0, 1, 0}},
+	}
+
+	for _, test := range tests {
+		cached, _ := index.Search(test.scope, test.vector)
+
+		got := ""
+		if cached != nil {
+			got = cached.Content
+		}
+
+		if got != test.want {
+			t.Errorf("%s: Search() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSemanticIndexBounds(t *testing.T) {
+	fresh := func(content string) *CachedResponse { return &CachedResponse{Content: content, Created: time.Now()} }
+
+	// The steps run in order on the same index, holding at most three entries.
+	index := NewSemanticIndex(0.9, time.Minute, 3)
+
+	steps := []struct {
+		name       string
+		change     func()
+		wantLen    int
+		wantScopes int
+	}{
+		{name: "one entry per scope", change: func() {
+			index.Add("a", []float32{1, 0}, fresh("a"))
+			index.Add("b", []float32{1, 0}, fresh("b"))
+			index.Add("c", []float32{1, 0}, fresh("c"))
+		}, wantLen: 3, wantScopes: 3},
+		{name: "a hit keeps its entry", change: func() { index.Search("a", []float32{1, 0}) }, wantLen: 3, wantScopes: 3},
+		{name: "the least recently used scope is evicted", change: func() {
+			index.Add("d", []float32{1, 0}, fresh("d"))
+		}, wantLen: 3, wantScopes: 3},
+		{name: "expired entries go with their scope", change: func() {
+			index.Add("e", []float32{1, 0}, &CachedResponse{Content: "e", Created: time.Now().Add(-time.Hour)})
+			index.Search("e", []float32{1, 0})
+		}, wantLen: 2, wantScopes: 2},
+	}
+
+	for _, step := range steps {
+		step.change()
+
+		if got := index.Len(); got != step.wantLen {
+			t.Errorf("%s: %d entries, want %d", step.name, got, step.wantLen)
+		}
+
+		if got := len(index.scopes); got != step.wantScopes {
+			t.Errorf("%s: %d scopes, want %d", step.name, got, step.wantScopes)
+		}
+	}
+
+	for scope, want := range map[string]bool{"a": true, "b": false, "c": false, "d": true} {
+		if cached, _ := index.Search(scope, []float32{1, 0}); (cached != nil) != want {
+			t.Errorf("scope %s cached = %v, want %v", scope, cached != nil, want)
+		}
+	}
+}
+
+func TestSemanticLookupTimeout(t *testing.T) {
+	previous := semanticIndex
+	semanticIndex = NewSemanticIndex(0, time.Minute, 0)
+
+	t.Cleanup(func() { semanticIndex = previous })
+
+	// The upstream doesn't answer until the test is over.
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+
+	defer server.Close()
+	defer close(done)
+
+	cfg := &Config{Upstreams: map[string]Upstream{"embeddings": {Type: "azure", URL: server.URL, APIKey: "sk-test"}}}
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		cancel  bool
+	}{
+		{name: "timeout", timeout: 50 * time.Millisecond},
+		{name: "request cancelled", timeout: time.Minute, cancel: true},
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg.Cache.Semantic = SemanticCacheConfig{Enabled: true, Upstream: "embeddings", Timeout: test.timeout}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if test.cancel {
+				time.AfterFunc(50*time.Millisecond, cancel)
+			}
+
+			started := time.Now()
+
+			cached, vector := semanticLookup(ctx, cfg, log.NewEntry(logger), chatRequest("team", "What is Go?"))
+			if cached != nil || vector != nil {
+				t.Error("a lookup without an embedding returned a result")
+			}
+
+			if elapsed := time.Since(started); elapsed > time.Second {
+				t.Errorf("the lookup took %v", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Timeouts of listeners that don't set their own.
+const (
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultReadTimeout       = 30 * time.Second
+	DefaultIdleTimeout       = 2 * time.Minute
+	DefaultWriteTimeout      = time.Minute
+)
+
+// NewListenerServer creates the server of a listener, with a TLS configuration if the listener
+// uses TLS. There is no deadline for the whole response, which would cut off long streams; instead
+// every write has to happen within writeTimeout of the previous one. TLS listeners speak HTTP/2
+// as well as HTTP/1.1, plain ones only with h2c enabled.
+func NewListenerServer(cfg *Config, listener Listener, handler http.Handler, logger *log.Logger) (*http.Server, error) {
+	tlsConfig, err := newListenerTLSConfig(cfg, listener, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Requests carry their listener, e.g. to map client certificates with its TLS settings.
+	listenerHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerContextKey{}, &listener)))
+	})
+
+	var settings ListenerHTTP2
+	if listener.HTTP2 != nil {
+		settings = *listener.HTTP2
+	}
+
+	h2 := &http2.Server{
+		MaxConcurrentStreams:         settings.MaxConcurrentStreams,
+		MaxUploadBufferPerConnection: settings.ConnectionWindowSize,
+		MaxUploadBufferPerStream:     settings.StreamWindowSize,
+	}
+
+	var serverHandler http.Handler = writeDeadlineHandler(orDefault(listener.WriteTimeout, DefaultWriteTimeout), listenerHandler)
+	if settings.H2C && tlsConfig == nil {
+		serverHandler = h2c.NewHandler(serverHandler, h2)
+	}
+
+	server := &http.Server{
+		Addr:              listener.Address(),
+		Handler:           serverHandler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: orDefault(listener.ReadHeaderTimeout, DefaultReadHeaderTimeout),
+		ReadTimeout:       orDefault(listener.ReadTimeout, DefaultReadTimeout),
+		IdleTimeout:       orDefault(listener.IdleTimeout, DefaultIdleTimeout),
+	}
+
+	// Besides tuning HTTP/2 over TLS, this lets Shutdown send GOAWAY to h2c connections, which the
+	// server no longer tracks once they are taken over.
+	if err := http2.ConfigureServer(server, h2); err != nil {
+		return nil, fmt.Errorf("configuring HTTP/2: %w", err)
+	}
+
+	// ConfigureServer sets up a TLS configuration, which would make a plain listener serve TLS.
+	server.TLSConfig = tlsConfig
+
+	return server, nil
+}
+
+func orDefault(timeout time.Duration, fallback time.Duration) time.Duration {
+	if timeout == 0 {
+		return fallback
+	}
+
+	return timeout
+}
+
+func writeDeadlineHandler(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadlineWriter := &writeDeadlineResponseWriter{
+			ResponseWriter: w,
+			controller:     http.NewResponseController(w), //nolint:bodyclose
+			timeout:        timeout,
+		}
+
+		// The deadline stays on the connection, it must not apply to the next request on it.
+		defer func() { _ = deadlineWriter.controller.SetWriteDeadline(time.Time{}) }()
+
+		next.ServeHTTP(deadlineWriter, r)
+	})
+}
+
+// writeDeadlineResponseWriter moves the write deadline forward with every chunk written, so a
+// stream times out when the next chunk isn't written within the timeout of the previous one, e.g.
+// because the client stopped reading or the upstream stalled, rather than after a fixed time.
+type writeDeadlineResponseWriter struct {
+	http.ResponseWriter
+	controller *http.ResponseController
+	timeout    time.Duration
+	started    bool
+}
+
+// start gives the first write of a response the whole timeout.
+func (w *writeDeadlineResponseWriter) start() {
+	if !w.started {
+		w.started = true
+		w.extendDeadline()
+	}
+}
+
+func (w *writeDeadlineResponseWriter) extendDeadline() {
+	_ = w.controller.SetWriteDeadline(time.Now().Add(w.timeout))
+}
+
+func (w *writeDeadlineResponseWriter) WriteHeader(status int) {
+	w.start()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *writeDeadlineResponseWriter) Write(data []byte) (int, error) {
+	w.start()
+
+	return w.ResponseWriter.Write(data) //nolint:wrapcheck
+}
+
+// Flush sends a chunk, which has to happen by the current deadline, and moves the deadline for
+// the next one. Writes in between are buffered and don't reach the connection.
+func (w *writeDeadlineResponseWriter) Flush() {
+	w.start()
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	w.extendDeadline()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *writeDeadlineResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
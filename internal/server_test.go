@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+func TestNewListenerServerTimeouts(t *testing.T) {
+	tests := []struct {
+		name     string
+		listener Listener
+		want     [3]time.Duration // ReadHeaderTimeout, ReadTimeout, IdleTimeout
+	}{
+		{
+			name:     "defaults",
+			listener: Listener{Port: "8080"},
+			want:     [3]time.Duration{DefaultReadHeaderTimeout, DefaultReadTimeout, DefaultIdleTimeout},
+		},
+		{
+			name:     "configured",
+			listener: Listener{Port: "8080", ReadHeaderTimeout: time.Second, ReadTimeout: 2 * time.Second, IdleTimeout: 3 * time.Second},
+			want:     [3]time.Duration{time.Second, 2 * time.Second, 3 * time.Second},
+		},
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, err := NewListenerServer(&Config{}, test.listener, http.NotFoundHandler(), logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := [3]time.Duration{server.ReadHeaderTimeout, server.ReadTimeout, server.IdleTimeout}; got != test.want {
+				t.Errorf("timeouts = %v, want %v", got, test.want)
+			}
+
+			if server.WriteTimeout != 0 {
+				t.Errorf("WriteTimeout = %v, streams would be cut off after it", server.WriteTimeout)
+			}
+		})
+	}
+}
+
+func TestWriteDeadlineHandler(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+
+	tests := []struct {
+		name   string
+		delays []time.Duration // Before each chunk
+		want   int
+	}{
+		{
+			name:   "stream longer than the timeout",
+			delays: []time.Duration{0, 50 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond},
+			want:   6,
+		},
+		{
+			name:   "stalled stream",
+			delays: []time.Duration{0, 3 * timeout, 0},
+			want:   1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(writeDeadlineHandler(timeout, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for i, delay := range test.delays {
+					time.Sleep(delay)
+					fmt.Fprintf(w, "data: %d\n\n", i)
+					w.(http.Flusher).Flush()
+				}
+			})))
+			defer server.Close()
+
+			resp, err := http.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			chunks := 0
+
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				if strings.HasPrefix(scanner.Text(), "data: ") {
+					chunks++
+				}
+			}
+
+			if chunks != test.want {
+				t.Errorf("received %d chunks, want %d", chunks, test.want)
+			}
+		})
+	}
+}
+
+func TestListenerH2C(t *testing.T) {
+	// h2cClient speaks HTTP/2 over a plain connection without upgrading, like gRPC clients do.
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+
+	tests := []struct {
+		name      string
+		http2     *ListenerHTTP2
+		client    *http.Client
+		wantProto string // Empty when the request must fail
+	}{
+		{name: "h2c", http2: &ListenerHTTP2{H2C: true, MaxConcurrentStreams: 10}, client: h2cClient, wantProto: "HTTP/2.0"},
+		{name: "HTTP/1.1 on an h2c listener", http2: &ListenerHTTP2{H2C: true}, client: http.DefaultClient, wantProto: "HTTP/1.1"},
+		{name: "h2c not enabled", client: h2cClient},
+		{name: "HTTP/1.1 without h2c", client: http.DefaultClient, wantProto: "HTTP/1.1"},
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, r.Proto) })
+
+			server, err := NewListenerServer(&Config{}, Listener{Port: "0", HTTP2: test.http2}, handler, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			go server.Serve(listener) //nolint:errcheck
+			defer server.Close()
+
+			resp, err := test.client.Get("http://" + listener.Addr().String())
+			if test.wantProto == "" {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("request succeeded")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if proto, _ := io.ReadAll(resp.Body); string(proto) != test.wantProto {
+				t.Errorf("served over %s, want %s", proto, test.wantProto)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certificateCheckInterval is how often the certificate files are checked for changes.
+const certificateCheckInterval = 10 * time.Second
+
+var (
+	ErrUnknownTLSVersion  = errors.New("unknown TLS version")
+	ErrUnknownCipherSuite = errors.New("unknown cipher suite")
+	ErrUnknownClientAuth  = errors.New("unknown client auth mode")
+	ErrInvalidClientCA    = errors.New("no certificates found in client CA file")
+)
+
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+type listenerContextKey struct{}
+
+// listenerTLS returns the TLS settings of a listener. Listeners without their own use the global
+// certFile and keyFile when useTLS is set.
+func listenerTLS(cfg *Config, listener Listener) *ListenerTLS {
+	if listener.TLS != nil {
+		return listener.TLS
+	}
+
+	if cfg.UseTLS {
+		return &ListenerTLS{CertFile: cfg.CertFile, KeyFile: cfg.KeyFile}
+	}
+
+	return nil
+}
+
+// listenerFrom returns the listener a request arrived on.
+func listenerFrom(ctx context.Context) *Listener {
+	listener, _ := ctx.Value(listenerContextKey{}).(*Listener)
+	return listener
+}
+
+// clientCertIdentity maps the verified client certificate of a request to a client name, using
+// the clientIdentities of the listener's TLS settings. The certificate's common name and all of
+// its DNS, email and URI names are tried.
+func clientCertIdentity(r *http.Request) (string, bool) {
+	listener := listenerFrom(r.Context())
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || listener == nil || listener.TLS == nil {
+		return "", false
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+
+	identities := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+
+	for _, identity := range identities {
+		if client, ok := listener.TLS.ClientIdentities[identity]; ok && identity != "" {
+			return client, true
+		}
+	}
+
+	return "", false
+}
+
+// certificateReloader serves the certificate, key and client CA of a listener and loads them again
+// when the files change, so rotated certificates are picked up without a restart.
+type certificateReloader struct {
+	settings ListenerTLS
+	logger   *log.Logger
+
+	mu       sync.Mutex
+	checked  time.Time
+	modTimes map[string]time.Time
+	current  *tls.Config
+}
+
+// newListenerTLSConfig returns the TLS configuration of a listener, or nil if it serves plain HTTP.
+func newListenerTLSConfig(cfg *Config, listener Listener, logger *log.Logger) (*tls.Config, error) {
+	settings := listenerTLS(cfg, listener)
+	if settings == nil {
+		return nil, nil
+	}
+
+	reloader := &certificateReloader{settings: *settings, logger: logger, modTimes: map[string]time.Time{}}
+	reloader.filesChanged()
+
+	current, err := reloader.load()
+	if err != nil {
+		return nil, err
+	}
+
+	reloader.current = current
+	reloader.checked = time.Now()
+
+	return &tls.Config{ //nolint:gosec
+		MinVersion:         current.MinVersion,
+		GetCertificate:     reloader.getCertificate,
+		GetConfigForClient: reloader.configForClient,
+	}, nil
+}
+
+func (c *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return &c.config().Certificates[0], nil
+}
+
+func (c *certificateReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return c.config(), nil
+}
+
+// config returns the current configuration, reloading it if the files changed. A broken
+// certificate is logged and the previous one kept.
+func (c *certificateReloader) config() *tls.Config {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) < certificateCheckInterval {
+		return c.current
+	}
+
+	c.checked = time.Now()
+
+	if !c.filesChanged() {
+		return c.current
+	}
+
+	next, err := c.load()
+	if err != nil {
+		c.logger.WithFields(log.Fields{"certFile": c.settings.CertFile, "error": err}).Error("Failed to reload certificates, keeping the current ones")
+		return c.current
+	}
+
+	c.logger.WithFields(log.Fields{"certFile": c.settings.CertFile}).Info("Reloaded certificates")
+	c.current = next
+
+	return c.current
+}
+
+// filesChanged records the modification times of the files and reports whether any changed.
+func (c *certificateReloader) filesChanged() bool {
+	changed := false
+
+	for _, path := range []string{c.settings.CertFile, c.settings.KeyFile, c.settings.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		if !info.ModTime().Equal(c.modTimes[path]) {
+			c.modTimes[path] = info.ModTime()
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+func (c *certificateReloader) load() (*tls.Config, error) {
+	return buildTLSConfig(&c.settings)
+}
+
+// buildTLSConfig loads the files of settings into a TLS configuration.
+func buildTLSConfig(settings *ListenerTLS) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[settings.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTLSVersion, settings.MinVersion)
+	}
+
+	cipherSuites, err := cipherSuiteIDs(settings.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+		Certificates: []tls.Certificate{certificate},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if settings.ClientCAFile == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(settings.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA: %w", err)
+	}
+
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidClientCA, settings.ClientCAFile)
+	}
+
+	switch settings.ClientAuth {
+	case "", "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownClientAuth, settings.ClientAuth)
+	}
+
+	return config, nil
+}
+
+// cipherSuiteIDs looks up cipher suites by their crypto/tls names. Go's defaults are used when
+// none are given.
+func cipherSuiteIDs(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownCipherSuite, name)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
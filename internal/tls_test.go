@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// writeTestCertificate writes a self-signed certificate and its key to dir and returns their paths.
+func writeTestCertificate(t *testing.T, dir string, commonName string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "proxy.example.com")
+
+	notPEM := filepath.Join(dir, "ca.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		settings       ListenerTLS
+		wantErr        error
+		wantMinVersion uint16
+		wantClientAuth tls.ClientAuthType
+	}{
+		{name: "defaults", settings: ListenerTLS{}, wantMinVersion: tls.VersionTLS12, wantClientAuth: tls.NoClientCert},
+		{name: "TLS 1.3", settings: ListenerTLS{MinVersion: "1.3"}, wantMinVersion: tls.VersionTLS13},
+		{name: "unknown version", settings: ListenerTLS{MinVersion: "1.1"}, wantErr: ErrUnknownTLSVersion},
+		{name: "unknown cipher suite", settings: ListenerTLS{CipherSuites: []string{"TLS_RSA_WITH_NOTHING"}}, wantErr: ErrUnknownCipherSuite},
+		{name: "client CA requires certificates", settings: ListenerTLS{ClientCAFile: certFile}, wantMinVersion: tls.VersionTLS12, wantClientAuth: tls.RequireAndVerifyClientCert},
+		{name: "optional client certificates", settings: ListenerTLS{ClientCAFile: certFile, ClientAuth: "optional"}, wantMinVersion: tls.VersionTLS12, wantClientAuth: tls.VerifyClientCertIfGiven},
+		{name: "unknown client auth", settings: ListenerTLS{ClientCAFile: certFile, ClientAuth: "sometimes"}, wantErr: ErrUnknownClientAuth},
+		{name: "client CA without certificates", settings: ListenerTLS{ClientCAFile: notPEM}, wantErr: ErrInvalidClientCA},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := test.settings
+			settings.CertFile, settings.KeyFile = certFile, keyFile
+
+			config, err := buildTLSConfig(&settings)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("buildTLSConfig() error = %v, want %v", err, test.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if config.MinVersion != test.wantMinVersion {
+				t.Errorf("MinVersion = %x, want %x", config.MinVersion, test.wantMinVersion)
+			}
+
+			if config.ClientAuth != test.wantClientAuth {
+				t.Errorf("ClientAuth = %v, want %v", config.ClientAuth, test.wantClientAuth)
+			}
+		})
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, dir string)
+		due    bool // Whether the check interval has passed
+		want   string
+	}{
+		{
+			name:   "rotated certificate",
+			change: func(t *testing.T, dir string) { writeTestCertificate(t, dir, "rotated") },
+			due:    true,
+			want:   "rotated",
+		},
+		{
+			name:   "rotated within the check interval",
+			change: func(t *testing.T, dir string) { writeTestCertificate(t, dir, "rotated") },
+			want:   "original",
+		},
+		{
+			name: "broken certificate keeps the current one",
+			change: func(t *testing.T, dir string) {
+				if err := os.WriteFile(filepath.Join(dir, "cert.pem"), []byte("truncated"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			due:  true,
+			want: "original",
+		},
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certFile, keyFile := writeTestCertificate(t, dir, "original")
+
+			reloader := &certificateReloader{
+				settings: ListenerTLS{CertFile: certFile, KeyFile: keyFile},
+				logger:   logger,
+				modTimes: map[string]time.Time{},
+			}
+			reloader.filesChanged()
+
+			current, err := reloader.load()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reloader.current, reloader.checked = current, time.Now()
+
+			test.change(t, dir)
+
+			// Make the change visible on file systems with coarse modification times.
+			later := time.Now().Add(time.Minute)
+			for _, path := range []string{certFile, keyFile} {
+				if err := os.Chtimes(path, later, later); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if test.due {
+				reloader.checked = time.Now().Add(-certificateCheckInterval)
+			}
+
+			certificate, err := reloader.getCertificate(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if leaf.Subject.CommonName != test.want {
+				t.Errorf("serving %s, want %s", leaf.Subject.CommonName, test.want)
+			}
+		})
+	}
+}
+
+func TestClientCertIdentity(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "build-agent"},
+		DNSNames:       []string{"ci.example.com"},
+		EmailAddresses: []string{"ops@example.com"},
+	}
+
+	tests := []struct {
+		name       string
+		identities map[string]string
+		verified   bool
+		want       string
+	}{
+		{name: "common name", identities: map[string]string{"build-agent": "ci"}, verified: true, want: "ci"},
+		{name: "DNS name", identities: map[string]string{"ci.example.com": "ci"}, verified: true, want: "ci"},
+		{name: "email address", identities: map[string]string{"ops@example.com": "ops"}, verified: true, want: "ops"},
+		{name: "unknown certificate", identities: map[string]string{"someone-else": "ci"}, verified: true},
+		{name: "unverified certificate", identities: map[string]string{"build-agent": "ci"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listener := &Listener{TLS: &ListenerTLS{ClientIdentities: test.identities}}
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			r = r.WithContext(context.WithValue(r.Context(), listenerContextKey{}, listener))
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+			if test.verified {
+				r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+			}
+
+			client, ok := clientCertIdentity(r)
+			if client != test.want || ok != (test.want != "") {
+				t.Errorf("clientCertIdentity() = %q, %v, want %q", client, ok, test.want)
+			}
+		})
+	}
+}
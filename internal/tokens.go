@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktokenloader "github.com/pkoukk/tiktoken-go-loader"
+	openai "github.com/sashabaranov/go-openai"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultEncoding = "cl100k_base"
+
+	// OpenAI's chat accounting: every message is wrapped in a few tokens of markup and the
+	// reply is primed with three more.
+	tokensPerMessage = 3
+	tokensPerName    = 1
+	replyPriming     = 3
+
+	// fallbackContextWindow is assumed for models whose context window isn't known, unless the
+	// "default" entry of the models setting says otherwise.
+	fallbackContextWindow = 4096
+	defaultModel          = "default"
+)
+
+// Context windows of well known models, config.yaml can add to or override these. Versions of a
+// model, e.g. gpt-4-0613, share its window.
+var defaultContextWindows = map[string]int{
+	"ada":               2049,
+	"babbage":           2049,
+	"curie":             2049,
+	"davinci":           2049,
+	"text-davinci-003":  4097,
+	"gpt-3.5-turbo":     4096,
+	"gpt-3.5-turbo-16k": 16385,
+	"gpt-4":             8192,
+	"gpt-4-32k":         32768,
+	"gpt-4-turbo":       128000,
+	"gpt-4o":            128000,
+	"gpt-4o-mini":       128000,
+}
+
+var (
+	encodingsMu sync.Mutex
+	encodings   = map[string]*tiktoken.Tiktoken{}
+)
+
+func init() {
+	// Use the BPE ranks embedded in the binary rather than downloading them at runtime.
+	tiktoken.SetBpeLoader(tiktokenloader.NewOfflineLoader())
+}
+
+// encodingName picks the encoding from the config, falling back to what tiktoken knows of the model.
+func encodingName(cfg *Config, model string) string {
+	if name := cfg.Models[model].Encoding; name != "" {
+		return name
+	}
+
+	if name, ok := tiktoken.MODEL_TO_ENCODING[model]; ok {
+		return name
+	}
+
+	for prefix, name := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+		if strings.HasPrefix(model, prefix) {
+			return name
+		}
+	}
+
+	return defaultEncoding
+}
+
+// encodingFor returns the tokenizer for the model. Encodings are loaded once and shared.
+func encodingFor(cfg *Config, model string) (*tiktoken.Tiktoken, error) {
+	name := encodingName(cfg, model)
+
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+
+	if encoding, ok := encodings[name]; ok {
+		return encoding, nil
+	}
+
+	encoding, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		return nil, fmt.Errorf("load encoding %s: %w", name, err)
+	}
+
+	encodings[name] = encoding
+
+	return encoding, nil
+}
+
+// countTokens counts the tokens of text for the model, estimating when no tokenizer is available.
+func countTokens(cfg *Config, model string, text string) int {
+	encoding, err := encodingFor(cfg, model)
+	if err != nil {
+		return estimateTokens(text)
+	}
+
+	return len(encoding.EncodeOrdinary(text))
+}
+
+// countPromptTokens counts the tokens the request sends upstream, with the tokenizer of the model
+// that answers it.
+func countPromptTokens(cfg *Config, requestData RequestData) int {
+	model := resolvedModel(requestData)
+
+	if requestData.RequestType == "completion" {
+		return countTokens(cfg, model, requestData.Prompt)
+	}
+
+	total := replyPriming
+	for _, message := range requestData.Messages {
+		total += countMessageTokens(cfg, model, message)
+	}
+
+	return total
+}
+
+// promptTokens is the size of the prompt, counted once by enforceContextWindow.
+func promptTokens(cfg *Config, requestData RequestData) int {
+	if requestData.promptTokens > 0 {
+		return requestData.promptTokens
+	}
+
+	return countPromptTokens(cfg, requestData)
+}
+
+// countMessageTokens counts a single chat message including its markup.
+func countMessageTokens(cfg *Config, model string, message openai.ChatCompletionMessage) int {
+	total := tokensPerMessage + countTokens(cfg, model, message.Role) + countTokens(cfg, model, message.Content)
+	if message.Name != "" {
+		total += tokensPerName + countTokens(cfg, model, message.Name)
+	}
+
+	return total
+}
+
+// estimateTokens approximates the token count of text using the common rule of thumb of
+// four characters per token.
+func estimateTokens(text string) int {
+	const charsPerToken = 4
+
+	return (len(text) + charsPerToken - 1) / charsPerToken
+}
+
+// contextWindow returns the context size of the model: the configured one, the built-in one of the
+// model or the model it is a version of, or else the default.
+func contextWindow(cfg *Config, model string) int {
+	if window := cfg.Models[model].ContextWindow; window > 0 {
+		return window
+	}
+
+	if window, ok := defaultContextWindows[model]; ok {
+		return window
+	}
+
+	longest, window := 0, 0
+	for name, size := range defaultContextWindows {
+		if strings.HasPrefix(model, name+"-") && len(name) > longest {
+			longest, window = len(name), size
+		}
+	}
+
+	if window > 0 {
+		return window
+	}
+
+	if window := cfg.Models[defaultModel].ContextWindow; window > 0 {
+		return window
+	}
+
+	return fallbackContextWindow
+}
+
+// usageFor builds the usage block of a response from locally counted tokens.
+func usageFor(cfg *Config, requestData RequestData, completedResponse string) map[string]interface{} {
+	promptTokens := promptTokens(cfg, requestData)
+	completionTokens := countTokens(cfg, resolvedModel(requestData), completedResponse)
+
+	return map[string]interface{}{
+		"prompt_tokens":     promptTokens,
+		"completion_tokens": completionTokens,
+		"total_tokens":      promptTokens + completionTokens,
+	}
+}
+
+// enforceContextWindow makes sure the prompt fits the context window of the upstream's model before
+// it is sent. Depending on contextOverflow, chats that don't fit are rejected or have their oldest
+// messages trimmed. MaxTokens is clamped to whatever room the prompt leaves. The prompt is counted
+// here once, for everything that needs its size later on.
+func enforceContextWindow(cfg *Config, logger *log.Entry, w http.ResponseWriter, requestData *RequestData) bool {
+	model := resolvedModel(*requestData)
+	window := contextWindow(cfg, model)
+	promptTokens := countPromptTokens(cfg, *requestData)
+
+	if promptTokens >= window && cfg.ContextOverflow == "trim" && requestData.RequestType == "chat" {
+		promptTokens = trimOldestMessages(cfg, logger, requestData, window, promptTokens)
+	}
+
+	requestData.promptTokens = promptTokens
+
+	if promptTokens >= window {
+		logger.WithFields(log.Fields{
+			"model":         model,
+			"promptTokens":  promptTokens,
+			"contextWindow": window,
+		}).Warn("Prompt exceeds context window")
+		writeAPIError(w, http.StatusBadRequest,
+			fmt.Sprintf("This model's maximum context length is %d tokens. However, your messages resulted in %d tokens. "+
+				"Please reduce the length of the messages.", window, promptTokens),
+			"invalid_request_error", "context_length_exceeded")
+
+		return false
+	}
+
+	if remaining := window - promptTokens; requestData.MaxTokens > remaining {
+		logger.WithFields(log.Fields{"maxTokens": requestData.MaxTokens, "clampedTo": remaining}).Debug("Clamping max tokens")
+		requestData.MaxTokens = remaining
+	}
+
+	return true
+}
+
+// trimOldestMessages drops the oldest non-system messages, always keeping the latest one, until
+// the prompt of promptTokens leaves room for a reply. It returns the new prompt size.
+func trimOldestMessages(cfg *Config, logger *log.Entry, requestData *RequestData, window int, promptTokens int) int {
+	if len(requestData.Messages) < 2 {
+		return promptTokens
+	}
+
+	model := resolvedModel(*requestData)
+	dropped := 0
+
+	for promptTokens >= window {
+		index := -1
+
+		for i, message := range requestData.Messages[:len(requestData.Messages)-1] {
+			if message.Role != openai.ChatMessageRoleSystem {
+				index = i
+				break
+			}
+		}
+
+		if index == -1 {
+			break
+		}
+
+		promptTokens -= countMessageTokens(cfg, model, requestData.Messages[index])
+		requestData.Messages = append(requestData.Messages[:index:index], requestData.Messages[index+1:]...)
+		dropped++
+	}
+
+	if dropped > 0 {
+		logger.WithFields(log.Fields{"dropped": dropped, "promptTokens": promptTokens}).Info("Trimmed messages to fit context window")
+	}
+
+	return promptTokens
+}
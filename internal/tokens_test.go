@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestCountTokens(t *testing.T) {
+	tests := []struct {
+		name  string
+		model string
+		text  string
+		want  int
+	}{
+		{name: "chat model", model: "gpt-3.5-turbo", text: "Hello world", want: 2},
+		{name: "model version", model: "gpt-4-0613", text: "Hello world", want: 2},
+		{name: "unknown model", model: "llama-2", text: "Hello world", want: 2},
+		{name: "empty", model: "gpt-4", text: "", want: 0},
+	}
+
+	for _, test := range tests {
+		if got := countTokens(&Config{}, test.model, test.text); got != test.want {
+			t.Errorf("%s: countTokens() = %d, want %d", test.name, got, test.want)
+		}
+	}
+
+	requestData := RequestData{
+		Model:       "gpt-3.5-turbo",
+		RequestType: "chat",
+		Messages:    []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Hello world"}},
+	}
+
+	// The priming of the reply, the markup of the message, its role and its content.
+	if got, want := countPromptTokens(&Config{}, requestData), replyPriming+tokensPerMessage+1+2; got != want {
+		t.Errorf("countPromptTokens() = %d, want %d", got, want)
+	}
+}
+
+func TestContextWindow(t *testing.T) {
+	cfg := &Config{Models: map[string]ModelConfig{
+		"gpt-4":      {ContextWindow: 10000},
+		"local-7b":   {ContextWindow: 2048},
+		defaultModel: {ContextWindow: 1000},
+	}}
+
+	tests := []struct {
+		model string
+		cfg   *Config
+		want  int
+	}{
+		{model: "gpt-3.5-turbo", cfg: cfg, want: 4096},
+		{model: "gpt-3.5-turbo-16k-0613", cfg: cfg, want: 16385},
+		{model: "gpt-4", cfg: cfg, want: 10000},
+		{model: "local-7b", cfg: cfg, want: 2048},
+		{model: "unknown", cfg: cfg, want: 1000},
+		{model: "unknown", cfg: &Config{}, want: fallbackContextWindow},
+	}
+
+	for _, test := range tests {
+		if got := contextWindow(test.cfg, test.model); got != test.want {
+			t.Errorf("contextWindow(%s) = %d, want %d", test.model, got, test.want)
+		}
+	}
+}
+
+func TestEnforceContextWindow(t *testing.T) {
+	long := strings.Repeat("word ", 40)
+
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "Be brief."},
+		{Role: openai.ChatMessageRoleUser, Content: long},
+		{Role: openai.ChatMessageRoleAssistant, Content: long},
+		{Role: openai.ChatMessageRoleUser, Content: "And now?"},
+	}
+
+	prompt := countPromptTokens(&Config{}, RequestData{Model: "gpt-3.5-turbo", RequestType: "chat", Messages: messages})
+
+	tests := []struct {
+		name          string
+		overflow      string
+		window        int
+		maxTokens     int
+		want          int
+		wantMessages  int
+		wantMaxTokens int
+	}{
+		{name: "fits", window: 1000, maxTokens: 100, want: http.StatusOK, wantMessages: 4, wantMaxTokens: 100},
+		{name: "clamps max tokens", window: 200, maxTokens: 1000, want: http.StatusOK, wantMessages: 4, wantMaxTokens: 200 - prompt},
+		{name: "rejects", window: 100, want: http.StatusBadRequest, wantMessages: 4},
+		{name: "trims the oldest messages", overflow: "trim", window: 100, want: http.StatusOK, wantMessages: 3, wantMaxTokens: 0},
+		{name: "trimming keeps the last message", overflow: "trim", window: 15, want: http.StatusBadRequest, wantMessages: 2},
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{
+				Models:          map[string]ModelConfig{"gpt-3.5-turbo": {ContextWindow: test.window}},
+				ContextOverflow: test.overflow,
+			}
+
+			requestData := RequestData{
+				Model:       "gpt-3.5-turbo",
+				RequestType: "chat",
+				MaxTokens:   test.maxTokens,
+				Messages:    append([]openai.ChatCompletionMessage{}, messages...),
+			}
+
+			w := httptest.NewRecorder()
+
+			allowed := enforceContextWindow(cfg, log.NewEntry(logger), w, &requestData)
+			if allowed != (test.want == http.StatusOK) || w.Code != test.want {
+				t.Fatalf("enforceContextWindow() = %v with status %d, want %d", allowed, w.Code, test.want)
+			}
+
+			if len(requestData.Messages) != test.wantMessages {
+				t.Errorf("%d messages left, want %d", len(requestData.Messages), test.wantMessages)
+			}
+
+			if requestData.Messages[0].Role != openai.ChatMessageRoleSystem {
+				t.Error("the system prompt was dropped")
+			}
+
+			if allowed && requestData.MaxTokens != test.wantMaxTokens {
+				t.Errorf("MaxTokens = %d, want %d", requestData.MaxTokens, test.wantMaxTokens)
+			}
+		})
+	}
+}
+
+func TestTrimOldestMessagesKeepsShortConversations(t *testing.T) {
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	for _, messages := range [][]openai.ChatCompletionMessage{
+		nil,
+		{{Role: openai.ChatMessageRoleUser, Content: strings.Repeat("word ", 40)}},
+	} {
+		requestData := RequestData{Model: "gpt-3.5-turbo", RequestType: "chat", Messages: messages}
+
+		if got := trimOldestMessages(&Config{}, log.NewEntry(logger), &requestData, 10, 50); got != 50 || len(requestData.Messages) != len(messages) {
+			t.Errorf("%d messages: trimmed to %d messages of %d tokens, want them kept", len(messages), len(requestData.Messages), got)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultServiceName     = "go-openai-proxy"
+	tracingShutdownTimeout = 5 * time.Second
+)
+
+var ErrUnknownTraceExporter = errors.New("unknown trace exporter")
+
+var (
+	tracer         = otel.Tracer("github.com/oceanplexian/go-openai-proxy/internal")
+	tracerProvider *sdktrace.TracerProvider
+)
+
+// InitializeTracing sets up the global tracer provider. Tracing is off unless an exporter is set;
+// "none" records spans without exporting them.
+func InitializeTracing(cfg *TracingConfig) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if cfg.Exporter == "" {
+		return nil
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+
+	// Zero is a valid ratio that records no new traces, only leaving the setting out records all.
+	sampleRatio := 1.0
+	if cfg.SampleRatio != nil {
+		sampleRatio = *cfg.SampleRatio
+	}
+
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	}
+
+	switch cfg.Exporter {
+	case "otlp":
+		headers := make(map[string]string, len(cfg.Headers))
+		for name, value := range cfg.Headers {
+			headers[name] = value.Value()
+		}
+
+		exporterOptions := []otlptracehttp.Option{otlptracehttp.WithHeaders(headers)}
+		if cfg.Endpoint != "" {
+			exporterOptions = append(exporterOptions, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+
+		if cfg.Insecure {
+			exporterOptions = append(exporterOptions, otlptracehttp.WithInsecure())
+		}
+
+		exporter, err := otlptracehttp.New(context.Background(), exporterOptions...)
+		if err != nil {
+			return fmt.Errorf("creating OTLP exporter: %w", err)
+		}
+
+		options = append(options, sdktrace.WithBatcher(exporter))
+	case "none":
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownTraceExporter, cfg.Exporter)
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(tracerProvider)
+
+	return nil
+}
+
+// ShutdownTracing exports the spans that are still buffered.
+func ShutdownTracing() error {
+	if tracerProvider == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		return fmt.Errorf("shutting down tracer provider: %w", err)
+	}
+
+	return nil
+}
+
+// startRequestSpan starts the span of a client request, continuing the client's trace if it sent
+// a traceparent header.
+func startRequestSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	ctx, span := tracer.Start(ctx, "proxy.request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethod(r.Method),
+			semconv.URLPath(r.URL.Path),
+		),
+	)
+
+	return r.WithContext(ctx), span
+}
+
+// endRequestSpan records the outcome of a client request on its span.
+func endRequestSpan(span trace.Span, status int, requestData RequestData) {
+	span.SetAttributes(
+		semconv.HTTPStatusCode(status),
+		attribute.String("proxy.client", requestData.Client),
+		attribute.String("gen_ai.request.model", requestData.Model),
+	)
+
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+
+	span.End()
+}
+
+// genAIAttributes describes the request with the OpenTelemetry GenAI semantic conventions.
+func genAIAttributes(upstream Upstream, requestData RequestData) []attribute.KeyValue {
+	system := "openai"
+	if upstream.Type == "azure" {
+		system = "az.ai.openai"
+	}
+
+	operation := "chat"
+	if requestData.RequestType == "completion" {
+		operation = "text_completion"
+	}
+
+	return []attribute.KeyValue{
+		attribute.String("gen_ai.system", system),
+		attribute.String("gen_ai.operation.name", operation),
+		attribute.String("gen_ai.request.model", requestData.Model),
+		attribute.Int("gen_ai.request.max_tokens", requestData.MaxTokens),
+	}
+}
+
+// setTokenAttributes adds the token counts of a finished response to the span in ctx.
+func setTokenAttributes(ctx context.Context, promptTokens int, completionTokens int) {
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int("gen_ai.usage.input_tokens", promptTokens),
+		attribute.Int("gen_ai.usage.output_tokens", completionTokens),
+	)
+}
+
+// failSpan marks the span as failed.
+func failSpan(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
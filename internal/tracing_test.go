@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestTracingSampleRatio(t *testing.T) {
+	ratio := func(r float64) *float64 { return &r }
+
+	tests := []struct {
+		name        string
+		sampleRatio *float64
+		want        bool
+	}{
+		{name: "unset records every trace", want: true},
+		{name: "zero records none", sampleRatio: ratio(0)},
+		{name: "one records every trace", sampleRatio: ratio(1), want: true},
+	}
+
+	previous := otel.GetTracerProvider()
+
+	t.Cleanup(func() {
+		ShutdownTracing() //nolint:errcheck
+		tracerProvider = nil
+		otel.SetTracerProvider(previous)
+	})
+
+	for _, test := range tests {
+		if err := InitializeTracing(&TracingConfig{Exporter: "none", SampleRatio: test.sampleRatio}); err != nil {
+			t.Fatal(err)
+		}
+
+		_, span := tracerProvider.Tracer("test").Start(context.Background(), "request")
+		span.End()
+
+		if sampled := span.SpanContext().IsSampled(); sampled != test.want {
+			t.Errorf("%s: sampled = %v, want %v", test.name, sampled, test.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Transport settings of upstreams that don't set their own.
+const (
+	DefaultUpstreamConnectTimeout     = 10 * time.Second
+	DefaultUpstreamIdleTimeout        = 90 * time.Second
+	DefaultUpstreamMaxIdleConnections = 100
+	upstreamKeepAlive                 = 30 * time.Second
+)
+
+var (
+	ErrInvalidUpstreamCA = errors.New("no certificates found in upstream CA file")
+	ErrInvalidProxyURL   = errors.New("invalid proxy URL")
+)
+
+// pooledClient is the long-lived client of an upstream and the settings it was built from.
+type pooledClient struct {
+	upstream  Upstream
+	client    *openai.Client
+	transport *http.Transport
+}
+
+var (
+	upstreamClientsMu sync.Mutex
+	upstreamClients   = map[string]*pooledClient{}
+)
+
+// upstreamClient returns the client of an upstream, whose connections are pooled across requests.
+// Clients are built on first use and again when the settings of the upstream change, e.g. on a
+// reload. Requests go through the tracing transport, so they carry the W3C traceparent of the
+// request they are made for, and its X-Request-ID.
+func upstreamClient(name string, upstream Upstream) (*openai.Client, error) {
+	upstreamClientsMu.Lock()
+	defer upstreamClientsMu.Unlock()
+
+	if pooled, ok := upstreamClients[name]; ok && pooled.upstream == upstream {
+		return pooled.client, nil
+	}
+
+	var config openai.ClientConfig
+
+	switch upstream.Type {
+	case "azure":
+		config = openai.DefaultAzureConfig(upstream.APIKey.Value(), upstream.URL)
+	case "openai":
+		config = openai.DefaultConfig(upstream.APIKey.Value())
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrInvalidUpstreamType, upstream.Type)
+	}
+
+	transport, err := newUpstreamTransport(upstream.Transport)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %w", name, err)
+	}
+
+	config.HTTPClient = &http.Client{Transport: otelhttp.NewTransport(requestIDTransport{transport})}
+
+	if previous, ok := upstreamClients[name]; ok {
+		previous.transport.CloseIdleConnections()
+	}
+
+	pooled := &pooledClient{upstream: upstream, client: openai.NewClientWithConfig(config), transport: transport}
+	upstreamClients[name] = pooled
+
+	return pooled.client, nil
+}
+
+// requestIDTransport forwards the ID of the client request to the upstream and notes the ID the
+// upstream gives it in return.
+type requestIDTransport struct {
+	next http.RoundTripper
+}
+
+func (t requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	entry := auditFrom(req.Context())
+	if entry == nil {
+		return t.next.RoundTrip(req) //nolint:wrapcheck
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set(RequestIDHeader, entry.requestID)
+
+	resp, err := t.next.RoundTrip(req)
+	if resp != nil {
+		entry.recordUpstreamID(resp.Header)
+	}
+
+	return resp, err //nolint:wrapcheck
+}
+
+// newUpstreamTransport builds the connection pool of an upstream.
+func newUpstreamTransport(settings UpstreamTransport) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert
+
+	transport.DialContext = (&net.Dialer{
+		Timeout:   orDefault(settings.ConnectTimeout, DefaultUpstreamConnectTimeout),
+		KeepAlive: upstreamKeepAlive,
+	}).DialContext
+	transport.ResponseHeaderTimeout = settings.ResponseHeaderTimeout
+	transport.IdleConnTimeout = orDefault(settings.IdleTimeout, DefaultUpstreamIdleTimeout)
+	transport.MaxConnsPerHost = settings.MaxConnections
+	transport.MaxIdleConnsPerHost = DefaultUpstreamMaxIdleConnections
+
+	if settings.MaxIdleConnections > 0 {
+		transport.MaxIdleConnsPerHost = settings.MaxIdleConnections
+	}
+
+	if settings.Proxy != "" {
+		proxyURL, err := url.Parse(settings.Proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidProxyURL, settings.Proxy)
+		}
+
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig, err := upstreamTLSConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	transport.TLSClientConfig = tlsConfig
+
+	return transport, nil
+}
+
+// upstreamTLSConfig trusts the CA bundle of an upstream in addition to the system roots and
+// presents its client certificate, if any.
+func upstreamTLSConfig(settings UpstreamTransport) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if settings.CAFile != "" {
+		pem, err := os.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading upstream CA: %w", err)
+		}
+
+		config.RootCAs, err = x509.SystemCertPool()
+		if err != nil {
+			config.RootCAs = x509.NewCertPool()
+		}
+
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidUpstreamCA, settings.CAFile)
+		}
+	}
+
+	if settings.CertFile != "" || settings.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading upstream client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
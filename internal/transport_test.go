@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewUpstreamTransport(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "proxy.example.com")
+
+	notPEM := filepath.Join(dir, "ca.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		settings         UpstreamTransport
+		wantErr          error
+		wantIdleTimeout  time.Duration
+		wantMaxIdle      int
+		wantMaxConns     int
+		wantCertificates int
+	}{
+		{
+			name:            "defaults",
+			wantIdleTimeout: DefaultUpstreamIdleTimeout,
+			wantMaxIdle:     DefaultUpstreamMaxIdleConnections,
+		},
+		{
+			name:            "configured",
+			settings:        UpstreamTransport{IdleTimeout: time.Minute, MaxConnections: 20, MaxIdleConnections: 10, Proxy: "http://proxy.internal:3128"},
+			wantIdleTimeout: time.Minute,
+			wantMaxIdle:     10,
+			wantMaxConns:    20,
+		},
+		{
+			name:             "client certificate and CA",
+			settings:         UpstreamTransport{CAFile: certFile, CertFile: certFile, KeyFile: keyFile},
+			wantIdleTimeout:  DefaultUpstreamIdleTimeout,
+			wantMaxIdle:      DefaultUpstreamMaxIdleConnections,
+			wantCertificates: 1,
+		},
+		{name: "proxy without a host", settings: UpstreamTransport{Proxy: "proxy.internal"}, wantErr: ErrInvalidProxyURL},
+		{name: "CA without certificates", settings: UpstreamTransport{CAFile: notPEM}, wantErr: ErrInvalidUpstreamCA},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport, err := newUpstreamTransport(test.settings)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("newUpstreamTransport() error = %v, want %v", err, test.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if transport.IdleConnTimeout != test.wantIdleTimeout {
+				t.Errorf("IdleConnTimeout = %v, want %v", transport.IdleConnTimeout, test.wantIdleTimeout)
+			}
+
+			if transport.MaxIdleConnsPerHost != test.wantMaxIdle || transport.MaxConnsPerHost != test.wantMaxConns {
+				t.Errorf("connections = %d idle, %d max, want %d, %d",
+					transport.MaxIdleConnsPerHost, transport.MaxConnsPerHost, test.wantMaxIdle, test.wantMaxConns)
+			}
+
+			if certificates := len(transport.TLSClientConfig.Certificates); certificates != test.wantCertificates {
+				t.Errorf("%d client certificates, want %d", certificates, test.wantCertificates)
+			}
+
+			if test.settings.Proxy != "" {
+				proxyURL, err := transport.Proxy(httptest.NewRequest(http.MethodPost, "https://api.openai.com/v1/chat/completions", nil))
+				if err != nil || proxyURL.String() != test.settings.Proxy {
+					t.Errorf("proxy = %v, want %s", proxyURL, test.settings.Proxy)
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamClientPooling(t *testing.T) {
+	upstreamClientsMu.Lock()
+	upstreamClients = map[string]*pooledClient{}
+	upstreamClientsMu.Unlock()
+
+	t.Cleanup(func() {
+		upstreamClientsMu.Lock()
+		upstreamClients = map[string]*pooledClient{}
+		upstreamClientsMu.Unlock()
+	})
+
+	primary := Upstream{Type: "openai", APIKey: "sk-primary"}
+
+	first, err := upstreamClient("primary", primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		upstream string
+		settings Upstream
+		wantSame bool
+	}{
+		{name: "same settings", upstream: "primary", settings: primary, wantSame: true},
+		{name: "other upstream", upstream: "backup", settings: primary},
+		{name: "changed settings", upstream: "primary", settings: Upstream{Type: "openai", APIKey: "sk-rotated"}},
+	}
+
+	for _, test := range tests {
+		client, err := upstreamClient(test.upstream, test.settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (client == first) != test.wantSame {
+			t.Errorf("%s: reused the client = %v, want %v", test.name, client == first, test.wantSame)
+		}
+	}
+
+	if _, err := upstreamClient("broken", Upstream{Type: "anthropic"}); !errors.Is(err, ErrInvalidUpstreamType) {
+		t.Errorf("upstreamClient() error = %v, want %v", err, ErrInvalidUpstreamType)
+	}
+}
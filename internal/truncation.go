@@ -0,0 +1,298 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	TruncationKeepLastTurns = "keepLastTurns"
+	TruncationSlidingWindow = "slidingWindow"
+	TruncationSummarize     = "summarize"
+
+	defaultSummaryMaxTokens = 256
+	defaultSummaryTimeout   = 10 * time.Second
+)
+
+var (
+	ErrUnknownTruncationStrategy = fmt.Errorf("unknown truncation strategy")
+	ErrContextLengthExceeded     = errors.New("context length exceeded")
+)
+
+// contextLengthError is returned when the last user message doesn't fit the budget on its own,
+// so no amount of truncation can save the request.
+type contextLengthError struct {
+	tokens    int // Needed by the last user message
+	available int // Left by the budget after the system prompt
+}
+
+func (e *contextLengthError) Error() string {
+	return fmt.Sprintf("%s: the last user message needs %d tokens, but only %d are available", ErrContextLengthExceeded, e.tokens, e.available)
+}
+
+func (e *contextLengthError) Is(target error) bool {
+	return target == ErrContextLengthExceeded
+}
+
+// TruncationInterceptor shortens long chats before they are forwarded so the upstream doesn't
+// reject them. System prompts are always kept unless dropSystemPrompt is set.
+func TruncationInterceptor(ctx context.Context, cfg *Config, logger *log.Entry, requestData *RequestData) error {
+	if requestData == nil {
+		return fmt.Errorf("%w", ErrRequestDataNil)
+	}
+
+	if requestData.RequestType != "chat" || len(requestData.Messages) == 0 {
+		return nil
+	}
+
+	settings := cfg.Truncation
+
+	var keep []bool
+	var err error
+
+	switch settings.Strategy {
+	case "":
+		return nil
+	case TruncationKeepLastTurns:
+		keep = keepLastTurns(requestData.Messages, settings.LastTurns)
+	case TruncationSlidingWindow:
+		keep, err = keepWithinTokens(cfg, requestData, truncationBudget(cfg, *requestData))
+	case TruncationSummarize:
+		// Leave room for the summary that replaces the elided messages.
+		keep, err = keepWithinTokens(cfg, requestData, truncationBudget(cfg, *requestData)-summaryMaxTokens(cfg))
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownTruncationStrategy, settings.Strategy)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !settings.DropSystemPrompt {
+		for i, message := range requestData.Messages {
+			if message.Role == openai.ChatMessageRoleSystem {
+				keep[i] = true
+			}
+		}
+	}
+
+	var kept, elided []openai.ChatCompletionMessage
+
+	elidedFields := []log.Fields{}
+
+	for i, message := range requestData.Messages {
+		if keep[i] {
+			kept = append(kept, message)
+			continue
+		}
+
+		elided = append(elided, message)
+		elidedFields = append(elidedFields, log.Fields{
+			"index":  i,
+			"role":   message.Role,
+			"tokens": countMessageTokens(cfg, resolvedModel(*requestData), message),
+		})
+	}
+
+	if len(elided) == 0 {
+		return nil
+	}
+
+	if settings.Strategy == TruncationSummarize {
+		summary, err := summarizeMessages(ctx, cfg, logger, *requestData, elided)
+		if err != nil {
+			// Fall back to plain dropping, the request still fits.
+			logger.WithFields(log.Fields{"error": err}).Error("Failed to summarize elided messages")
+		} else {
+			kept = insertAfterSystemPrompt(kept, openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: "Summary of the earlier conversation: " + summary,
+			})
+		}
+	}
+
+	logger.WithFields(log.Fields{
+		"strategy": settings.Strategy,
+		"client":   requestData.Client,
+		"model":    requestData.Model,
+		"elided":   elidedFields,
+	}).Info("Truncated conversation")
+
+	requestData.Messages = kept
+
+	return nil
+}
+
+// truncationBudget is how many prompt tokens the chat may use: the configured maximum, or
+// whatever the context window leaves after reserving room for the reply.
+func truncationBudget(cfg *Config, requestData RequestData) int {
+	if cfg.Truncation.MaxTokens > 0 {
+		return cfg.Truncation.MaxTokens
+	}
+
+	window := contextWindow(cfg, resolvedModel(requestData))
+
+	reserve := cfg.Truncation.ReserveTokens
+	if requestData.MaxTokens > reserve {
+		reserve = requestData.MaxTokens
+	}
+
+	return window - reserve
+}
+
+// keepLastTurns keeps the last n turns, a turn starting at each user message. Zero keeps everything.
+func keepLastTurns(messages []openai.ChatCompletionMessage, turns int) []bool {
+	keep := make([]bool, len(messages))
+	seen := 0
+
+	if turns <= 0 {
+		turns = len(messages)
+	}
+
+	for i := len(messages) - 1; i >= 0; i-- {
+		if seen >= turns {
+			break
+		}
+
+		keep[i] = true
+
+		if messages[i].Role == openai.ChatMessageRoleUser {
+			seen++
+		}
+	}
+
+	return keep
+}
+
+// keepWithinTokens keeps the newest messages that fit into budget tokens, after the system
+// prompt has taken its share. The last user message is always kept, and a contextLengthError is
+// returned when it doesn't fit by itself. A budget of zero keeps everything.
+func keepWithinTokens(cfg *Config, requestData *RequestData, budget int) ([]bool, error) {
+	messages := requestData.Messages
+	model := resolvedModel(*requestData)
+	keep := make([]bool, len(messages))
+
+	if budget <= 0 {
+		for i := range keep {
+			keep[i] = true
+		}
+
+		return keep, nil
+	}
+
+	used := replyPriming
+
+	if !cfg.Truncation.DropSystemPrompt {
+		for _, message := range messages {
+			if message.Role == openai.ChatMessageRoleSystem {
+				used += countMessageTokens(cfg, model, message)
+			}
+		}
+	}
+
+	if last := lastUserIndex(*requestData); last >= 0 {
+		tokens := countMessageTokens(cfg, model, messages[last])
+		if used+tokens > budget {
+			return nil, &contextLengthError{tokens: tokens, available: budget - used}
+		}
+
+		used += tokens
+		keep[last] = true
+	}
+
+	for i := len(messages) - 1; i >= 0; i-- {
+		if keep[i] || (messages[i].Role == openai.ChatMessageRoleSystem && !cfg.Truncation.DropSystemPrompt) {
+			continue
+		}
+
+		tokens := countMessageTokens(cfg, model, messages[i])
+		if used+tokens > budget {
+			break
+		}
+
+		used += tokens
+		keep[i] = true
+	}
+
+	return keep, nil
+}
+
+// summarizeMessages asks an upstream to condense the elided part of the conversation, by default
+// the one the request goes to. It gives up after the summary timeout or when the request ends.
+func summarizeMessages(ctx context.Context, cfg *Config, logger *log.Entry, requestData RequestData, messages []openai.ChatCompletionMessage) (string, error) {
+	var name string
+	var upstream Upstream
+
+	if route := requestData.route; route != nil {
+		name, upstream = route.name, route.upstream
+	} else {
+		name, upstream = selectUpstream(cfg, requestData.Profile)
+	}
+
+	if cfg.Truncation.SummaryUpstream != "" {
+		name = cfg.Truncation.SummaryUpstream
+		upstream = cfg.Upstreams[name]
+	}
+
+	maxTokens := summaryMaxTokens(cfg)
+
+	prompt := []openai.ChatCompletionMessage{{
+		Role: openai.ChatMessageRoleSystem,
+		Content: "Summarize the following conversation in a few sentences. Keep names, facts and decisions " +
+			"that later messages may refer to.",
+	}}
+	prompt = append(prompt, messages...)
+
+	logger.WithFields(log.Fields{"upstreamName": name, "messages": len(messages)}).Debug("Summarizing elided messages")
+
+	timeout := cfg.Truncation.SummaryTimeout
+	if timeout <= 0 {
+		timeout = defaultSummaryTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	summary, err := CreateChatCompletion(ctx, cfg, logger, name, upstream, prompt, maxTokens)
+	if err != nil {
+		return "", err
+	}
+
+	// The summary counts against the budget of the client whose conversation it condenses.
+	recordUsage(cfg, logger, name, RequestData{
+		Client:      requestData.Client,
+		Profile:     requestData.Profile,
+		Model:       requestData.Model,
+		RequestType: "chat",
+		Messages:    prompt,
+		route:       &upstreamRoute{name: name, upstream: upstream, model: upstreamModel(upstream, "chat")},
+	}, summary)
+
+	return summary, nil
+}
+
+func summaryMaxTokens(cfg *Config) int {
+	if cfg.Truncation.SummaryMaxTokens > 0 {
+		return cfg.Truncation.SummaryMaxTokens
+	}
+
+	return defaultSummaryMaxTokens
+}
+
+func insertAfterSystemPrompt(messages []openai.ChatCompletionMessage, message openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	index := 0
+	for index < len(messages) && messages[index].Role == openai.ChatMessageRoleSystem {
+		index++
+	}
+
+	result := make([]openai.ChatCompletionMessage, 0, len(messages)+1)
+	result = append(result, messages[:index]...)
+	result = append(result, message)
+
+	return append(result, messages[index:]...)
+}
@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestTruncationInterceptor(t *testing.T) {
+	long := strings.Repeat("word ", 40)
+
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "Be brief."},
+		{Role: openai.ChatMessageRoleUser, Content: long},
+		{Role: openai.ChatMessageRoleAssistant, Content: long},
+		{Role: openai.ChatMessageRoleUser, Content: "And now?"},
+	}
+
+	tests := []struct {
+		name     string
+		settings TruncationConfig
+		last     string // replaces the last user message
+		want     []int  // indexes of the messages left
+		wantErr  error
+	}{
+		{name: "no strategy", want: []int{0, 1, 2, 3}},
+		{name: "last turn", settings: TruncationConfig{Strategy: TruncationKeepLastTurns, LastTurns: 1}, want: []int{0, 3}},
+		{name: "last turn without the system prompt", settings: TruncationConfig{Strategy: TruncationKeepLastTurns, LastTurns: 1, DropSystemPrompt: true}, want: []int{3}},
+		{name: "sliding window", settings: TruncationConfig{Strategy: TruncationSlidingWindow, MaxTokens: 70}, want: []int{0, 2, 3}},
+		{name: "small sliding window", settings: TruncationConfig{Strategy: TruncationSlidingWindow, MaxTokens: 60}, want: []int{0, 3}},
+		{name: "sliding window fits everything", settings: TruncationConfig{Strategy: TruncationSlidingWindow, MaxTokens: 1000}, want: []int{0, 1, 2, 3}},
+		{name: "last user message too long", settings: TruncationConfig{Strategy: TruncationSlidingWindow, MaxTokens: 20}, last: long, wantErr: ErrContextLengthExceeded},
+		{name: "unknown strategy", settings: TruncationConfig{Strategy: "random"}, wantErr: ErrUnknownTruncationStrategy},
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requestData := RequestData{
+				Model:       "gpt-3.5-turbo",
+				RequestType: "chat",
+				Messages:    append([]openai.ChatCompletionMessage{}, messages...),
+			}
+
+			if test.last != "" {
+				requestData.Messages[3].Content = test.last
+			}
+
+			err := TruncationInterceptor(context.Background(), &Config{Truncation: test.settings}, log.NewEntry(logger), &requestData)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("TruncationInterceptor() error = %v, want %v", err, test.wantErr)
+			}
+
+			if test.wantErr != nil {
+				return
+			}
+
+			want := []openai.ChatCompletionMessage{}
+			for _, i := range test.want {
+				want = append(want, messages[i])
+			}
+
+			if !reflect.DeepEqual(requestData.Messages, want) {
+				t.Errorf("kept %v, want %v", requestData.Messages, want)
+			}
+		})
+	}
+}
+
+func TestTruncationSummary(t *testing.T) {
+	long := strings.Repeat("word ", 40)
+
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "Be brief."},
+		{Role: openai.ChatMessageRoleUser, Content: long},
+		{Role: openai.ChatMessageRoleAssistant, Content: long},
+		{Role: openai.ChatMessageRoleUser, Content: "And now?"},
+	}
+
+	summary := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: "Summary of the earlier conversation: Words."}
+
+	tests := []struct {
+		name    string
+		delay   time.Duration // before the upstream answers
+		timeout time.Duration
+		cancel  bool
+		want    []openai.ChatCompletionMessage
+		wantUse bool // whether the summary shows up in the usage of the client
+	}{
+		{name: "summarized", want: []openai.ChatCompletionMessage{messages[0], summary, messages[3]}, wantUse: true},
+		{name: "summary timeout", delay: time.Minute, timeout: 50 * time.Millisecond, want: []openai.ChatCompletionMessage{messages[0], messages[3]}},
+		{name: "request cancelled", delay: time.Minute, cancel: true, want: []openai.ChatCompletionMessage{messages[0], messages[3]}},
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Reading the body lets the server notice the client giving up.
+				io.Copy(io.Discard, r.Body) //nolint:errcheck
+
+				select {
+				case <-time.After(test.delay):
+				case <-r.Context().Done():
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"Words."}}]}`) //nolint:errcheck
+			}))
+			defer server.Close()
+
+			path := filepath.Join(t.TempDir(), "usage.db")
+
+			store, err := OpenUsageStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			previous := usageStore
+			usageStore = store
+
+			defer func() { usageStore = previous }()
+
+			cfg := &Config{
+				Upstreams: map[string]Upstream{"primary": {Type: "azure", URL: server.URL, Model: "gpt-35-turbo", Priority: 1}},
+				Pricing:   map[string]ModelPrice{"gpt-35-turbo": {Prompt: 1, Completion: 1}},
+				Truncation: TruncationConfig{
+					Strategy:         TruncationSummarize,
+					MaxTokens:        70,
+					SummaryMaxTokens: 10,
+					SummaryTimeout:   test.timeout,
+				},
+			}
+
+			requestData := RequestData{
+				Client:      "team",
+				Model:       "gpt-3.5-turbo",
+				RequestType: "chat",
+				Messages:    append([]openai.ChatCompletionMessage{}, messages...),
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if test.cancel {
+				time.AfterFunc(50*time.Millisecond, cancel)
+			}
+
+			started := time.Now()
+
+			if err := TruncationInterceptor(ctx, cfg, log.NewEntry(logger), &requestData); err != nil {
+				t.Fatal(err)
+			}
+
+			if elapsed := time.Since(started); elapsed > time.Second {
+				t.Errorf("truncation took %v", elapsed)
+			}
+
+			if !reflect.DeepEqual(requestData.Messages, test.want) {
+				t.Errorf("messages = %v, want %v", requestData.Messages, test.want)
+			}
+
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			store, err = OpenUsageStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer store.Close()
+
+			if daily, _, _ := store.Spend("team", time.Now()); (daily > 0) != test.wantUse {
+				t.Errorf("the client spent %v on the summary, want spending = %v", daily, test.wantUse)
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Circuit breaker states, also the values of the proxy_upstream_circuit_state metric.
+const (
+	CircuitClosed   = 0
+	CircuitHalfOpen = 1
+	CircuitOpen     = 2
+)
+
+var circuitNames = map[int]string{CircuitClosed: "closed", CircuitHalfOpen: "halfOpen", CircuitOpen: "open"}
+
+// upstreamOutcome is filled in by an upstream call before it closes its response channel.
+type upstreamOutcome struct {
+	err      error
+	finished bool // The upstream's answer arrived in full
+}
+
+func (o *upstreamOutcome) fail(err error) {
+	o.err = err
+}
+
+// succeeded reports whether the upstream answered in full, rather than failing, being cancelled or
+// never being called.
+func (o *upstreamOutcome) succeeded() bool {
+	return o.finished && o.err == nil
+}
+
+// status describes the failure for metrics: the upstream's HTTP status if it sent one.
+func (o *upstreamOutcome) status() string {
+	var apiError *openai.APIError
+	if errors.As(o.err, &apiError) {
+		return strconv.Itoa(apiError.HTTPStatusCode)
+	}
+
+	var requestError *openai.RequestError
+	if errors.As(o.err, &requestError) {
+		return strconv.Itoa(requestError.HTTPStatusCode)
+	}
+
+	return "error"
+}
+
+// upstreamCall follows a single request to an upstream for metrics, tracing and the circuit breaker.
+type upstreamCall struct {
+	ctx         context.Context
+	upstream    string
+	requestData RequestData
+	started     time.Time
+	firstChunk  time.Time
+	span        trace.Span
+	audit       *auditEntry
+	capture     *CaptureRecord
+	cancel      context.CancelFunc
+	chunks      atomic.Int64
+}
+
+// InflightCall describes a call in flight to an upstream, for the admin API.
+type InflightCall struct {
+	RequestID   string    `json:"requestId,omitempty"`
+	Upstream    string    `json:"upstream"`
+	Client      string    `json:"client"`
+	Model       string    `json:"model"`
+	RequestType string    `json:"requestType"`
+	Started     time.Time `json:"started"`
+	Seconds     float64   `json:"seconds"`
+	Chunks      int64     `json:"chunks"`
+}
+
+var (
+	upstreamCallsMu sync.Mutex
+	upstreamCalls   = map[*upstreamCall]struct{}{}
+)
+
+// startUpstreamCall starts the span of an upstream attempt. failover tells whether preferred
+// upstreams were skipped to get here.
+func startUpstreamCall(
+	ctx context.Context,
+	name string,
+	upstream Upstream,
+	requestData RequestData,
+	failover bool,
+) (context.Context, *upstreamCall) {
+	inflightStreams.WithLabelValues(name, requestData.Model, requestData.RequestType).Inc()
+
+	attributes := append(genAIAttributes(upstream, requestData),
+		attribute.String("proxy.upstream", name),
+		attribute.Int("proxy.attempt", 1),
+		attribute.Bool("proxy.failover", failover),
+	)
+
+	ctx, span := tracer.Start(ctx, "proxy.upstream_attempt",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attributes...),
+	)
+
+	// Disabling the upstream with the admin API cancels the call.
+	ctx, cancel := context.WithCancel(ctx)
+
+	call := &upstreamCall{
+		ctx:         ctx,
+		upstream:    name,
+		requestData: requestData,
+		started:     time.Now(),
+		span:        span,
+		audit:       auditFrom(ctx),
+		capture:     captureFrom(ctx),
+		cancel:      cancel,
+	}
+
+	upstreamCallsMu.Lock()
+	upstreamCalls[call] = struct{}{}
+	upstreamCallsMu.Unlock()
+
+	return ctx, call
+}
+
+// received notes that a chunk arrived from the upstream.
+func (c *upstreamCall) received(content string) {
+	c.capture.recordChunk(content)
+	c.chunks.Add(1)
+
+	if c.firstChunk.IsZero() {
+		c.firstChunk = time.Now()
+		timeToFirstToken.WithLabelValues(c.upstream, c.requestData.Model, c.requestData.RequestType).
+			Observe(c.firstChunk.Sub(c.started).Seconds())
+		c.span.AddEvent("first_token")
+	}
+}
+
+func (c *upstreamCall) finish(cfg *Config, logger *log.Entry, outcome *upstreamOutcome) {
+	upstreamCallsMu.Lock()
+	delete(upstreamCalls, c)
+	upstreamCallsMu.Unlock()
+
+	// Calls cut short by the client going away or the upstream being disabled say nothing about its
+	// health.
+	cancelled := errors.Is(outcome.err, context.Canceled) || (outcome.err != nil && c.ctx.Err() != nil)
+
+	c.cancel()
+
+	labels := []string{c.upstream, c.requestData.Model, c.requestData.RequestType}
+
+	inflightStreams.WithLabelValues(labels...).Dec()
+	upstreamDuration.WithLabelValues(labels...).Observe(time.Since(c.started).Seconds())
+
+	if outcome.err != nil {
+		if !cancelled {
+			upstreamErrorsTotal.WithLabelValues(append(labels, outcome.status())...).Inc()
+		}
+
+		failSpan(c.span, outcome.err)
+		c.audit.recordUpstreamError(outcome.err)
+		c.capture.recordUpstreamError(outcome.err)
+	}
+
+	c.span.End()
+
+	fields := log.Fields{"upstreamName": c.upstream, "durationMs": time.Since(c.started).Milliseconds(), "chunks": c.chunks.Load()}
+	if c.audit != nil && c.audit.upstreamID != "" {
+		fields["upstreamRequestId"] = c.audit.upstreamID
+	}
+
+	logger.WithFields(fields).Debug("Upstream call finished")
+
+	if cancelled {
+		releaseRoute(c.requestData.route)
+		return
+	}
+
+	recordUpstreamResult(cfg, logger, c.requestData.route, outcome.err)
+}
+
+// InflightCalls lists the calls in flight to upstreams, oldest first.
+func InflightCalls() []InflightCall {
+	upstreamCallsMu.Lock()
+	defer upstreamCallsMu.Unlock()
+
+	calls := make([]InflightCall, 0, len(upstreamCalls))
+
+	for call := range upstreamCalls {
+		inflight := InflightCall{
+			Upstream:    call.upstream,
+			Client:      call.requestData.Client,
+			Model:       call.requestData.Model,
+			RequestType: call.requestData.RequestType,
+			Started:     call.started,
+			Seconds:     time.Since(call.started).Seconds(),
+			Chunks:      call.chunks.Load(),
+		}
+
+		if call.audit != nil {
+			inflight.RequestID = call.audit.requestID
+		}
+
+		calls = append(calls, inflight)
+	}
+
+	sort.Slice(calls, func(i, j int) bool { return calls[i].Started.Before(calls[j].Started) })
+
+	return calls
+}
+
+func inflightCallsByUpstream() map[string]int {
+	upstreamCallsMu.Lock()
+	defer upstreamCallsMu.Unlock()
+
+	counts := map[string]int{}
+	for call := range upstreamCalls {
+		counts[call.upstream]++
+	}
+
+	return counts
+}
+
+// cancelUpstreamCalls aborts the calls in flight to an upstream.
+func cancelUpstreamCalls(name string) {
+	upstreamCallsMu.Lock()
+	defer upstreamCallsMu.Unlock()
+
+	for call := range upstreamCalls {
+		if call.upstream == name {
+			call.cancel()
+		}
+	}
+}
+
+type upstreamHealth struct {
+	state     int
+	failures  int
+	openedAt  time.Time
+	lastError string
+	probing   bool // The trial call of a half-open circuit is in flight
+}
+
+var (
+	upstreamHealthMu sync.Mutex
+	upstreamHealths  = map[string]*upstreamHealth{}
+)
+
+func healthOf(name string) *upstreamHealth {
+	health, ok := upstreamHealths[name]
+	if !ok {
+		health = &upstreamHealth{}
+		upstreamHealths[name] = health
+	}
+
+	return health
+}
+
+// upstreamAvailable reports whether requests may be sent to the upstream. An open circuit lets a
+// single trial request through (half-open) once the cooldown has passed.
+func upstreamAvailable(cfg *Config, name string) bool {
+	if cfg.CircuitBreaker.FailureThreshold <= 0 {
+		return true
+	}
+
+	upstreamHealthMu.Lock()
+	defer upstreamHealthMu.Unlock()
+
+	health := healthOf(name)
+
+	switch {
+	case health.state == CircuitClosed:
+		return true
+	case health.state == CircuitOpen && time.Since(health.openedAt) >= cfg.CircuitBreaker.Cooldown:
+		health.state = CircuitHalfOpen
+		circuitState.WithLabelValues(name).Set(CircuitHalfOpen)
+	}
+
+	return health.state == CircuitHalfOpen && !health.probing
+}
+
+// claimProbe makes the request routed to a half-open upstream its trial call, so that no other
+// request is sent there until it is settled.
+func claimProbe(cfg *Config, route *upstreamRoute) {
+	if cfg.CircuitBreaker.FailureThreshold <= 0 {
+		return
+	}
+
+	upstreamHealthMu.Lock()
+	defer upstreamHealthMu.Unlock()
+
+	if health := healthOf(route.name); health.state == CircuitHalfOpen && !health.probing {
+		health.probing, route.probe = true, true
+	}
+}
+
+// releaseRoute gives up the trial call of a request that didn't get to call the upstream, or
+// whose call was cancelled, so that the next request makes it instead.
+func releaseRoute(route *upstreamRoute) {
+	if route == nil {
+		return
+	}
+
+	upstreamHealthMu.Lock()
+	defer upstreamHealthMu.Unlock()
+
+	if route.probe {
+		healthOf(route.name).probing, route.probe = false, false
+	}
+}
+
+// recordUpstreamResult feeds the outcome of a call into the upstream's circuit breaker.
+func recordUpstreamResult(cfg *Config, logger *log.Entry, route *upstreamRoute, err error) {
+	if cfg.CircuitBreaker.FailureThreshold <= 0 || route == nil || route.name == "" {
+		return
+	}
+
+	upstreamHealthMu.Lock()
+	defer upstreamHealthMu.Unlock()
+
+	name := route.name
+	health := healthOf(name)
+
+	if route.probe {
+		health.probing, route.probe = false, false
+	}
+
+	if err == nil {
+		if health.state != CircuitClosed {
+			logger.WithFields(log.Fields{"upstreamName": name}).Info("Upstream circuit closed")
+		}
+
+		health.state, health.failures = CircuitClosed, 0
+		circuitState.WithLabelValues(name).Set(CircuitClosed)
+
+		return
+	}
+
+	health.failures++
+	health.lastError = err.Error()
+
+	if health.state == CircuitHalfOpen || health.failures >= cfg.CircuitBreaker.FailureThreshold {
+		if health.state != CircuitOpen {
+			logger.WithFields(log.Fields{"upstreamName": name, "failures": health.failures, "error": err}).Warn("Upstream circuit opened")
+		}
+
+		health.state, health.openedAt = CircuitOpen, time.Now()
+		circuitState.WithLabelValues(name).Set(CircuitOpen)
+	}
+}
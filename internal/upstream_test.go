@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errTestUpstream = errors.New("upstream failed")
+
+// resetUpstreamHealth forgets the circuit state left behind by other tests.
+func resetUpstreamHealth(t *testing.T) {
+	t.Helper()
+
+	upstreamHealthMu.Lock()
+	upstreamHealths = map[string]*upstreamHealth{}
+	upstreamHealthMu.Unlock()
+
+	t.Cleanup(func() {
+		upstreamHealthMu.Lock()
+		upstreamHealths = map[string]*upstreamHealth{}
+		upstreamHealthMu.Unlock()
+	})
+}
+
+// expireCooldown makes the cooldown of an open circuit look like it has passed.
+func expireCooldown(name string, cooldown time.Duration) {
+	upstreamHealthMu.Lock()
+	defer upstreamHealthMu.Unlock()
+
+	health := healthOf(name)
+	health.openedAt = health.openedAt.Add(-cooldown)
+}
+
+func circuitOf(name string) int {
+	upstreamHealthMu.Lock()
+	defer upstreamHealthMu.Unlock()
+
+	return healthOf(name).state
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	// Steps: "fail" and "succeed" record a call, "cooldown" lets the cooldown pass.
+	tests := []struct {
+		name      string
+		threshold int
+		steps     []string
+		state     int
+		available bool
+	}{
+		{name: "disabled", threshold: 0, steps: []string{"fail", "fail", "fail"}, state: CircuitClosed, available: true},
+		{name: "below the threshold", threshold: 3, steps: []string{"fail", "fail"}, state: CircuitClosed, available: true},
+		{name: "at the threshold", threshold: 3, steps: []string{"fail", "fail", "fail"}, state: CircuitOpen, available: false},
+		{name: "failures must be consecutive", threshold: 2, steps: []string{"fail", "succeed", "fail"}, state: CircuitClosed, available: true},
+		{name: "half-open after the cooldown", threshold: 1, steps: []string{"fail", "cooldown"}, state: CircuitHalfOpen, available: true},
+		{name: "trial call succeeds", threshold: 1, steps: []string{"fail", "cooldown", "succeed"}, state: CircuitClosed, available: true},
+		{name: "trial call fails", threshold: 3, steps: []string{"fail", "fail", "fail", "cooldown", "fail"}, state: CircuitOpen, available: false},
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetUpstreamHealth(t)
+
+			cfg := &Config{CircuitBreaker: CircuitBreaker{FailureThreshold: test.threshold, Cooldown: time.Minute}}
+
+			for _, step := range test.steps {
+				switch step {
+				case "fail":
+					recordUpstreamResult(cfg, log.NewEntry(logger), &upstreamRoute{name: "primary"}, errTestUpstream)
+				case "succeed":
+					recordUpstreamResult(cfg, log.NewEntry(logger), &upstreamRoute{name: "primary"}, nil)
+				case "cooldown":
+					expireCooldown("primary", time.Minute)
+					upstreamAvailable(cfg, "primary")
+				}
+			}
+
+			if state := circuitOf("primary"); state != test.state {
+				t.Errorf("state = %d, want %d", state, test.state)
+			}
+
+			if available := upstreamAvailable(cfg, "primary"); available != test.available {
+				t.Errorf("upstreamAvailable() = %v, want %v", available, test.available)
+			}
+		})
+	}
+}
+
+func TestSelectUpstreamAvoidsOpenCircuits(t *testing.T) {
+	tests := []struct {
+		name string
+		open []string
+		want string
+	}{
+		{name: "all healthy", want: "primary"},
+		{name: "primary open", open: []string{"primary"}, want: "secondary"},
+		{name: "all open falls back to priority", open: []string{"primary", "secondary"}, want: "primary"},
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetUpstreamHealth(t)
+
+			cfg := &Config{
+				Upstreams: map[string]Upstream{
+					"primary":   {Type: "openai", Priority: 1},
+					"secondary": {Type: "openai", Priority: 2},
+				},
+				CircuitBreaker: CircuitBreaker{FailureThreshold: 1, Cooldown: time.Minute},
+			}
+
+			for _, name := range test.open {
+				recordUpstreamResult(cfg, log.NewEntry(logger), &upstreamRoute{name: name}, errTestUpstream)
+			}
+
+			if name, _ := selectUpstream(cfg, ""); name != test.want {
+				t.Errorf("selectUpstream() = %s, want %s", name, test.want)
+			}
+		})
+	}
+}
+
+func TestHalfOpenCircuitAdmitsOneTrialCall(t *testing.T) {
+	resetUpstreamHealth(t)
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	cfg := &Config{
+		Upstreams: map[string]Upstream{
+			"primary":   {Type: "openai", Priority: 1},
+			"secondary": {Type: "openai", Priority: 2},
+		},
+		CircuitBreaker: CircuitBreaker{FailureThreshold: 1, Cooldown: time.Minute},
+	}
+
+	recordUpstreamResult(cfg, log.NewEntry(logger), &upstreamRoute{name: "primary"}, errTestUpstream)
+	expireCooldown("primary", time.Minute)
+
+	requestData := RequestData{Model: "gpt-3.5-turbo", RequestType: "chat"}
+
+	// The steps run in order: "route" routes a request, "release" gives up the trial call without
+	// making it, "cancel" and "fail" finish it.
+	steps := []struct {
+		action    string
+		want      string
+		wantState int
+	}{
+		{action: "route", want: "primary", wantState: CircuitHalfOpen},
+		{action: "route", want: "secondary", wantState: CircuitHalfOpen},
+		{action: "release", wantState: CircuitHalfOpen},
+		{action: "route", want: "primary", wantState: CircuitHalfOpen},
+		{action: "cancel", wantState: CircuitHalfOpen},
+		{action: "route", want: "primary", wantState: CircuitHalfOpen},
+		{action: "fail", wantState: CircuitOpen},
+		{action: "route", want: "secondary", wantState: CircuitOpen},
+	}
+
+	var probe *upstreamRoute
+
+	for i, step := range steps {
+		switch step.action {
+		case "route":
+			route := routeRequest(context.Background(), cfg, requestData)
+			if route.name != step.want {
+				t.Fatalf("step %d: routed to %s, want %s", i, route.name, step.want)
+			}
+
+			if route.probe {
+				probe = route
+			}
+		case "release":
+			releaseRoute(probe)
+		case "cancel", "fail":
+			err := error(errTestUpstream)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if step.action == "cancel" {
+				cancel()
+				err = ctx.Err()
+			}
+
+			data := requestData
+			data.route = probe
+
+			_, call := startUpstreamCall(ctx, probe.name, probe.upstream, data, false)
+			call.finish(cfg, log.NewEntry(logger), &upstreamOutcome{err: err})
+			cancel()
+		}
+
+		if state := circuitOf("primary"); state != step.wantState {
+			t.Errorf("step %d: state = %d, want %d", i, state, step.wantState)
+		}
+	}
+}
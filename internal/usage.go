@@ -0,0 +1,448 @@
+package internal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	usageRecordsBucket = []byte("records")
+	usageSpendBucket   = []byte("spend")
+
+	ErrUnknownUsageGroup = fmt.Errorf("unknown usage group")
+)
+
+// UsageRecord is what a single request cost.
+type UsageRecord struct {
+	Time             time.Time `json:"time"`
+	Client           string    `json:"client"`
+	Team             string    `json:"team"`
+	Upstream         string    `json:"upstream"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"promptTokens"`
+	CompletionTokens int       `json:"completionTokens"`
+	Cost             float64   `json:"cost"`
+}
+
+// UsageSummary aggregates the records sharing the same values for the grouped fields.
+type UsageSummary struct {
+	Group            map[string]string `json:"group"`
+	Requests         int               `json:"requests"`
+	PromptTokens     int               `json:"promptTokens"`
+	CompletionTokens int               `json:"completionTokens"`
+	Cost             float64           `json:"cost"`
+}
+
+// UsageStore persists usage records and running spend totals in a BoltDB file. Requests hand their
+// records to a background writer, which commits whatever has queued up in one transaction.
+type UsageStore struct {
+	db *bolt.DB
+
+	mu      sync.RWMutex // Keeps Enqueue from sending on the queue once Close has closed it
+	closed  bool
+	queue   chan usageWrite
+	stopped chan struct{} // Closed when the writer has written out the queue
+}
+
+// usageWrite is a queued record, with the logger of the request that made it.
+type usageWrite struct {
+	record UsageRecord
+	logger *log.Entry
+}
+
+const (
+	usageQueueSize = 1024 // Records waiting for the writer before Enqueue blocks
+	usageBatchSize = 256  // Records written in one transaction
+)
+
+var usageStore *UsageStore
+
+// InitializeUsageStore opens the usage database. Usage isn't tracked when no path is configured.
+func InitializeUsageStore(cfg *UsageConfig) error {
+	if cfg.Path == "" {
+		return nil
+	}
+
+	store, err := OpenUsageStore(cfg.Path)
+	if err != nil {
+		return err
+	}
+
+	usageStore = store
+
+	return nil
+}
+
+// CloseUsageStore flushes and closes the usage database, if one is open.
+func CloseUsageStore() error {
+	if usageStore == nil {
+		return nil
+	}
+
+	return usageStore.Close()
+}
+
+func OpenUsageStore(path string) (*UsageStore, error) {
+	const fileMode = 0o600
+
+	db, err := bolt.Open(path, fileMode, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("usage database open failed: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{usageRecordsBucket, usageSpendBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return fmt.Errorf("create bucket %s: %w", name, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("usage database init failed: %w", err)
+	}
+
+	store := &UsageStore{
+		db:      db,
+		queue:   make(chan usageWrite, usageQueueSize),
+		stopped: make(chan struct{}),
+	}
+
+	go store.write()
+
+	return store, nil
+}
+
+// Enqueue hands a record to the background writer, so requests don't wait for the disk. It only
+// blocks when the writer has fallen usageQueueSize records behind.
+func (s *UsageStore) Enqueue(logger *log.Entry, record UsageRecord) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		logger.WithFields(log.Fields{"client": record.Client}).Warn("Usage store closed, usage not recorded")
+		return
+	}
+
+	s.queue <- usageWrite{record: record, logger: logger}
+}
+
+// write records the queued usage until the queue is closed and empty.
+func (s *UsageStore) write() {
+	defer close(s.stopped)
+
+	for first := range s.queue {
+		batch := []usageWrite{first}
+
+	collect:
+		for len(batch) < usageBatchSize {
+			select {
+			case next, ok := <-s.queue:
+				if !ok {
+					break collect
+				}
+
+				batch = append(batch, next)
+			default:
+				break collect
+			}
+		}
+
+		records := make([]UsageRecord, 0, len(batch))
+		for _, queued := range batch {
+			records = append(records, queued.record)
+		}
+
+		if err := s.Record(records...); err != nil {
+			for _, queued := range batch {
+				queued.logger.WithFields(log.Fields{"error": err}).Error("Failed to record usage")
+			}
+		}
+	}
+}
+
+// Close writes out the queued records and closes the database.
+func (s *UsageStore) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	<-s.stopped
+
+	return s.db.Close()
+}
+
+// spendKeys are the running totals a record adds to, one per budget period.
+func spendKeys(client string, t time.Time) (string, string) {
+	t = t.UTC()
+	return client + "/day/" + t.Format("2006-01-02"), client + "/month/" + t.Format("2006-01")
+}
+
+// Record writes the records and adds them to the spend totals in one transaction.
+func (s *UsageStore) Record(records ...UsageRecord) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, record := range records {
+			if err := putUsageRecord(tx, record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("usage record failed: %w", err)
+	}
+
+	return nil
+}
+
+func putUsageRecord(tx *bolt.Tx, record UsageRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrJSONMarshalFailed, err)
+	}
+
+	records := tx.Bucket(usageRecordsBucket)
+
+	seq, err := records.NextSequence()
+	if err != nil {
+		return fmt.Errorf("next sequence: %w", err)
+	}
+
+	// Keys sort by time so reports can seek straight to the start of their range.
+	const keySize = 16
+	key := make([]byte, keySize)
+	binary.BigEndian.PutUint64(key, uint64(record.Time.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+
+	if err := records.Put(key, data); err != nil {
+		return fmt.Errorf("put record: %w", err)
+	}
+
+	spend := tx.Bucket(usageSpendBucket)
+	daily, monthly := spendKeys(record.Client, record.Time)
+
+	for _, name := range []string{daily, monthly} {
+		total := record.Cost
+		if current := spend.Get([]byte(name)); current != nil {
+			total += math.Float64frombits(binary.BigEndian.Uint64(current))
+		}
+
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, math.Float64bits(total))
+
+		if err := spend.Put([]byte(name), value); err != nil {
+			return fmt.Errorf("put spend: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Spend returns what the client has spent on the day and in the month containing t.
+func (s *UsageStore) Spend(client string, t time.Time) (float64, float64, error) {
+	var totals [2]float64
+
+	daily, monthly := spendKeys(client, t)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		spend := tx.Bucket(usageSpendBucket)
+
+		for i, name := range []string{daily, monthly} {
+			if value := spend.Get([]byte(name)); value != nil {
+				totals[i] = math.Float64frombits(binary.BigEndian.Uint64(value))
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("usage spend lookup failed: %w", err)
+	}
+
+	return totals[0], totals[1], nil
+}
+
+// Report aggregates the records in [from, to) by the given fields: key, team, upstream, model,
+// day and hour (UTC).
+func (s *UsageStore) Report(from time.Time, to time.Time, groupBy []string) ([]UsageSummary, error) {
+	for _, field := range groupBy {
+		if usageGroupValue(UsageRecord{}, field) == nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownUsageGroup, field)
+		}
+	}
+
+	summaries := map[string]*UsageSummary{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		start := make([]byte, 8)
+		binary.BigEndian.PutUint64(start, uint64(from.UnixNano()))
+
+		cursor := tx.Bucket(usageRecordsBucket).Cursor()
+		for key, value := cursor.Seek(start); key != nil; key, value = cursor.Next() {
+			if int64(binary.BigEndian.Uint64(key)) >= to.UnixNano() {
+				break
+			}
+
+			var record UsageRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return fmt.Errorf("%w: %v", ErrJSONUnmarshalFailed, err)
+			}
+
+			group := map[string]string{}
+			parts := make([]string, 0, len(groupBy))
+
+			for _, field := range groupBy {
+				group[field] = *usageGroupValue(record, field)
+				parts = append(parts, group[field])
+			}
+
+			id := strings.Join(parts, "\x00")
+
+			summary, ok := summaries[id]
+			if !ok {
+				summary = &UsageSummary{Group: group}
+				summaries[id] = summary
+			}
+
+			summary.Requests++
+			summary.PromptTokens += record.PromptTokens
+			summary.CompletionTokens += record.CompletionTokens
+			summary.Cost += record.Cost
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("usage report failed: %w", err)
+	}
+
+	report := make([]UsageSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		report = append(report, *summary)
+	}
+
+	sort.Slice(report, func(i, j int) bool { return report[i].Cost > report[j].Cost })
+
+	return report, nil
+}
+
+func usageGroupValue(record UsageRecord, field string) *string {
+	switch field {
+	case "key":
+		return &record.Client
+	case "team":
+		return &record.Team
+	case "upstream":
+		return &record.Upstream
+	case "model":
+		return &record.Model
+	case "day":
+		day := record.Time.UTC().Format("2006-01-02")
+		return &day
+	case "hour":
+		hour := record.Time.UTC().Format("2006-01-02T15:00Z")
+		return &hour
+	default:
+		return nil
+	}
+}
+
+// defaultPrice names the price of models missing from the pricing table.
+const defaultPrice = "default"
+
+// priceFor looks up the price of a model, falling back to the default price.
+func priceFor(cfg *Config, model string) (ModelPrice, bool) {
+	if price, ok := cfg.Pricing[model]; ok {
+		return price, true
+	}
+
+	price, ok := cfg.Pricing[defaultPrice]
+
+	return price, ok
+}
+
+// requestCost prices the tokens with the per-model price table.
+func requestCost(cfg *Config, model string, promptTokens int, completionTokens int) float64 {
+	const perTokens = 1000
+
+	price, _ := priceFor(cfg, model)
+
+	return (float64(promptTokens)*price.Prompt + float64(completionTokens)*price.Completion) / perTokens
+}
+
+// enforceBudget rejects requests from keys that have used up their daily or monthly budget.
+func enforceBudget(cfg *Config, logger *log.Entry, w http.ResponseWriter, requestData RequestData) bool {
+	key := lookupVirtualKey(cfg, requestData.Client)
+	if usageStore == nil || key == nil || key.Budget == (Budget{}) {
+		return true
+	}
+
+	daily, monthly, err := usageStore.Spend(requestData.Client, time.Now())
+	if err != nil {
+		// Fail open, the same as the rate limiter.
+		logger.WithFields(log.Fields{"error": err, "client": requestData.Client}).Error("Budget check failed")
+		return true
+	}
+
+	var exceeded string
+
+	switch {
+	case key.Budget.Daily > 0 && daily >= key.Budget.Daily:
+		exceeded = "daily"
+	case key.Budget.Monthly > 0 && monthly >= key.Budget.Monthly:
+		exceeded = "monthly"
+	default:
+		return true
+	}
+
+	logger.WithFields(log.Fields{"client": requestData.Client, "budget": exceeded}).Warn("Budget exceeded")
+	writeAPIError(w, http.StatusTooManyRequests,
+		fmt.Sprintf("You exceeded your %s budget for %s", exceeded, requestData.Client),
+		"insufficient_quota", "insufficient_quota")
+
+	return false
+}
+
+// recordUsage queues the tokens and cost of a finished request, or of a call the proxy made on its
+// behalf, for the usage store.
+func recordUsage(cfg *Config, logger *log.Entry, upstreamName string, requestData RequestData, completedResponse string) {
+	if usageStore == nil {
+		return
+	}
+
+	record := UsageRecord{
+		Time:             time.Now().UTC(),
+		Client:           requestData.Client,
+		Upstream:         upstreamName,
+		Model:            resolvedModel(requestData), // The model that answered, and is paid for
+		PromptTokens:     promptTokens(cfg, requestData),
+		CompletionTokens: countTokens(cfg, resolvedModel(requestData), completedResponse),
+	}
+
+	if key := lookupVirtualKey(cfg, requestData.Client); key != nil {
+		record.Team = key.Team
+	}
+
+	// Answers from the cache are free, but still show up in reports.
+	if upstreamName != cachedUpstream {
+		record.Cost = requestCost(cfg, record.Model, record.PromptTokens, record.CompletionTokens)
+	}
+
+	usageStore.Enqueue(logger, record)
+}
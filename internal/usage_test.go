@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"io"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestUsageStore(t *testing.T) {
+	store, err := OpenUsageStore(filepath.Join(t.TempDir(), "usage.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store.Close()
+
+	today := time.Date(2023, 10, 2, 9, 0, 0, 0, time.UTC)
+	yesterday := today.AddDate(0, 0, -1)
+
+	for _, record := range []UsageRecord{
+		{Time: yesterday, Client: "team", Model: "gpt-4", PromptTokens: 10, Cost: 1},
+		{Time: today, Client: "team", Model: "gpt-4", PromptTokens: 20, Cost: 2},
+		{Time: today, Client: "team", Model: "gpt-3.5-turbo", PromptTokens: 30, Cost: 0.5},
+		{Time: today, Client: "ci", Model: "gpt-4", PromptTokens: 40, Cost: 4},
+	} {
+		if err := store.Record(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	daily, monthly, err := store.Spend("team", today)
+	if err != nil || daily != 2.5 || monthly != 3.5 {
+		t.Errorf("Spend() = %v, %v, %v, want 2.5 and 3.5", daily, monthly, err)
+	}
+
+	tests := []struct {
+		name    string
+		from    time.Time
+		groupBy []string
+		want    []UsageSummary
+	}{
+		{
+			name:    "by key",
+			from:    yesterday,
+			groupBy: []string{"key"},
+			want: []UsageSummary{
+				{Group: map[string]string{"key": "ci"}, Requests: 1, PromptTokens: 40, Cost: 4},
+				{Group: map[string]string{"key": "team"}, Requests: 3, PromptTokens: 60, Cost: 3.5},
+			},
+		},
+		{
+			name:    "by model since today",
+			from:    today,
+			groupBy: []string{"model"},
+			want: []UsageSummary{
+				{Group: map[string]string{"model": "gpt-4"}, Requests: 2, PromptTokens: 60, Cost: 6},
+				{Group: map[string]string{"model": "gpt-3.5-turbo"}, Requests: 1, PromptTokens: 30, Cost: 0.5},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report, err := store.Report(test.from, today.Add(time.Hour), test.groupBy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(report, test.want) {
+				t.Errorf("Report() = %+v, want %+v", report, test.want)
+			}
+		})
+	}
+
+	if _, err := store.Report(yesterday, today, []string{"region"}); err == nil {
+		t.Error("Report() accepted an unknown group")
+	}
+}
+
+func TestUsageStoreQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.db")
+
+	store, err := OpenUsageStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	now := time.Now()
+
+	// More than fit in the queue or in one transaction.
+	for i := 0; i < usageQueueSize+usageBatchSize; i++ {
+		store.Enqueue(log.NewEntry(logger), UsageRecord{Time: now, Client: "team", Cost: 1})
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Records that come in late are dropped, not sent on the closed queue.
+	store.Enqueue(log.NewEntry(logger), UsageRecord{Time: now, Client: "team", Cost: 1})
+
+	store, err = OpenUsageStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store.Close()
+
+	if daily, _, err := store.Spend("team", now); err != nil || daily != usageQueueSize+usageBatchSize {
+		t.Errorf("Spend() = %v, %v, want every queued record", daily, err)
+	}
+}
+
+func TestRequestCost(t *testing.T) {
+	tests := []struct {
+		name    string
+		pricing map[string]ModelPrice
+		want    float64
+	}{
+		{name: "priced model", pricing: map[string]ModelPrice{"gpt-4": {Prompt: 0.03, Completion: 0.06}}, want: 0.06},
+		{name: "default price", pricing: map[string]ModelPrice{defaultPrice: {Prompt: 0.01, Completion: 0.01}}, want: 0.015},
+		{name: "unpriced model", pricing: map[string]ModelPrice{"gpt-3.5-turbo": {Prompt: 1}}},
+	}
+
+	for _, test := range tests {
+		got := requestCost(&Config{Pricing: test.pricing}, "gpt-4", 1000, 500)
+		if math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: requestCost() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestUnnamedKeyClient(t *testing.T) {
+	// Both keys redact to the same name.
+	first, second := "sk-aaaa-first-1234", "sk-aaaa-second-1234"
+
+	if redactKey(first) != redactKey(second) {
+		t.Fatal("the keys should redact alike")
+	}
+
+	if unnamedKeyClient(first) == unnamedKeyClient(second) {
+		t.Error("keys that redact alike share a client name")
+	}
+
+	if unnamedKeyClient(first) != unnamedKeyClient(first) {
+		t.Error("the client name of a key isn't stable")
+	}
+
+	cfg := &Config{Keys: map[Secret]VirtualKey{Secret(first): {Budget: Budget{Daily: 1}}, Secret(second): {}}}
+
+	if key := lookupVirtualKey(cfg, unnamedKeyClient(first)); key == nil || key.Budget.Daily != 1 {
+		t.Errorf("lookupVirtualKey() = %+v, want the first key", key)
+	}
+}
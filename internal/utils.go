@@ -18,7 +18,7 @@ var (
 )
 
 // Reads Data from the Client.
-func ReadAndUnmarshalBody(cfg *Config, logger *log.Logger, resp http.ResponseWriter, req *http.Request) (RequestData, error) {
+func ReadAndUnmarshalBody(cfg *Config, logger *log.Entry, resp http.ResponseWriter, req *http.Request) (RequestData, error) {
 	var requestData RequestData
 
 	// Read the request body
@@ -28,16 +28,16 @@ func ReadAndUnmarshalBody(cfg *Config, logger *log.Logger, resp http.ResponseWri
 			"status":  "error",
 			"message": "error reading request body",
 		}
-		err, marshalErr := json.MarshalIndent(errorResponse, "", "  ")
+		errorData, marshalErr := json.MarshalIndent(errorResponse, "", "  ")
 
-		if err != nil {
+		if marshalErr != nil {
 			logger.WithFields(log.Fields{"error": marshalErr}).Error("failed to marshal JSON")
 			http.Error(resp, "Internal Server Error", http.StatusInternalServerError)
 
 			return requestData, fmt.Errorf("json.MarshalIndent failed: %w", marshalErr)
 		}
 
-		http.Error(resp, string(err), http.StatusInternalServerError)
+		http.Error(resp, string(errorData), http.StatusInternalServerError)
 
 		return requestData, fmt.Errorf("io.ReadAll failed: %w", err)
 	}
@@ -81,7 +81,7 @@ func ReadAndUnmarshalBody(cfg *Config, logger *log.Logger, resp http.ResponseWri
 		}
 
 		http.Error(resp, string(errorData), http.StatusBadRequest)
-		logger.WithFields(log.Fields{"error": err, "body": string(body)}).Error("Error parsing JSON payload")
+		logger.WithFields(log.Fields{"error": err, "bodyBytes": len(body)}).Error("Error parsing JSON payload")
 
 		return requestData, fmt.Errorf("%w: %v", ErrJSONUnmarshalFailed, err)
 	}
@@ -89,17 +89,12 @@ func ReadAndUnmarshalBody(cfg *Config, logger *log.Logger, resp http.ResponseWri
 	return requestData, nil
 }
 
-func createJSONResponse(content string, responseType string, isClosing bool) JSONResponse {
+func createJSONResponse(id string, content string, responseType string, isClosing bool) JSONResponse {
 	commonFields := JSONResponse{
-		ID:      "chatcmpl-1692118020279965440",
+		ID:      id,           // The request ID, so clients can quote it when reporting a problem
 		Object:  responseType, // This can be "chat.completion" or "text_completion"
 		Created: 1692118020,
 		Model:   "Nous-Hermes-Llama2-GPTQ",
-		Usage: map[string]interface{}{
-			"prompt_tokens":     58,
-			"completion_tokens": 100,
-			"total_tokens":      1000,
-		},
 	}
 
 	if responseType == "chat.completion" {
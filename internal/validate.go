@@ -0,0 +1,387 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// ConfigError is a problem with one setting of the configuration.
+type ConfigError struct {
+	Setting string
+	Problem string
+	Err     error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Setting + ": " + e.Problem
+}
+
+func (e *ConfigError) Is(target error) bool {
+	return target == ErrInvalidConfig
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+type configProblems []error
+
+func (p *configProblems) add(setting string, format string, args ...interface{}) {
+	*p = append(*p, &ConfigError{Setting: setting, Problem: fmt.Sprintf(format, args...)})
+}
+
+func (p *configProblems) addErr(setting string, err error) {
+	*p = append(*p, &ConfigError{Setting: setting, Problem: err.Error(), Err: err})
+}
+
+// ValidateConfig checks the configuration as a whole, so that mistakes are reported at startup
+// rather than when the first request runs into them. All problems are returned, joined.
+func ValidateConfig(cfg *Config) error {
+	var problems configProblems
+
+	validateUpstreams(&problems, cfg)
+	validateListeners(&problems, cfg)
+	validateProfiles(&problems, cfg)
+	validateLogConfig(&problems, "logConfig", cfg.LogConfig, true)
+
+	if cfg.Admin.Port != "" && cfg.Admin.Token == "" {
+		problems.add("admin.token", "is required when admin.port is set")
+	}
+
+	if cfg.RateLimits.Store != "" && !rateLimitStoreRegistered(cfg.RateLimits.Store) {
+		problems.addErr("rateLimits.store", fmt.Errorf("%w: %s", ErrUnknownRateLimitStore, cfg.RateLimits.Store))
+	}
+
+	switch cfg.ContextOverflow {
+	case "", "reject", "trim":
+	default:
+		problems.add("contextOverflow", "%q is not reject or trim", cfg.ContextOverflow)
+	}
+
+	for i, name := range cfg.Interceptors {
+		if _, ok := interceptors[name]; !ok {
+			problems.addErr(fmt.Sprintf("interceptors[%d]", i), fmt.Errorf("%w: %s", ErrUnknownInterceptor, name))
+		}
+	}
+
+	switch cfg.Truncation.Strategy {
+	case "", TruncationKeepLastTurns, TruncationSlidingWindow, TruncationSummarize:
+	default:
+		problems.addErr("truncation.strategy", fmt.Errorf("%w: %s", ErrUnknownTruncationStrategy, cfg.Truncation.Strategy))
+	}
+
+	validateUpstreamReference(&problems, cfg, "truncation.summaryUpstream", cfg.Truncation.SummaryUpstream)
+
+	if cfg.Truncation.SummaryTimeout < 0 {
+		problems.add("truncation.summaryTimeout", "can't be negative")
+	}
+
+	validateCache(&problems, cfg)
+
+	if cfg.CircuitBreaker.FailureThreshold < 0 || cfg.CircuitBreaker.Cooldown < 0 {
+		problems.add("circuitBreaker", "failureThreshold and cooldown can't be negative")
+	}
+
+	switch cfg.Tracing.Exporter {
+	case "", "otlp", "none":
+	default:
+		problems.addErr("tracing.exporter", fmt.Errorf("%w: %s", ErrUnknownTraceExporter, cfg.Tracing.Exporter))
+	}
+
+	if cfg.Tracing.SampleRatio != nil {
+		validateRatio(&problems, "tracing.sampleRatio", *cfg.Tracing.SampleRatio)
+	}
+	if cfg.Capture.SampleRatio != nil {
+		validateRatio(&problems, "capture.sampleRatio", *cfg.Capture.SampleRatio)
+	}
+
+	if cfg.Audit.Output.LogOutput != "" {
+		validateLogConfig(&problems, "audit.output", cfg.Audit.Output, false)
+	}
+
+	validatePricing(&problems, cfg)
+
+	if cfg.Shutdown.DrainTimeout < 0 {
+		problems.add("shutdown.drainTimeout", "can't be negative")
+	}
+
+	if _, err := newRedactor(&cfg.Redaction); err != nil {
+		problems.addErr("redaction", err)
+	}
+
+	return errors.Join(problems...)
+}
+
+func validateUpstreams(problems *configProblems, cfg *Config) {
+	if len(cfg.Upstreams) == 0 {
+		problems.add("upstreams", "at least one upstream is required")
+		return
+	}
+
+	names := make([]string, 0, len(cfg.Upstreams))
+	for name := range cfg.Upstreams {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		upstream := cfg.Upstreams[name]
+		setting := "upstreams." + name
+
+		switch upstream.Type {
+		case "azure":
+			if upstream.URL == "" {
+				problems.add(setting+".url", "is required for azure upstreams")
+			}
+		case "openai":
+		default:
+			problems.addErr(setting+".type", fmt.Errorf("%w: %q is not azure or openai", ErrInvalidUpstreamType, upstream.Type))
+		}
+
+		if upstream.APIKey == "" {
+			problems.add(setting+".apiKey", "is required")
+		}
+
+		if upstream.URL != "" {
+			if parsed, err := url.Parse(upstream.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				problems.add(setting+".url", "%q is not an http(s) URL", upstream.URL)
+			}
+		}
+
+		validateUpstreamTransport(problems, setting+".transport", upstream.Transport)
+
+		if upstream.Weight < 0 {
+			problems.add(setting+".weight", "can't be negative")
+		}
+	}
+}
+
+// validatePricing makes sure budgets can't be bypassed by models without a price, which would
+// cost nothing.
+func validatePricing(problems *configProblems, cfg *Config) {
+	budgets := false
+	for _, key := range cfg.Keys {
+		budgets = budgets || key.Budget != (Budget{})
+	}
+
+	if !budgets {
+		return
+	}
+
+	names := make([]string, 0, len(cfg.Upstreams))
+	for name := range cfg.Upstreams {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	unpriced := map[string]bool{}
+
+	for _, name := range names {
+		for _, requestType := range []string{"chat", "completion"} {
+			model := upstreamModel(cfg.Upstreams[name], requestType)
+
+			if _, ok := priceFor(cfg, model); !ok && !unpriced[model] {
+				unpriced[model] = true
+				problems.add("pricing", "%q, the model of upstream %s, has no price; budgets need every model priced, or a %q price",
+					model, name, defaultPrice)
+			}
+		}
+	}
+}
+
+func validateUpstreamTransport(problems *configProblems, setting string, transport UpstreamTransport) {
+	if transport.ConnectTimeout < 0 || transport.ResponseHeaderTimeout < 0 || transport.IdleTimeout < 0 {
+		problems.add(setting, "timeouts can't be negative")
+	}
+
+	if transport.MaxConnections < 0 || transport.MaxIdleConnections < 0 {
+		problems.add(setting, "connection limits can't be negative")
+	}
+
+	if (transport.CertFile == "") != (transport.KeyFile == "") {
+		problems.add(setting, "certFile and keyFile are required together")
+		return
+	}
+
+	if _, err := newUpstreamTransport(transport); err != nil {
+		problems.addErr(setting, err)
+	}
+}
+
+func validateListeners(problems *configProblems, cfg *Config) {
+	if len(cfg.Listeners) == 0 {
+		problems.add("listeners", "at least one listener is required")
+	}
+
+	for i, listener := range cfg.Listeners {
+		setting := fmt.Sprintf("listeners[%d]", i)
+
+		switch {
+		case listener.Socket != "" && listener.Systemd != "":
+			problems.add(setting, "socket and systemd can't both be set")
+		case listener.Socket != "" || listener.Systemd != "":
+			if listener.Interface != "" || listener.Port != "" {
+				problems.add(setting, "interface and port can't be combined with socket or systemd")
+			}
+		default:
+			if port, err := strconv.Atoi(listener.Port); err != nil || port < 1 || port > 65535 {
+				problems.add(setting+".port", "%q is not a port number", listener.Port)
+			}
+
+			if strings.Contains(listener.Interface, ":") && net.ParseIP(listener.Interface) == nil {
+				problems.add(setting+".interface", "%q is not an IPv6 address, write them without brackets", listener.Interface)
+			}
+		}
+
+		if listener.SocketMode != "" {
+			if _, err := strconv.ParseUint(listener.SocketMode, 8, 32); err != nil {
+				problems.add(setting+".socketMode", "%q is not an octal mode", listener.SocketMode)
+			}
+		}
+
+		if listener.ReadHeaderTimeout < 0 || listener.ReadTimeout < 0 || listener.IdleTimeout < 0 || listener.WriteTimeout < 0 {
+			problems.add(setting, "timeouts can't be negative")
+		}
+
+		validateListenerTLS(problems, cfg, i, listener)
+		validateListenerHTTP2(problems, cfg, i, listener)
+		validateListenerCORS(problems, i, listener)
+	}
+}
+
+func validateListenerHTTP2(problems *configProblems, cfg *Config, i int, listener Listener) {
+	settings := listener.HTTP2
+	if settings == nil {
+		return
+	}
+
+	setting := fmt.Sprintf("listeners[%d].http2", i)
+
+	if settings.H2C && listenerTLS(cfg, listener) != nil {
+		problems.add(setting+".h2c", "is for listeners without TLS, which offer HTTP/2 anyway")
+	}
+
+	// Smaller connection windows than the initial one of the protocol are ignored.
+	if settings.ConnectionWindowSize != 0 && settings.ConnectionWindowSize < 65535 {
+		problems.add(setting+".connectionWindowSize", "%d is less than the minimum of 65535", settings.ConnectionWindowSize)
+	}
+
+	if settings.StreamWindowSize < 0 {
+		problems.add(setting+".streamWindowSize", "can't be negative")
+	}
+}
+
+func validateListenerTLS(problems *configProblems, cfg *Config, i int, listener Listener) {
+	settings := listenerTLS(cfg, listener)
+	if settings == nil {
+		return
+	}
+
+	// Listeners without TLS settings of their own use the global files.
+	certSetting, keySetting := "certFile", "keyFile"
+	if listener.TLS != nil {
+		certSetting = fmt.Sprintf("listeners[%d].tls.certFile", i)
+		keySetting = fmt.Sprintf("listeners[%d].tls.keyFile", i)
+	}
+
+	found := len(*problems)
+
+	validateFileExists(problems, certSetting, settings.CertFile)
+	validateFileExists(problems, keySetting, settings.KeyFile)
+
+	if len(*problems) > found {
+		return
+	}
+
+	if _, err := buildTLSConfig(settings); err != nil {
+		problems.addErr(fmt.Sprintf("listeners[%d].tls", i), err)
+	}
+
+	for identity, client := range settings.ClientIdentities {
+		if lookupVirtualKey(cfg, client) == nil {
+			problems.add(fmt.Sprintf("listeners[%d].tls.clientIdentities.%s", i, identity), "%q is not the name of a client key", client)
+		}
+	}
+}
+
+// validateLogConfig checks what InitializeLogger needs. The audit log has no level of its own.
+func validateLogConfig(problems *configProblems, setting string, cfg LogConfig, checkLevel bool) {
+	switch cfg.LogOutput {
+	case "stdout":
+	case "file":
+		if cfg.Filepath == "" || cfg.Filesize <= 0 || cfg.FileCount <= 0 {
+			problems.add(setting, "filepath, filesize and fileCount are required for file output")
+		}
+	default:
+		problems.add(setting+".logOutput", "%q is not stdout or file", cfg.LogOutput)
+	}
+
+	if checkLevel {
+		if _, err := log.ParseLevel(cfg.LogLevel); err != nil {
+			problems.addErr(setting+".logLevel", err)
+		}
+	}
+}
+
+func validateCache(problems *configProblems, cfg *Config) {
+	switch cfg.Cache.Backend {
+	case "", "memory":
+	case "disk":
+		if cfg.Cache.Path == "" {
+			problems.add("cache.path", "is required for the disk backend")
+		}
+	default:
+		problems.add("cache.backend", "%q is not memory or disk", cfg.Cache.Backend)
+	}
+
+	if cfg.Cache.TTL < 0 {
+		problems.add("cache.ttl", "can't be negative")
+	}
+
+	if cfg.Cache.Semantic.Enabled {
+		if cfg.Cache.Semantic.Upstream == "" {
+			problems.add("cache.semantic.upstream", "is required when the semantic cache is enabled")
+		}
+
+		validateUpstreamReference(problems, cfg, "cache.semantic.upstream", cfg.Cache.Semantic.Upstream)
+
+		if cfg.Cache.Semantic.Timeout < 0 {
+			problems.add("cache.semantic.timeout", "can't be negative")
+		}
+	}
+}
+
+func validateUpstreamReference(problems *configProblems, cfg *Config, setting string, name string) {
+	if _, ok := cfg.Upstreams[name]; name != "" && !ok {
+		problems.addErr(setting, fmt.Errorf("%w: %s", ErrUnknownUpstream, name))
+	}
+}
+
+func validateFileExists(problems *configProblems, setting string, path string) {
+	if path == "" {
+		problems.add(setting, "is required for TLS")
+		return
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		problems.addErr(setting, err)
+	}
+}
+
+func validateRatio(problems *configProblems, setting string, ratio float64) {
+	if ratio < 0 || ratio > 1 {
+		problems.add(setting, "%v is not between 0 and 1", ratio)
+	}
+}
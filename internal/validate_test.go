@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+)
+
+// validTestConfig passes ValidateConfig, the cases below break one part of it.
+func validTestConfig() *Config {
+	return &Config{
+		Upstreams: map[string]Upstream{
+			"primary": {Type: "azure", URL: "https://primary.example.com", Model: "gpt-35-turbo", APIKey: "sk-primary"},
+			"backup":  {Type: "openai", Model: "gpt-3.5-turbo", APIKey: "sk-backup"},
+		},
+		Listeners: []Listener{{Interface: "0.0.0.0", Port: "6001"}},
+		LogConfig: LogConfig{LogOutput: "stdout", LogLevel: "info"},
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), "proxy.example.com")
+	ratio := func(r float64) *float64 { return &r }
+
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+		want   []string // settings with problems
+	}{
+		{
+			name:   "valid",
+			change: func(cfg *Config) {},
+		},
+		{
+			name:   "no upstreams or listeners",
+			change: func(cfg *Config) { cfg.Upstreams, cfg.Listeners = nil, nil },
+			want:   []string{"listeners", "upstreams"},
+		},
+		{
+			name: "upstream problems",
+			change: func(cfg *Config) {
+				cfg.Upstreams["primary"] = Upstream{Type: "azure"}
+				cfg.Upstreams["backup"] = Upstream{Type: "anthropic", URL: "ftp://backup", APIKey: "sk-backup", Weight: -1}
+			},
+			want: []string{
+				"upstreams.backup.type", "upstreams.backup.url", "upstreams.backup.weight",
+				"upstreams.primary.apiKey", "upstreams.primary.url",
+			},
+		},
+		{
+			name: "upstream transport",
+			change: func(cfg *Config) {
+				backup := cfg.Upstreams["backup"]
+				backup.Transport = UpstreamTransport{ConnectTimeout: -time.Second, CertFile: "/etc/proxy/client.pem"}
+				cfg.Upstreams["backup"] = backup
+			},
+			want: []string{"upstreams.backup.transport", "upstreams.backup.transport"},
+		},
+		{
+			name: "listener problems",
+			change: func(cfg *Config) {
+				cfg.Listeners = []Listener{
+					{Port: "http"},
+					{Interface: "[::1]", Port: "6002"},
+					{Socket: "/run/proxy.sock", Systemd: "api"},
+					{Socket: "/run/proxy.sock", Port: "6003", SocketMode: "rw"},
+					{Port: "6004", WriteTimeout: -time.Second},
+				}
+			},
+			want: []string{
+				"listeners[0].port", "listeners[1].interface", "listeners[2]", "listeners[3]",
+				"listeners[3].socketMode", "listeners[4]",
+			},
+		},
+		{
+			name: "unix and systemd listeners need no port",
+			change: func(cfg *Config) {
+				cfg.Listeners = []Listener{{Socket: "/run/proxy.sock", SocketMode: "0660"}, {Systemd: "api"}}
+			},
+		},
+		{
+			name: "listener TLS without its files",
+			change: func(cfg *Config) {
+				cfg.Listeners = []Listener{{Port: "6001", TLS: &ListenerTLS{KeyFile: "/nonexistent/key.pem"}}}
+			},
+			want: []string{"listeners[0].tls.certFile", "listeners[0].tls.keyFile"},
+		},
+		{
+			name: "profiles",
+			change: func(cfg *Config) {
+				cfg.Listeners = []Listener{{Port: "6001", Profile: "batch"}, {Port: "6002", Profile: "missing"}}
+				cfg.Profiles = map[string]Profile{
+					"batch": {Upstreams: []string{"backup", "other"}, Endpoints: []string{"embeddings"}, Auth: ProfileAuthClientCert},
+					"keys":  {Auth: ProfileAuthKey},
+				}
+			},
+			want: []string{
+				"listeners[0].profile", "listeners[1].profile", "profiles.batch.endpoints[0]",
+				"profiles.batch.upstreams[1]", "profiles.keys.auth",
+			},
+		},
+		{
+			name: "listener HTTP/2",
+			change: func(cfg *Config) {
+				cfg.UseTLS, cfg.CertFile, cfg.KeyFile = true, certFile, keyFile
+				cfg.Listeners = []Listener{
+					{Port: "6001", HTTP2: &ListenerHTTP2{H2C: true}},
+					{Port: "6002", HTTP2: &ListenerHTTP2{ConnectionWindowSize: 1024, StreamWindowSize: -1}},
+				}
+			},
+			want: []string{"listeners[0].http2.h2c", "listeners[1].http2.connectionWindowSize", "listeners[1].http2.streamWindowSize"},
+		},
+		{
+			name:   "admin port without a token",
+			change: func(cfg *Config) { cfg.Admin.Port = "6002" },
+			want:   []string{"admin.token"},
+		},
+		{
+			name: "unknown names",
+			change: func(cfg *Config) {
+				cfg.RateLimits.Store = "redis"
+				cfg.ContextOverflow = "drop"
+				cfg.Interceptors = []string{"googleSearch", "bing"}
+				cfg.Truncation.Strategy = "random"
+				cfg.Truncation.SummaryUpstream = "missing"
+				cfg.Tracing.Exporter = "jaeger"
+			},
+			want: []string{
+				"contextOverflow", "interceptors[1]", "rateLimits.store", "tracing.exporter",
+				"truncation.strategy", "truncation.summaryUpstream",
+			},
+		},
+		{
+			name: "logging",
+			change: func(cfg *Config) {
+				cfg.LogConfig = LogConfig{LogOutput: "file", LogLevel: "loud"}
+				cfg.Audit.Output = LogConfig{LogOutput: "syslog"}
+			},
+			want: []string{"audit.output.logOutput", "logConfig", "logConfig.logLevel"},
+		},
+		{
+			name: "cache",
+			change: func(cfg *Config) {
+				cfg.Cache = CacheConfig{Backend: "disk", TTL: -time.Minute}
+				cfg.Cache.Semantic = SemanticCacheConfig{Enabled: true, Timeout: -time.Second}
+			},
+			want: []string{"cache.path", "cache.semantic.timeout", "cache.semantic.upstream", "cache.ttl"},
+		},
+		{
+			name: "ratios",
+			change: func(cfg *Config) {
+				cfg.Tracing.SampleRatio = ratio(1.5)
+				cfg.Capture.SampleRatio = ratio(-0.1)
+			},
+			want: []string{"capture.sampleRatio", "tracing.sampleRatio"},
+		},
+		{
+			name: "zero ratios are valid",
+			change: func(cfg *Config) {
+				cfg.Tracing.SampleRatio = ratio(0)
+				cfg.Capture.SampleRatio = ratio(0)
+			},
+		},
+		{
+			name: "negative durations and counts",
+			change: func(cfg *Config) {
+				cfg.CircuitBreaker.FailureThreshold = -1
+				cfg.Cache.TTL = -time.Second
+				cfg.Shutdown.DrainTimeout = -time.Second
+				cfg.Truncation.SummaryTimeout = -time.Second
+			},
+			want: []string{"cache.ttl", "circuitBreaker", "shutdown.drainTimeout", "truncation.summaryTimeout"},
+		},
+		{
+			name:   "redaction",
+			change: func(cfg *Config) { cfg.Redaction.Patterns = []RedactionPattern{{Name: "bad", Pattern: "("}} },
+			want:   []string{"redaction"},
+		},
+		{
+			name: "budgets need every upstream model priced",
+			change: func(cfg *Config) {
+				cfg.Keys = map[Secret]VirtualKey{"sk-client": {Name: "client", Budget: Budget{Daily: 10}}}
+				cfg.Pricing = map[string]ModelPrice{"gpt-3.5-turbo": {}}
+			},
+			want: []string{"pricing"},
+		},
+		{
+			name: "budgets with a default price",
+			change: func(cfg *Config) {
+				cfg.Keys = map[Secret]VirtualKey{"sk-client": {Name: "client", Budget: Budget{Daily: 10}}}
+				cfg.Pricing = map[string]ModelPrice{defaultPrice: {}}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := validTestConfig()
+			test.change(cfg)
+
+			err := ValidateConfig(cfg)
+
+			var got []string
+
+			var joined interface{ Unwrap() []error }
+			if errors.As(err, &joined) {
+				for _, problem := range joined.Unwrap() {
+					var configError *ConfigError
+					if !errors.As(problem, &configError) {
+						t.Fatalf("problem %v is not a ConfigError", problem)
+					}
+
+					if !errors.Is(problem, ErrInvalidConfig) {
+						t.Errorf("problem %v is not an ErrInvalidConfig", problem)
+					}
+
+					got = append(got, configError.Setting)
+				}
+			} else if err != nil {
+				t.Fatalf("ValidateConfig() = %v", err)
+			}
+
+			sort.Strings(got)
+
+			if len(got) != len(test.want) {
+				t.Fatalf("problems with %v, want %v\n%v", got, test.want, err)
+			}
+
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("problems with %v, want %v\n%v", got, test.want, err)
+					break
+				}
+			}
+		})
+	}
+}